@@ -1,13 +1,40 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
+	"io/ioutil"
+	"strings"
 
 	goovn "github.com/ebay/go-ovn"
 )
 
 func main() {
-	ovndbapi, err := goovn.NewClient(&goovn.Config{Addr: "tcp:127.0.0.1:6643"})
+	addr := flag.String("db", "tcp:127.0.0.1:6643", "Comma separated NB database cluster endpoints (tcp:IP:PORT or ssl:IP:PORT)")
+	privateKey := flag.String("ssl-private-key", "", "Path to the private key for ssl: addresses")
+	certificate := flag.String("ssl-certificate", "", "Path to the certificate for ssl: addresses")
+	caCert := flag.String("ssl-ca-cert", "", "Path to the CA certificate for ssl: addresses")
+	flag.Parse()
+
+	err := checkTLSFlags(*addr, *privateKey, *certificate, *caCert)
+	if err != nil {
+		panic(err)
+	}
+
+	// Reads can be served by any member of a cluster, so go-ovn is given all of them to try in turn.
+	cfg := &goovn.Config{Addr: *addr}
+	if strings.Contains(","+*addr, ",ssl:") {
+		tlsConfig, err := loadTLSConfig(*privateKey, *certificate, *caCert)
+		if err != nil {
+			panic(err)
+		}
+
+		cfg.TLSConfig = tlsConfig
+	}
+
+	ovndbapi, err := goovn.NewClient(cfg)
 	if err != nil {
 		panic(err)
 	}
@@ -21,3 +48,71 @@ func main() {
 		fmt.Printf("%v\n", *lp)
 	}
 }
+
+// checkTLSFlags checks that either all or none of the SSL files are set, and that they are set for ssl: addresses.
+func checkTLSFlags(addr string, privateKey string, certificate string, caCert string) error {
+	set := 0
+	for _, path := range []string{privateKey, certificate, caCert} {
+		if path != "" {
+			set++
+		}
+	}
+
+	if set != 0 && set != 3 {
+		return fmt.Errorf("-ssl-private-key, -ssl-certificate and -ssl-ca-cert must all be set, or none of them")
+	}
+
+	if set == 0 && strings.Contains(","+addr, ",ssl:") {
+		return fmt.Errorf("-ssl-private-key, -ssl-certificate and -ssl-ca-cert are required for ssl: addresses")
+	}
+
+	return nil
+}
+
+// loadTLSConfig returns the TLS configuration for connecting to an OVN database over SSL.
+// The server certificate is only checked against the CA certificate, as certificates issued by ovs-pki don't name
+// the host.
+func loadTLSConfig(privateKey string, certificate string, caCert string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certificate, privateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM, err := ioutil.ReadFile(caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("No certificates found in %q", caCert)
+	}
+
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("No server certificate")
+			}
+
+			serverCert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, rawCert := range rawCerts[1:] {
+				intermediate, err := x509.ParseCertificate(rawCert)
+				if err != nil {
+					return err
+				}
+
+				intermediates.AddCert(intermediate)
+			}
+
+			_, err = serverCert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		},
+	}, nil
+}
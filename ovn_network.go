@@ -2,32 +2,73 @@ package main
 
 import (
 	"bytes"
-	cryptoRand "crypto/rand"
 	"encoding/hex"
+	"flag"
 	"fmt"
 	"log"
-	"math/big"
 	"math/rand"
 	"net"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mdlayher/netx/eui64"
 
 	"github.com/lxc/lxd/shared"
 )
 
+// network is a project network. The settings of an IP family the network doesn't have are empty.
 type network struct {
 	name         string
+	ipv4         bool
+	ipv6         bool
 	gw4          string
 	gw6          string
 	dns4         string
 	dns6         string
+	ipv6Mode     string
 	extBridge    string
 	extIP4       string
+	extIP4Subnet string
+	extIP4Range  string
 	extIP6Prefix string
 	extGW4       string
 	extGW6       string
+	routed4      bool // Route the internal IPv4 subnet to the uplink instead of SNATing it.
+	routed6      bool // Route the internal IPv6 subnet to the uplink instead of SNATing it.
+	instances    []string
+	instanceIPs  map[string]instanceAddresses
+	reservedIPs  []string
+	routes       []staticRoute
+
+	// The transit switch the router is attached to, if any, and the subnets of the transit router port for each IP
+	// family the network and transit switch both have. The availability zone is part of the transit port names.
+	transitSwitch    string
+	transitNet4      string
+	transitNet6      string
+	availabilityZone string
+
+	// subnets are the internal subnets allocated from the subnet pool, keyed by the logical router external_ids
+	// key they are recorded under.
+	subnets map[string]string
+}
+
+// staticRoute is a static route on a project network's router, in addition to the default routes to the uplink.
+// The output port is empty if the route doesn't set one, and the policy is dst-ip or src-ip.
+type staticRoute struct {
+	prefix     string
+	nexthop    string
+	outputPort string
+	policy     string
+}
+
+// instanceAddresses are the static addresses of an instance port. If the IPv6 address is empty it is derived from
+// the port's MAC address.
+type instanceAddresses struct {
+	ipv4 string
+	ipv6 string
 }
 
 const ndbIP = "10.109.89.178"
@@ -38,96 +79,360 @@ const dnsDomainName = "lxd"
 const dnsV6SearchDomains = "lxd"
 
 func main() {
-	if len(os.Args) < 2 || os.Args[1] == "" {
+	topologyFile := flag.String("topology", "topology.yaml", "Path to YAML or JSON topology file")
+	flag.BoolVar(&dryRun, "dry-run", false, "Print the commands that would be run instead of running them")
+	nbBackend := flag.String("nb-backend", "ovsdb", "How to access the NB database (ovsdb, nbctl or memory)")
+	flag.StringVar(&ovnSSL.privateKey, "ssl-private-key", "", "Path to the private key used to connect to the OVN databases over SSL")
+	flag.StringVar(&ovnSSL.certificate, "ssl-certificate", "", "Path to the certificate used to connect to the OVN databases over SSL")
+	flag.StringVar(&ovnSSL.caCert, "ssl-ca-cert", "", "Path to the CA certificate used to verify the OVN databases over SSL")
+	nbDB := flag.String("nb-db", "", "Comma separated NB database cluster endpoints (defaults to port 6643 on the OVN host)")
+	sbDB := flag.String("sb-db", "", "Comma separated SB database cluster endpoints (defaults to port 6642 on the OVN host)")
+	flag.StringVar(&macSeed, "mac-seed", "", "Seed mixed into the MAC addresses derived from port names")
+	flag.StringVar(&macOUI, "mac-oui", macOUI, "OUI prefix of generated MAC addresses")
+	format := flag.String("format", "", "Output format of the status and diff modes (table or json) or the export-graph mode (dot or mermaid)")
+	flag.Parse()
+
+	mode := flag.Arg(0)
+	if mode == "" {
 		log.Fatal("no mode supplied")
 	}
 
-	mode := os.Args[1]
+	if !shared.StringInSlice(mode, []string{"net", "instance", "all", "delete", "status", "diff", "import", "export-graph", "peer", "unpeer"}) {
+		log.Fatalf("unknown mode %q (valid modes are net, instance, all, delete, status, diff, import, export-graph, peer and unpeer)", mode)
+	}
+
+	// The first format is the default.
+	formats := []string{"table", "json"}
+	if mode == "export-graph" {
+		formats = []string{"dot", "mermaid"}
+	}
+
+	if *format == "" {
+		*format = formats[0]
+	}
+
+	if !shared.StringInSlice(*format, formats) {
+		log.Fatalf("unknown format %q for mode %q (valid formats are %s)", *format, mode, strings.Join(formats, " and "))
+	}
+
+	// An instance name supplied on the command line is used for every network instead of those in the topology.
+	// In import mode it is the project to import instead.
+	instance := flag.Arg(1)
+
+	// The import mode writes out a topology rather than reading one.
+	var t *topology
+	var err error
+	if mode != "import" {
+		t, err = loadTopology(*topologyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	err = validateMACOUI(macOUI)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = ovnSSL.validate()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	nbEndpoints, err = parseDBEndpoints(*nbDB, 6643)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sbEndpoints, err = parseDBEndpoints(*sbDB, 6642)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch *nbBackend {
+	case "ovsdb":
+		tlsConfig, err := ovnSSL.tlsConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		client, err := newOVSDBClient(nbEndpoints, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		defer client.Close()
+		nb = client
+
+		if len(nbEndpoints) > 1 {
+			log.Printf("Using NB database cluster leader %q", client.endpoint)
+		}
+	case "nbctl":
+		nb = &nbctlClient{}
+	case "memory":
+		nb = newMemoryClient()
+	default:
+		log.Fatalf("unknown NB backend %q (valid backends are ovsdb, nbctl and memory)", *nbBackend)
+	}
+
+	if mode == "import" {
+		imported, err := importTopology(instance)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = writeImportedTopology(os.Stdout, imported)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	// Peering connects the routers of two existing project networks, given as <project>/<network>.
+	if mode == "peer" || mode == "unpeer" {
+		projectName, network, err := findProjectNetwork(t, flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		peerProjectName, peerNetwork, err := findProjectNetwork(t, flag.Arg(2))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if projectName == peerProjectName && network.name == peerNetwork.name {
+			log.Fatalf("can't peer project %q network %q with itself", projectName, network.name)
+		}
+
+		if mode == "peer" {
+			err = peerProjectNetworks(projectName, network, peerProjectName, peerNetwork)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Peered project %q network %q with project %q network %q", projectName, network.name, peerProjectName, peerNetwork.name)
+		} else {
+			err = unpeerProjectNetworks(projectName, network, peerProjectName, peerNetwork)
+			if err != nil {
+				log.Fatal(err)
+			}
+			log.Printf("Unpeered project %q network %q from project %q network %q", projectName, network.name, peerProjectName, peerNetwork.name)
+		}
+
+		if dryRun {
+			printPlan(os.Stdout)
+		}
+
+		return
+	}
+
+	// Comparing the NB database with the topology must not change anything.
+	if mode == "diff" {
+		dryRun = true
+	}
+
+	// Deleting only touches the NB database and local instances, and status, diff and export-graph only read the NB
+	// database, so there is no need to connect to OVN.
+	if mode != "delete" && mode != "status" && mode != "diff" && mode != "export-graph" {
+		err = connectOVStoOVN(t.Interconnection != nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// The routers are attached to the transit switches, which ovn-ic adds once the availability zone is configured.
+	if t.Interconnection != nil && (mode == "net" || mode == "all") {
+		err = configureInterconnection(t.Interconnection)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = waitTransitSwitches(t.Interconnection)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
-	if (mode == "instance" || mode == "all") && (len(os.Args) < 3 || os.Args[2] == "") {
-		log.Fatal("no instance name supplied")
+	s := &status{HAChassisGroup: haChassisGroup, Networks: []networkStatus{}}
+	if mode == "status" {
+		s.HAChassis, err = getHAChassisStatus()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	instance := os.Args[2]
+	g := newGraph()
+
+	pool, err := newSubnetPool(t)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	err := connectOVStoOVN()
+	err = reserveExternalIPs(t)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	projects := []string{"project1"}
-	for _, projectName := range projects {
-
-		// Define the networks we want each project to have.
-		networks := []network{
-			network{
-				name:         "net1",
-				gw4:          "10.0.0.1/24",
-				gw6:          "fd47:8ac3:9083:35f6::1/64",
-				extBridge:    "lxdbr0",
-				extIP4:       "10.233.203.100/24",
-				extIP6Prefix: "fd42:8944:1883:8bc::/64",
-				extGW4:       "10.233.203.1",
-				extGW6:       "fd42:8944:1883:8bc::1",
-				dns4:         "10.233.203.1",
-				dns6:         "fd42:8944:1883:8bc::1",
-			},
-			network{
-				name:         "net2",
-				gw4:          "10.0.1.1/24",
-				gw6:          "fd47:8ac3:9083:35f7::1/64",
-				extBridge:    "lxdbr0",
-				extIP4:       "10.233.203.101/24",
-				extIP6Prefix: "fd42:8944:1883:8bc::/64",
-				extGW4:       "10.233.203.1",
-				extGW6:       "fd42:8944:1883:8bc::1",
-				dns4:         "10.233.203.1",
-				dns6:         "fd42:8944:1883:8bc::1",
-			},
+	drift := []drift{}
+	if mode == "diff" {
+		drift, err = diffHAChassisGroup()
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if t.Interconnection != nil {
+			interconnectionDrift, err := diffInterconnection(t.Interconnection)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			drift = append(drift, interconnectionDrift...)
+		}
+	}
+
+	for _, project := range t.Projects {
+		projectName := project.Name
+
+		// Get the networks we want each project to have.
+		networks, err := t.networks(project)
+		if err != nil {
+			log.Fatal(err)
 		}
 
 		for _, network := range networks {
-			if mode == "net" || mode == "all" {
-				err = createLogicalRouter(projectName, network)
+			// Status, export-graph and delete don't use the internal subnets, so don't allocate them.
+			if pool != nil && mode != "status" && mode != "export-graph" && mode != "delete" {
+				network, err = pool.allocate(projectName, network)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+
+			if mode == "status" {
+				networkStatus, err := getNetworkStatus(projectName, network)
 				if err != nil {
 					log.Fatal(err)
 				}
-				log.Printf("Created logical router for project %q and network %q", projectName, network.name)
 
-				err = createLogicalRouterUplink(projectName, network)
+				s.Networks = append(s.Networks, *networkStatus)
+			}
+
+			if mode == "diff" {
+				networkDrift, err := diffProjectNetwork(projectName, network)
 				if err != nil {
 					log.Fatal(err)
 				}
-				log.Printf("Created logical router uplink on %q for %q", projectName, network.name)
 
-				err = createProjectInternalSwitch(projectName, network)
+				drift = append(drift, networkDrift...)
+			}
+
+			if mode == "export-graph" {
+				err = g.addProjectNetwork(projectName, network)
 				if err != nil {
 					log.Fatal(err)
 				}
-				log.Printf("Created project internal switch and connected router to it")
 			}
 
-			if mode == "instance" || mode == "all" {
-				// Create the instances we want to connect to this network.
-				instPortName, instPortMac, err := addInstancePort(projectName, network, instance)
+			if mode == "delete" {
+				err = deleteProjectNetwork(projectName, network)
 				if err != nil {
 					log.Fatal(err)
 				}
-				log.Printf("Created instance port %q (%q)", instPortName, instPortMac)
+				log.Printf("Deleted project %q network %q", projectName, network.name)
+			}
+
+			if mode == "net" || mode == "all" {
+				err = createProjectNetwork(projectName, network)
+				if err != nil {
+					log.Fatal(err)
+				}
+				log.Printf("Created logical router, uplink and internal switch for project %q and network %q", projectName, network.name)
 
-				err = createInstance(projectName, network, instance, instPortName)
+				routes, err := getUpstreamRoutes(projectName, network)
 				if err != nil {
 					log.Fatal(err)
 				}
-				log.Printf("Created instance %q using port %q", instance, instPortName)
 
+				for _, route := range routes {
+					log.Printf("Upstream router %s needs a static route to %s via %s for project %q network %q", route.router, route.prefix, route.nexthop, projectName, network.name)
+				}
+			}
+
+			if mode == "instance" || mode == "all" {
+				instances := network.instances
+				if instance != "" {
+					instances = []string{instance}
+				}
+
+				if len(instances) == 0 {
+					log.Printf("No instances defined for project %q and network %q", projectName, network.name)
+				}
+
+				// Create the instances we want to connect to this network.
+				for _, instance := range instances {
+					instPortName, instPortMac, instAddresses, err := addInstancePort(projectName, network, instance)
+					if err != nil {
+						log.Fatal(err)
+					}
+					log.Printf("Created instance port %q (%q) with addresses %q and %q", instPortName, instPortMac, instAddresses.ipv4, instAddresses.ipv6)
+
+					err = createInstance(projectName, network, instance, instPortName, instAddresses)
+					if err != nil {
+						log.Fatal(err)
+					}
+					log.Printf("Created instance %q using port %q", instance, instPortName)
+				}
 			}
 		}
 	}
-}
 
-func ovnNbctl(args ...string) (string, error) {
-	return shared.RunCommand("ovn-nbctl", append([]string{"--db", fmt.Sprintf("tcp:%s:6643", ndbIP)}, args...)...)
+	if mode == "status" {
+		if *format == "json" {
+			err = printStatusJSON(os.Stdout, s)
+		} else {
+			err = printStatusTable(os.Stdout, s)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if mode == "export-graph" {
+		if *format == "mermaid" {
+			err = printGraphMermaid(os.Stdout, g)
+		} else {
+			err = printGraphDOT(os.Stdout, g)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Exit non-zero when there is drift so that it can be alerted on.
+	if mode == "diff" {
+		if *format == "json" {
+			err = printDriftJSON(os.Stdout, drift)
+		} else {
+			err = printDriftTable(os.Stdout, drift)
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if len(drift) > 0 {
+			os.Exit(1)
+		}
+
+		return
+	}
+
+	// Status and export-graph only read the NB database and write their output to stdout, which a plan would corrupt.
+	if dryRun && mode != "status" && mode != "export-graph" {
+		printPlan(os.Stdout)
+	}
 }
 
 // networkRandomDevName returns a random device name with prefix.
@@ -145,25 +450,6 @@ func networkRandomDevName(prefix string) string {
 	return iface
 }
 
-// networkRandomMAC generates a random MAC address.
-func networkRandomMAC() (string, error) {
-	// Generate a new random MAC address using the usual prefix.
-	ret := bytes.Buffer{}
-	for _, c := range "00:16:3e:xx:xx:xx" {
-		if c == 'x' {
-			c, err := cryptoRand.Int(cryptoRand.Reader, big.NewInt(16))
-			if err != nil {
-				return "", err
-			}
-			ret.WriteString(fmt.Sprintf("%x", c.Int64()))
-		} else {
-			ret.WriteString(string(c))
-		}
-	}
-
-	return ret.String(), nil
-}
-
 func getExternalOVSBridgeName(projectName string, network network) string {
 	return fmt.Sprintf("%s-ext-br", getLogicalRouterName(projectName, network))
 }
@@ -188,13 +474,21 @@ func getLogicalIntSwitchName(projectName string, network network) string {
 	return fmt.Sprintf("%s-%s-ls-int", projectName, network.name)
 }
 
+func getLogicalIntSwitchRouterPortNames(projectName string, network network) (string, string) {
+	return fmt.Sprintf("%s-%s-lrp-int", projectName, network.name), fmt.Sprintf("%s-%s-lsrp-int", projectName, network.name)
+}
+
 func getInstancePortName(projectName string, network network, instanceName string) string {
 	return fmt.Sprintf("%s-%s-ls-inst-%s", projectName, network.name, instanceName)
 }
 
+func getInstanceName(projectName string, network network, instanceName string) string {
+	return fmt.Sprintf("%s-%s-%s", projectName, network.name, instanceName)
+}
+
 func clearOVSPort(externalIfaceID string) error {
 	// Clear existing ports that have externalIfaceID.
-	existingPorts, err := shared.RunCommand("ovs-vsctl", "--format=csv", "--no-headings", "--data=bare", "--colum=name", "find", "interface", fmt.Sprintf("external-ids:iface-id=%s", externalIfaceID))
+	existingPorts, err := runQuery("ovs-vsctl", "--format=csv", "--no-headings", "--data=bare", "--colum=name", "find", "interface", fmt.Sprintf("external-ids:iface-id=%s", externalIfaceID))
 	if err != nil {
 		return err
 	}
@@ -202,366 +496,698 @@ func clearOVSPort(externalIfaceID string) error {
 	existingPorts = strings.TrimSpace(existingPorts)
 	if existingPorts != "" {
 		for _, port := range strings.Split(existingPorts, "\n") {
-			_, err = shared.RunCommand("ovs-vsctl", "del-port", port)
+			_, err = runCommand("ovs-vsctl", "del-port", port)
 			if err != nil {
 				return err
 			}
 
-			shared.RunCommand("ip", "link", "del", port)
+			runCommand("ip", "link", "del", port)
 		}
 	}
 
 	return nil
 }
 
-func connectOVStoOVN() error {
-	// Get our chassis IP.
-	output, err := shared.RunCommand("ip", "route", "get", "8.8.8.8")
+// clearDHCPOptions removes the DHCP options associated to a logical switch.
+func clearDHCPOptions(switchName string) error {
+	existingOpts, err := nb.GetDHCPOptions(switchName)
 	if err != nil {
 		return err
 	}
 
-	fields := strings.Fields(output)
-	ip := fields[6]
-
-	// Add to ha_chassis list.
-	ipParts := strings.Split(ip, ".") // Use last octet as priority.
-
-	// Connect local machine OVS to local OVN database.
-	// The "." record seems to be a way to specify the first record in this table,
-	// although can't find any docs on this, only numerous examples using this style.
-	_, err = shared.RunCommand("ovs-vsctl", "set", "open_vswitch", ".",
-		fmt.Sprintf("external_ids:ovn-remote=tcp:%s:6642", ndbIP),
-		"external_ids:ovn-remote-probe-interval=10000",
-		fmt.Sprintf("external_ids:ovn-encap-ip=%s", ip),
-		"external_ids:ovn-encap-type=geneve",
-	)
-	if err != nil {
-		return err
+	for i := range existingOpts {
+		err = nb.DeleteDHCPOptions(&existingOpts[i])
+		if err != nil {
+			return err
+		}
 	}
 
-	// Get chassis ID from local OVS.
-	chassisID, err := shared.RunCommand("ovs-vsctl", "get", "open_vswitch", ".", "external_ids:system-id")
+	return nil
+}
+
+// getLogicalSwitchPorts returns the ports on a logical switch.
+// Returns an empty list if the logical switch doesn't exist.
+func getLogicalSwitchPorts(switchName string) ([]nbLogicalSwitchPort, error) {
+	logicalSwitch, err := nb.GetLogicalSwitch(switchName)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	chassisID = strings.Replace(strings.TrimSpace(chassisID), `"`, "", -1)
 
-	// No --may-exist argument is supported by this command.
-	ovnNbctl("ha-chassis-group-add", haChassisGroup)
-	_, err = ovnNbctl("ha-chassis-group-add-chassis", haChassisGroup, chassisID, ipParts[3])
-	if err != nil {
-		return err
+	if logicalSwitch == nil {
+		return []nbLogicalSwitchPort{}, nil
 	}
 
-	return nil
+	return nb.GetLogicalSwitchPorts(logicalSwitch)
 }
 
-// createLogicalRouter creates logical router for project network.
-func createLogicalRouter(projectName string, network network) error {
-	// Create logical router.
-	logicalRouterName := getLogicalRouterName(projectName, network)
-	ovnNbctl("--if-exists", "lr-del", logicalRouterName)
-	_, err := ovnNbctl("lr-add", logicalRouterName)
+// getExistingLogicalRouter returns the logical router with the given name, which must already exist or have been
+// created in the current transaction.
+func getExistingLogicalRouter(name string) (*nbLogicalRouter, error) {
+	router, err := nb.GetLogicalRouter(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
+	if router == nil {
+		return nil, fmt.Errorf("Logical router %q not found", name)
+	}
 
-// createLogicalRouterUplink creates logical router uplink port and external logical switch.
-// Connects router to OVS integration bridge and connects integration bridge port to parent network bridge.
-func createLogicalRouterUplink(projectName string, network network) error {
-	logicalRouterName := getLogicalRouterName(projectName, network)
+	return router, nil
+}
 
-	// Generate MAC address for logical router's external port.
-	lrpExtMACStr, err := networkRandomMAC()
-	if err != nil {
-		return err
+// ensureLogicalRouterPort creates a logical router port, or updates the named columns of the existing port where
+// they differ from those wanted. The existing port is passed in as the caller needs it to decide on the MAC address.
+func ensureLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort, want *nbLogicalRouterPort, columns ...string) error {
+	if port == nil {
+		return nb.CreateLogicalRouterPort(router, want)
 	}
 
-	lrpExtMAC, err := net.ParseMAC(lrpExtMACStr)
+	want.UUID = port.UUID
+	changed, err := nbDiffColumns(port, want, columns...)
 	if err != nil {
 		return err
 	}
 
-	extIP4, extNet4, err := net.ParseCIDR(network.extIP4)
-	if err != nil {
-		return err
-	}
+	return nb.Update(want, changed...)
+}
 
-	extIP6, extNet6, err := net.ParseCIDR(network.extIP6Prefix)
-	if err != nil {
-		return err
-	}
+// ensureLogicalSwitch creates a logical switch if it doesn't exist, or updates its other_config where it differs
+// from that wanted.
+func ensureLogicalSwitch(name string, otherConfig map[string]string) (*nbLogicalSwitch, error) {
+	want := &nbLogicalSwitch{Name: name, OtherConfig: otherConfig}
 
-	// Generate external logical router port IPv6 in parent's prefix (Use ULA prefix for EUI64 IP generation).
-	extIP6, err = eui64.ParseMAC(extIP6, lrpExtMAC)
+	logicalSwitch, err := nb.GetLogicalSwitch(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	extIP4Net := net.IPNet{
-		IP:   extIP4,
-		Mask: extNet4.Mask,
-	}
+	if logicalSwitch == nil {
+		err = nb.CreateLogicalSwitch(want)
+		if err != nil {
+			return nil, err
+		}
 
-	extIP6Net := net.IPNet{
-		IP:   extIP6,
-		Mask: extNet6.Mask,
+		return want, nil
 	}
 
-	// Create external router port.
-	externalRouterPortName, externalSwitchRouterPortName := getLogicalExtSwitchRouterPortNames(projectName, network)
-
-	ovnNbctl("--if-exists", "lrp-del", externalRouterPortName)
-	_, err = ovnNbctl("lrp-add", logicalRouterName, externalRouterPortName, lrpExtMACStr, extIP4Net.String(), extIP6Net.String())
+	changed, err := nbDiffColumns(logicalSwitch, want, "other_config")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Assign external router port chassis group.
-	chassisGroupID, err := ovnNbctl("--format=csv", "--no-headings", "--data=bare", "--colum=_uuid", "find", "ha_chassis_group", fmt.Sprintf("name=%s", haChassisGroup))
+	logicalSwitch.OtherConfig = otherConfig
+	err = nb.Update(logicalSwitch, changed...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	chassisGroupID = strings.TrimSpace(chassisGroupID)
-	_, err = ovnNbctl("set", "logical_router_port", externalRouterPortName, fmt.Sprintf("ha_chassis_group=%s", chassisGroupID))
-	if err != nil {
-		return err
-	}
+	return logicalSwitch, nil
+}
 
-	// Add default IPv4 route.
-	_, err = ovnNbctl("lr-route-add", logicalRouterName, "0.0.0.0/0", network.extGW4)
+// ensureLogicalSwitchPort creates a logical switch port if needed and sets its type, addresses and options where
+// they differ from those wanted.
+func ensureLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, want *nbLogicalSwitchPort) error {
+	port, err := nb.GetLogicalSwitchPort(want.Name)
 	if err != nil {
 		return err
 	}
 
-	// Add default IPv6 route.
-	_, err = ovnNbctl("lr-route-add", logicalRouterName, "::/0", network.extGW6)
-	if err != nil {
-		return err
+	if port == nil {
+		return nb.CreateLogicalSwitchPort(logicalSwitch, want)
 	}
 
-	// Add SNAT rules.
-	_, intNet4, err := net.ParseCIDR(network.gw4)
+	want.UUID = port.UUID
+	changed, err := nbDiffColumns(port, want, "type", "addresses", "options")
 	if err != nil {
 		return err
 	}
 
-	_, err = ovnNbctl("lr-nat-add", logicalRouterName, "snat", extIP4.String(), intNet4.String())
-	if err != nil {
-		return err
-	}
+	return nb.Update(want, changed...)
+}
 
-	_, intNet6, err := net.ParseCIDR(network.gw6)
+// ensureStaticRoute adds a static route to a logical router, or updates the existing route if it differs. The route
+// is marked with the router name in its external_ids, so that its output port and policy can be corrected if they are
+// changed. An unmarked route for the prefix with no output port and the default policy, as created before routes were
+// marked, is taken over; other unmarked routes and routes from the network definition are left alone.
+func ensureStaticRoute(router *nbLogicalRouter, routes []nbLogicalRouterStaticRoute, prefix string, nexthop string) error {
+	_, prefixNet, err := net.ParseCIDR(prefix)
 	if err != nil {
 		return err
 	}
 
-	_, err = ovnNbctl("lr-nat-add", logicalRouterName, "snat", extIP6.String(), intNet6.String())
-	if err != nil {
-		return err
-	}
+	match := -1
+	for i, route := range routes {
+		_, routeNet, err := net.ParseCIDR(route.IPPrefix)
+		if err != nil || routeNet.String() != prefixNet.String() || isICLearnedRoute(route) {
+			continue
+		}
 
-	// Create logical external network switch.
-	externalSwitchName := getLogicalExtSwitchName(projectName, network)
-	ovnNbctl("--if-exists", "ls-del", externalSwitchName)
-	_, err = ovnNbctl("ls-add", externalSwitchName)
-	if err != nil {
-		return err
-	}
+		if route.ExternalIDs["lxd_default_route"] == router.Name {
+			match = i
+			break
+		}
 
-	// Create logical external switch router port.
-	ovnNbctl("--if-exists", "lsp-del", externalSwitchRouterPortName)
-	_, err = ovnNbctl("lsp-add", externalSwitchName, externalSwitchRouterPortName)
-	if err != nil {
-		return err
+		_, custom := route.ExternalIDs["lxd_network"]
+		if match == -1 && !custom && route.OutputPort == nil && (route.Policy == nil || *route.Policy == "dst-ip") {
+			match = i
+		}
 	}
 
-	// Connect logical router port to switch.
-	_, err = ovnNbctl("lsp-set-type", externalSwitchRouterPortName, "router")
-	if err != nil {
-		return err
+	if match == -1 {
+		return nb.CreateLogicalRouterStaticRoute(router, &nbLogicalRouterStaticRoute{
+			IPPrefix:    prefix,
+			Nexthop:     nexthop,
+			ExternalIDs: map[string]string{"lxd_default_route": router.Name},
+		})
 	}
 
-	_, err = ovnNbctl("lsp-set-addresses", externalSwitchRouterPortName, "router")
-	if err != nil {
-		return err
+	route := &routes[match]
+	changed := []string{}
+	if !net.ParseIP(route.Nexthop).Equal(net.ParseIP(nexthop)) {
+		route.Nexthop = nexthop
+		changed = append(changed, "nexthop")
 	}
 
-	_, err = ovnNbctl("lsp-set-options", externalSwitchRouterPortName,
-		fmt.Sprintf("router-port=%s", externalRouterPortName),
-		fmt.Sprintf("nat-addresses=%s", "router"),
-	)
-	if err != nil {
-		return err
+	if route.OutputPort != nil {
+		route.OutputPort = nil
+		changed = append(changed, "output_port")
 	}
 
-	// Create logical external switch port for parent bridge.
-	externalSwitchParentPortName := getLogicalExtSwitchParentPortName(projectName, network)
-	ovnNbctl("--if-exists", "lsp-del", externalSwitchParentPortName)
-	_, err = ovnNbctl("lsp-add", externalSwitchName, externalSwitchParentPortName)
-	if err != nil {
-		return err
+	if route.Policy != nil && *route.Policy != "dst-ip" {
+		route.Policy = nil
+		changed = append(changed, "policy")
 	}
 
-	// Forward any unknown MAC frames down this port.
-	_, err = ovnNbctl("lsp-set-addresses", externalSwitchParentPortName, "unknown")
-	if err != nil {
-		return err
+	if route.ExternalIDs["lxd_default_route"] != router.Name {
+		externalIDs := map[string]string{"lxd_default_route": router.Name}
+		for key, value := range route.ExternalIDs {
+			if key != "lxd_default_route" {
+				externalIDs[key] = value
+			}
+		}
+
+		route.ExternalIDs = externalIDs
+		changed = append(changed, "external_ids")
 	}
 
-	_, err = ovnNbctl("lsp-set-type", externalSwitchParentPortName, "localnet")
+	return nb.Update(route, changed...)
+}
+
+// isICLearnedRoute returns whether a static route was learned from another availability zone by ovn-ic, which
+// manages it.
+func isICLearnedRoute(route nbLogicalRouterStaticRoute) bool {
+	_, found := route.ExternalIDs["ic-learned-route"]
+	return found
+}
+
+// removeStaticRoute removes the static route for prefix that ensureStaticRoute manages, if there is one.
+func removeStaticRoute(router *nbLogicalRouter, routes []nbLogicalRouterStaticRoute, prefix string) error {
+	_, prefixNet, err := net.ParseCIDR(prefix)
 	if err != nil {
 		return err
 	}
 
-	_, err = ovnNbctl("lsp-set-options", externalSwitchParentPortName, fmt.Sprintf("network_name=%s", "lxdbr0"))
-	if err != nil {
-		return err
+	for i, route := range routes {
+		_, routeNet, err := net.ParseCIDR(route.IPPrefix)
+		if err != nil || routeNet.String() != prefixNet.String() || isICLearnedRoute(route) {
+			continue
+		}
+
+		marker, marked := route.ExternalIDs["lxd_default_route"]
+		if marked && marker != router.Name {
+			continue
+		}
+
+		_, custom := route.ExternalIDs["lxd_network"]
+		if !marked && (custom || route.OutputPort != nil || (route.Policy != nil && *route.Policy != "dst-ip")) {
+			continue
+		}
+
+		err = nb.DeleteLogicalRouterStaticRoute(router, &routes[i])
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// createProjectInternalSwitch creates internal logical switch, connects internal router port to it and returns
-// internal switch name and DHCPv4 and DHCPv6 options ID.
-func createProjectInternalSwitch(projectName string, network network) error {
-	logicalRouterName := getLogicalRouterName(projectName, network)
+// ensureSNATs makes the SNAT rules on a logical router match those wanted (a map of logical subnet to external
+// IP), removing any other SNAT rules.
+func ensureSNATs(router *nbLogicalRouter, nats []nbNAT, want map[string]string) error {
+	existing := make(map[string]struct{}, len(nats))
+	for i, nat := range nats {
+		if nat.Type != "snat" {
+			continue
+		}
 
-	// Create router port.
-	internalRouterPortName := fmt.Sprintf("%s-%s-lrp-int", projectName, network.name)
-	internalRouterPortMAC, err := networkRandomMAC()
-	routerIPv4, cidrV4, err := net.ParseCIDR(network.gw4)
+		_, logicalNet, err := net.ParseCIDR(nat.LogicalIP)
+		if err == nil {
+			externalIP, found := want[logicalNet.String()]
+			if found && net.ParseIP(nat.ExternalIP).Equal(net.ParseIP(externalIP)) {
+				existing[logicalNet.String()] = struct{}{}
+				continue
+			}
+		}
+
+		err = nb.DeleteNAT(router, &nats[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	logicalSubnets := make([]string, 0, len(want))
+	for logicalSubnet := range want {
+		logicalSubnets = append(logicalSubnets, logicalSubnet)
+	}
+
+	sort.Strings(logicalSubnets)
+	for _, logicalSubnet := range logicalSubnets {
+		_, found := existing[logicalSubnet]
+		if found {
+			continue
+		}
+
+		err := nb.CreateNAT(router, &nbNAT{Type: "snat", ExternalIP: want[logicalSubnet], LogicalIP: logicalSubnet})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getDHCPOptionsForSubnet returns the DHCP options of the same IP family as subnet, or nil if there are none.
+func getDHCPOptionsForSubnet(existingOpts []nbDHCPOptions, subnet *net.IPNet) *nbDHCPOptions {
+	for i := range existingOpts {
+		_, optsNet, err := net.ParseCIDR(existingOpts[i].Cidr)
+		if err != nil {
+			continue
+		}
+
+		if ipFamily(optsNet) == ipFamily(subnet) {
+			return &existingOpts[i]
+		}
+	}
+
+	return nil
+}
+
+// getDHCPOptionsID returns the UUID of the DHCP options of the same IP family as subnet on a logical switch.
+func getDHCPOptionsID(switchName string, existingOpts []nbDHCPOptions, subnet *net.IPNet) (string, error) {
+	opts := getDHCPOptionsForSubnet(existingOpts, subnet)
+	if opts != nil {
+		return opts.UUID, nil
+	}
+
+	// The DHCP options would have been created earlier in the plan.
+	if dryRun {
+		return dryRunUUID("dhcp_options", subnet.String()), nil
+	}
+
+	return "", fmt.Errorf("No DHCP options for %q found on %q", subnet.String(), switchName)
+}
+
+// ipFamily returns "ipv4" or "ipv6" depending on the family of subnet.
+func ipFamily(subnet *net.IPNet) string {
+	if subnet.IP.To4() == nil {
+		return "ipv6"
+	}
+
+	return "ipv4"
+}
+
+// ensureDHCPOptions creates DHCP options for a subnet on a logical switch, or updates the existing ones of the same
+// IP family where they differ.
+func ensureDHCPOptions(switchName string, existingOpts []nbDHCPOptions, subnet *net.IPNet, options map[string]string) error {
+	want := &nbDHCPOptions{
+		Cidr:        subnet.String(),
+		Options:     options,
+		ExternalIDs: map[string]string{"lxd_network": switchName},
+	}
+
+	opts := getDHCPOptionsForSubnet(existingOpts, subnet)
+	if opts == nil {
+		return nb.CreateDHCPOptions(want)
+	}
+
+	want.UUID = opts.UUID
+	changed, err := nbDiffColumns(opts, want, "cidr", "options")
 	if err != nil {
 		return err
 	}
 
-	_, cidrV6, err := net.ParseCIDR(network.gw6)
+	return nb.Update(want, changed...)
+}
+
+// connectOVStoOVN connects the local OVS to the OVN SB database and adds the local chassis to the HA chassis group.
+// If interconn is set the chassis is also marked as an interconnection gateway, which carries the traffic of the
+// transit router ports it hosts to the other availability zones.
+func connectOVStoOVN(interconn bool) error {
+	// Get our chassis IP.
+	output, err := runQuery("ip", "route", "get", "8.8.8.8")
 	if err != nil {
 		return err
 	}
 
-	// Create internal logical router port.
-	ovnNbctl("--if-exists", "lrp-del", internalRouterPortName)
-	_, err = ovnNbctl("lrp-add", logicalRouterName, internalRouterPortName, internalRouterPortMAC, network.gw4, network.gw6)
+	fields := strings.Fields(output)
+	ip := fields[6]
+
+	// Add to ha_chassis list.
+	ipParts := strings.Split(ip, ".") // Use last octet as priority.
+	priority, err := strconv.Atoi(ipParts[3])
 	if err != nil {
 		return err
 	}
 
-	// Configure IPv6 Router Advertisements.
-	_, err = ovnNbctl("set", "logical_router_port", internalRouterPortName,
-		"ipv6_ra_configs:send_periodic=true",
-		"ipv6_ra_configs:address_mode=slaac",
-		"ipv6_ra_configs:min_interval=10",
-		"ipv6_ra_configs:max_interval=15",
-		fmt.Sprintf("ipv6_ra_configs:rdnss=%s", network.dns6),
-		fmt.Sprintf("ipv6_ra_configs:dnssl=%s", dnsV6SearchDomains),
-	)
+	// ovn-controller takes its SSL settings from the local OVS database.
+	if ovnSSL.enabled() {
+		_, err = runCommand("ovs-vsctl", "set-ssl", ovnSSL.privateKey, ovnSSL.certificate, ovnSSL.caCert)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Connect local machine OVS to local OVN database.
+	settings := []string{
+		fmt.Sprintf("external_ids:ovn-remote=%s", strings.Join(sbEndpoints, ",")),
+		"external_ids:ovn-remote-probe-interval=10000",
+		fmt.Sprintf("external_ids:ovn-encap-ip=%s", ip),
+		"external_ids:ovn-encap-type=geneve",
+	}
+
+	// Without interconnection the setting is left alone, in case it was set by other means.
+	if interconn {
+		settings = append(settings, "external_ids:ovn-is-interconn=true")
+	}
+
+	// The "." record seems to be a way to specify the first record in this table,
+	// although can't find any docs on this, only numerous examples using this style.
+	_, err = runCommand("ovs-vsctl", append([]string{"set", "open_vswitch", "."}, settings...)...)
 	if err != nil {
 		return err
 	}
 
-	// Create internal project switch.
-	internalSwitchName := getLogicalIntSwitchName(projectName, network)
-	ovnNbctl("--if-exists", "ls-del", internalSwitchName)
-	_, err = ovnNbctl("ls-add", internalSwitchName)
+	// Get chassis ID from local OVS.
+	chassisID, err := runQuery("ovs-vsctl", "get", "open_vswitch", ".", "external_ids:system-id")
 	if err != nil {
 		return err
 	}
+	chassisID = strings.Replace(strings.TrimSpace(chassisID), `"`, "", -1)
 
-	// Setup DHCP.
-	_, err = ovnNbctl("set", "logical_switch", internalSwitchName,
-		fmt.Sprintf("other_config:subnet=%s", cidrV4.String()),
-		fmt.Sprintf("other_config:exclude_ips=%s", routerIPv4),
-		fmt.Sprintf("other_config:ipv6_prefix=%s", cidrV6.String()),
-	)
+	// Create the group and add the chassis to it in one transaction.
+	nb.Begin()
+	defer nb.Abort()
+
+	chassisGroup, err := nb.GetHAChassisGroup(haChassisGroup)
 	if err != nil {
 		return err
 	}
 
-	// Clear existing DHCP options.
-	existingOpts, err := ovnNbctl("--format=csv", "--no-headings", "--data=bare", "--colum=_uuid", "find", "dhcp_options", fmt.Sprintf("external_ids:lxd_network=%s", internalSwitchName))
+	if chassisGroup == nil {
+		chassisGroup = &nbHAChassisGroup{Name: haChassisGroup}
+		err = nb.CreateHAChassisGroup(chassisGroup)
+		if err != nil {
+			return err
+		}
+	}
+
+	members, err := nb.GetHAChassis(chassisGroup)
 	if err != nil {
 		return err
 	}
 
-	existingOpts = strings.TrimSpace(existingOpts)
-	if existingOpts != "" {
-		for _, uuid := range strings.Split(existingOpts, "\n") {
-			_, err = ovnNbctl("destroy", "dhcp_options", uuid)
+	for i := range members {
+		if members[i].ChassisName != chassisID {
+			continue
+		}
+
+		if members[i].Priority != priority {
+			members[i].Priority = priority
+			err = nb.Update(&members[i], "priority")
 			if err != nil {
 				return err
 			}
 		}
+
+		return nb.Commit()
 	}
 
-	DHCPv4Opt, err := ovnNbctl("create", "dhcp_option",
-		fmt.Sprintf("external_ids:lxd_network=%s", internalSwitchName),
-		fmt.Sprintf("cidr=%s", cidrV4.String()),
-	)
+	err = nb.CreateHAChassis(chassisGroup, &nbHAChassis{ChassisName: chassisID, Priority: priority})
 	if err != nil {
 		return err
 	}
-	DHCPv4Opt = strings.TrimSpace(DHCPv4Opt)
 
-	// We have to use dhcp-options-set-options rather than the command above as its the only way to allow the
-	// domain_name option to be properly escaped.
-	_, err = ovnNbctl("dhcp-options-set-options", DHCPv4Opt,
-		fmt.Sprintf("server_id=%s", routerIPv4.String()),
-		fmt.Sprintf("router=%s", routerIPv4.String()),
-		fmt.Sprintf("server_mac=%s", internalRouterPortMAC),
-		"lease_time=3600",
-		fmt.Sprintf("dns_server=%s", network.dns4),
-		fmt.Sprintf(`domain_name="%s"`, dnsDomainName),
-	)
+	return nb.Commit()
+}
+
+// createProjectNetwork creates the logical router, uplink and internal switch of a project network. The NB changes
+// are committed in a single transaction, so if any step fails the NB database is left as it was.
+func createProjectNetwork(projectName string, network network) error {
+	if !network.ipv4 && !network.ipv6 {
+		return fmt.Errorf("Network %q has no IP family", network.name)
+	}
+
+	nb.Begin()
+	defer nb.Abort()
+
+	err := createLogicalRouter(projectName, network)
+	if err != nil {
+		return fmt.Errorf("Failed creating logical router: %w", err)
+	}
+
+	err = createLogicalRouterUplink(projectName, network)
+	if err != nil {
+		return fmt.Errorf("Failed creating logical router uplink: %w", err)
+	}
+
+	err = createProjectInternalSwitch(projectName, network)
+	if err != nil {
+		return fmt.Errorf("Failed creating internal switch: %w", err)
+	}
+
+	err = createLogicalRouterTransitPort(projectName, network)
+	if err != nil {
+		return fmt.Errorf("Failed attaching to transit switch: %w", err)
+	}
+
+	err = createLogicalRouterRoutes(projectName, network)
+	if err != nil {
+		return fmt.Errorf("Failed creating static routes: %w", err)
+	}
+
+	return nb.Commit()
+}
+
+// createLogicalRouter creates logical router for project network if it doesn't exist.
+func createLogicalRouter(projectName string, network network) error {
+	logicalRouterName := getLogicalRouterName(projectName, network)
+	router, err := nb.GetLogicalRouter(logicalRouterName)
 	if err != nil {
 		return err
 	}
 
-	DHCPv6Opt, err := ovnNbctl("create", "dhcp_option",
-		fmt.Sprintf("external_ids:lxd_network=%s", internalSwitchName),
-		fmt.Sprintf(`cidr="%s"`, cidrV6.String()),
-	)
+	// Record the subnets allocated from the subnet pool, so that they are kept on later runs.
+	if router != nil {
+		changed := false
+		for key, value := range network.subnets {
+			if router.ExternalIDs[key] != value {
+				if router.ExternalIDs == nil {
+					router.ExternalIDs = map[string]string{}
+				}
+
+				router.ExternalIDs[key] = value
+				changed = true
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+
+		return nb.Update(router, "external_ids")
+	}
+
+	// Create logical router.
+	return nb.CreateLogicalRouter(&nbLogicalRouter{Name: logicalRouterName, ExternalIDs: network.subnets})
+}
+
+// createLogicalRouterUplink creates logical router uplink port and external logical switch.
+// Connects router to OVS integration bridge and connects integration bridge port to parent network bridge.
+// Existing ports, routes and NAT rules are only changed where they differ from the network definition.
+func createLogicalRouterUplink(projectName string, network network) error {
+	logicalRouterName := getLogicalRouterName(projectName, network)
+	router, err := getExistingLogicalRouter(logicalRouterName)
 	if err != nil {
 		return err
 	}
-	DHCPv6Opt = strings.TrimSpace(DHCPv6Opt)
 
-	// We have to use dhcp-options-set-options rather than the command above as its the only way to allow the
-	// domain_search option to be properly escaped.
-	_, err = ovnNbctl("dhcp-options-set-options", DHCPv6Opt,
-		fmt.Sprintf("server_id=%s", internalRouterPortMAC),
-		fmt.Sprintf(`domain_search="%s"`, dnsDomainName),
-		fmt.Sprintf("dns_server=%s", network.dns6),
-	)
+	externalRouterPortName, externalSwitchRouterPortName := getLogicalExtSwitchRouterPortNames(projectName, network)
+	externalRouterPort, err := nb.GetLogicalRouterPort(externalRouterPortName)
+	if err != nil {
+		return err
+	}
+
+	// Take an external IPv4 address from the uplink's range if the topology doesn't set one.
+	if network.ipv4 && network.extIP4 == "" {
+		network.extIP4, err = allocateExternalIP4(logicalRouterName, network, externalRouterPort)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Keep the MAC address of an existing external port as the external IPv6 address is derived from it.
+	lrpExtMACStr := ""
+	if externalRouterPort != nil {
+		lrpExtMACStr = externalRouterPort.MAC
+	} else {
+		lrpExtMACStr, err = networkStableMAC(externalRouterPortName)
+		if err != nil {
+			return err
+		}
+	}
+
+	lrpExtMAC, err := net.ParseMAC(lrpExtMACStr)
 	if err != nil {
 		return err
 	}
 
-	// Create logical switch router port.
-	internalSwitchRouterPortName := fmt.Sprintf("%s-%s-lsrp-int", projectName, network.name)
-	ovnNbctl("--if-exists", "lsp-del", internalSwitchRouterPortName)
-	_, err = ovnNbctl("lsp-add", internalSwitchName, internalSwitchRouterPortName)
+	// The router port addresses, default routes and SNAT rules only cover the IP families the network has. Routed
+	// IP families have no SNAT rule, as the upstream router routes the internal subnet to the external port instead.
+	extNetworks := []string{}
+	snats := map[string]string{}
+	defaultRoutes := map[string]string{"0.0.0.0/0": "", "::/0": ""}
+
+	if network.ipv4 {
+		extIP4, extNet4, err := net.ParseCIDR(network.extIP4)
+		if err != nil {
+			return err
+		}
+
+		_, intNet4, err := net.ParseCIDR(network.gw4)
+		if err != nil {
+			return err
+		}
+
+		extIP4Net := net.IPNet{
+			IP:   extIP4,
+			Mask: extNet4.Mask,
+		}
+
+		extNetworks = append(extNetworks, extIP4Net.String())
+		if !network.routed4 {
+			snats[intNet4.String()] = extIP4.String()
+		}
+
+		defaultRoutes["0.0.0.0/0"] = network.extGW4
+	}
+
+	if network.ipv6 {
+		extIP6, extNet6, err := net.ParseCIDR(network.extIP6Prefix)
+		if err != nil {
+			return err
+		}
+
+		// Generate external logical router port IPv6 in parent's prefix (Use ULA prefix for EUI64 IP generation).
+		extIP6, err = eui64.ParseMAC(extIP6, lrpExtMAC)
+		if err != nil {
+			return err
+		}
+
+		_, intNet6, err := net.ParseCIDR(network.gw6)
+		if err != nil {
+			return err
+		}
+
+		extIP6Net := net.IPNet{
+			IP:   extIP6,
+			Mask: extNet6.Mask,
+		}
+
+		extNetworks = append(extNetworks, extIP6Net.String())
+		if !network.routed6 {
+			snats[intNet6.String()] = extIP6.String()
+		}
+
+		defaultRoutes["::/0"] = network.extGW6
+	}
+
+	// Get the chassis group for the external router port.
+	chassisGroupID, err := getHAChassisGroupID()
 	if err != nil {
 		return err
 	}
 
-	// Connect logical router port to switch.
-	_, err = ovnNbctl("lsp-set-type", internalSwitchRouterPortName, "router")
+	// Create external router port and assign it to the chassis group.
+	err = ensureLogicalRouterPort(router, externalRouterPort, &nbLogicalRouterPort{
+		Name:           externalRouterPortName,
+		MAC:            lrpExtMACStr,
+		Networks:       extNetworks,
+		HaChassisGroup: &chassisGroupID,
+	}, "mac", "networks", "ha_chassis_group")
 	if err != nil {
 		return err
 	}
 
-	_, err = ovnNbctl("lsp-set-addresses", internalSwitchRouterPortName, "router")
+	// Add default routes, removing that of an IP family the network doesn't have.
+	routes, err := nb.GetLogicalRouterStaticRoutes(router)
 	if err != nil {
 		return err
 	}
 
-	_, err = ovnNbctl("lsp-set-options", internalSwitchRouterPortName, fmt.Sprintf("router-port=%s", internalRouterPortName))
+	for _, prefix := range []string{"0.0.0.0/0", "::/0"} {
+		if defaultRoutes[prefix] == "" {
+			err = removeStaticRoute(router, routes, prefix)
+		} else {
+			err = ensureStaticRoute(router, routes, prefix, defaultRoutes[prefix])
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	// Add SNAT rules.
+	nats, err := nb.GetLogicalRouterNATs(router)
+	if err != nil {
+		return err
+	}
+
+	err = ensureSNATs(router, nats, snats)
+	if err != nil {
+		return err
+	}
+
+	// Create logical external network switch.
+	externalSwitch, err := ensureLogicalSwitch(getLogicalExtSwitchName(projectName, network), nil)
+	if err != nil {
+		return err
+	}
+
+	// Create logical external switch router port and connect logical router port to switch.
+	err = ensureLogicalSwitchPort(externalSwitch, &nbLogicalSwitchPort{
+		Name:      externalSwitchRouterPortName,
+		Type:      "router",
+		Addresses: []string{"router"},
+		Options: map[string]string{
+			"router-port":   externalRouterPortName,
+			"nat-addresses": "router",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Create logical external switch port for parent bridge.
+	// Forward any unknown MAC frames down this port.
+	err = ensureLogicalSwitchPort(externalSwitch, &nbLogicalSwitchPort{
+		Name:      getLogicalExtSwitchParentPortName(projectName, network),
+		Type:      "localnet",
+		Addresses: []string{"unknown"},
+		Options: map[string]string{
+			"network_name": network.extBridge,
+		},
+	})
 	if err != nil {
 		return err
 	}
@@ -569,135 +1195,904 @@ func createProjectInternalSwitch(projectName string, network network) error {
 	return nil
 }
 
-// addInstancePort creates veth pair and connects host side to internal switch. Returns peer interface name for
-// adding to an instance and MAC address of the port.
-func addInstancePort(projectName string, network network, instanceName string) (string, string, error) {
-	internalSwitchName := getLogicalIntSwitchName(projectName, network)
+// getHAChassisGroupID returns the UUID of the HA chassis group that gateway router ports are assigned to. In dry-run
+// mode the group may not exist yet, so a placeholder is returned.
+func getHAChassisGroupID() (string, error) {
+	chassisGroup, err := nb.GetHAChassisGroup(haChassisGroup)
+	if err != nil {
+		return "", err
+	}
+
+	if chassisGroup != nil {
+		return chassisGroup.UUID, nil
+	}
+
+	if !dryRun {
+		return "", fmt.Errorf("HA chassis group %q not found", haChassisGroup)
+	}
 
-	_, intNet4, err := net.ParseCIDR(network.gw4)
+	return dryRunUUID("ha_chassis_group", haChassisGroup), nil
+}
+
+// upstreamRoute is a static route that the router at the uplink's gateway needs to reach the internal subnet of a
+// network that is routed rather than SNATed.
+type upstreamRoute struct {
+	router  string
+	prefix  string
+	nexthop string
+}
+
+// getUpstreamRoutes returns the static routes the upstream routers need for the routed IP families of a project
+// network, via the addresses of its external router port. In dry-run mode the addresses of a port that doesn't exist
+// yet are placeholders.
+func getUpstreamRoutes(projectName string, network network) ([]upstreamRoute, error) {
+	externalRouterPortName, _ := getLogicalExtSwitchRouterPortNames(projectName, network)
+	externalRouterPort, err := nb.GetLogicalRouterPort(externalRouterPortName)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []upstreamRoute{}
+	for _, family := range []struct {
+		name   string
+		routed bool
+		gw     string
+		extGW  string
+	}{
+		{"ipv4", network.routed4, network.gw4, network.extGW4},
+		{"ipv6", network.routed6, network.gw6, network.extGW6},
+	} {
+		if !family.routed {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(family.gw)
+		if err != nil {
+			return nil, err
+		}
+
+		nexthop := ""
+		if externalRouterPort != nil {
+			for _, cidr := range externalRouterPort.Networks {
+				ip, _, err := net.ParseCIDR(cidr)
+				if err == nil && (ip.To4() != nil) == (family.name == "ipv4") {
+					nexthop = ip.String()
+				}
+			}
+		}
+
+		if nexthop == "" {
+			if !dryRun {
+				return nil, fmt.Errorf("Logical router port %q has no %s address", externalRouterPortName, family.name)
+			}
+
+			nexthop = fmt.Sprintf("<%s:%s>", family.name, externalRouterPortName)
+		}
+
+		routes = append(routes, upstreamRoute{router: family.extGW, prefix: subnet.String(), nexthop: nexthop})
+	}
+
+	return routes, nil
+}
+
+// createProjectInternalSwitch creates internal logical switch, connects internal router port to it and sets up
+// the DHCPv4 and DHCPv6 options. Existing records are only changed where they differ from the network definition.
+func createProjectInternalSwitch(projectName string, network network) error {
+	logicalRouterName := getLogicalRouterName(projectName, network)
+	router, err := getExistingLogicalRouter(logicalRouterName)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	_, intNet6, err := net.ParseCIDR(network.gw6)
+	// Create router port.
+	internalRouterPortName, internalSwitchRouterPortName := getLogicalIntSwitchRouterPortNames(projectName, network)
+	internalRouterPort, err := nb.GetLogicalRouterPort(internalRouterPortName)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	// Get DHCP option IDs.
-	DHCPv4Opt, err := ovnNbctl("--format=csv", "--no-headings", "--data=bare", "--colum=_uuid", "find", "dhcp_options",
-		fmt.Sprintf("external_ids:lxd_network=%s", internalSwitchName),
-		fmt.Sprintf("cidr=%s", intNet4.String()),
-	)
+	// Keep the MAC address of an existing internal port as it is handed out as the DHCP server MAC.
+	internalRouterPortMAC := ""
+	if internalRouterPort != nil {
+		internalRouterPortMAC = internalRouterPort.MAC
+	} else {
+		internalRouterPortMAC, err = networkStableMAC(internalRouterPortName)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The router port addresses, switch other_config and DHCP options only cover the IP families the network has,
+	// and IPv6 Router Advertisements are only sent if it has IPv6.
+	routerNetworks := []string{}
+	otherConfig := map[string]string{}
+	var raConfigs map[string]string
+	var routerIPv4 net.IP
+	var cidrV4, cidrV6 *net.IPNet
+
+	if network.ipv4 {
+		routerIPv4, cidrV4, err = net.ParseCIDR(network.gw4)
+		if err != nil {
+			return err
+		}
+
+		// Keep the router address and the network's reserved addresses out of dynamic allocation. The router
+		// address isn't listed on its own if a reserved range already covers it, as in switches set up by other
+		// tools.
+		excludeIPs := []string{}
+		routerReserved := false
+		for _, reserved := range network.reservedIPs {
+			first, last := net.ParseIP(reserved), net.ParseIP(reserved)
+			if strings.Contains(reserved, "-") {
+				first, last, err = parseIPRange(reserved)
+				if err != nil {
+					return err
+				}
+			}
+
+			if bytes.Compare(routerIPv4.To16(), first.To16()) >= 0 && bytes.Compare(routerIPv4.To16(), last.To16()) <= 0 {
+				routerReserved = true
+			}
+
+			excludeIPs = append(excludeIPs, strings.Replace(reserved, "-", "..", 1))
+		}
+
+		if !routerReserved {
+			excludeIPs = append([]string{routerIPv4.String()}, excludeIPs...)
+		}
+
+		routerNetworks = append(routerNetworks, network.gw4)
+		otherConfig["subnet"] = cidrV4.String()
+		otherConfig["exclude_ips"] = strings.Join(excludeIPs, " ")
+	}
+
+	if network.ipv6 {
+		_, cidrV6, err = net.ParseCIDR(network.gw6)
+		if err != nil {
+			return err
+		}
+
+		routerNetworks = append(routerNetworks, network.gw6)
+		otherConfig["ipv6_prefix"] = cidrV6.String()
+		raConfigs = map[string]string{
+			"send_periodic": "true",
+			"address_mode":  network.ipv6Mode,
+			"min_interval":  "10",
+			"max_interval":  "15",
+			"rdnss":         network.dns6,
+			"dnssl":         dnsV6SearchDomains,
+		}
+	}
+
+	// Create internal logical router port and configure IPv6 Router Advertisements.
+	err = ensureLogicalRouterPort(router, internalRouterPort, &nbLogicalRouterPort{
+		Name:          internalRouterPortName,
+		MAC:           internalRouterPortMAC,
+		Networks:      routerNetworks,
+		Ipv6RaConfigs: raConfigs,
+	}, "mac", "networks", "ipv6_ra_configs")
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	DHCPv4Opt = strings.TrimSpace(DHCPv4Opt)
+	// Create internal project switch and setup DHCP.
+	internalSwitchName := getLogicalIntSwitchName(projectName, network)
+	internalSwitch, err := ensureLogicalSwitch(internalSwitchName, otherConfig)
+	if err != nil {
+		return err
+	}
 
-	DHCPv6Opt, err := ovnNbctl("--format=csv", "--no-headings", "--data=bare", "--colum=_uuid", "find", "dhcp_options",
-		fmt.Sprintf("external_ids:lxd_network=%s", internalSwitchName),
-		fmt.Sprintf(`cidr="%s"`, intNet6.String()),
-	)
+	existingOpts, err := nb.GetDHCPOptions(internalSwitchName)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	DHCPv6Opt = strings.TrimSpace(DHCPv6Opt)
+	// Remove the DHCP options of an IP family the network doesn't have.
+	for i := range existingOpts {
+		_, optsNet, err := net.ParseCIDR(existingOpts[i].Cidr)
+		if err != nil || (ipFamily(optsNet) == "ipv4" && network.ipv4) || (ipFamily(optsNet) == "ipv6" && network.ipv6) {
+			continue
+		}
 
-	instancePortName := getInstancePortName(projectName, network, instanceName)
-	ovnNbctl("--if-exists", "lsp-del", instancePortName)
-	_, err = ovnNbctl("lsp-add", internalSwitchName, instancePortName)
+		err = nb.DeleteDHCPOptions(&existingOpts[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	// The domain options are quoted as they are strings rather than identifiers.
+	if network.ipv4 {
+		err = ensureDHCPOptions(internalSwitchName, existingOpts, cidrV4, map[string]string{
+			"server_id":   routerIPv4.String(),
+			"router":      routerIPv4.String(),
+			"server_mac":  internalRouterPortMAC,
+			"lease_time":  "3600",
+			"dns_server":  network.dns4,
+			"domain_name": fmt.Sprintf(`"%s"`, dnsDomainName),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// In stateful mode DHCPv6 hands out the instance port's IPv6 address (ia_addr). In the slaac and stateless modes
+	// it only hands out the other options, as instances configure their address from the router advertisements.
+	if network.ipv6 {
+		dhcpv6Options := map[string]string{
+			"server_id":     internalRouterPortMAC,
+			"domain_search": fmt.Sprintf(`"%s"`, dnsDomainName),
+			"dns_server":    network.dns6,
+		}
+
+		if network.ipv6Mode != "dhcpv6_stateful" {
+			dhcpv6Options["dhcpv6_stateless"] = "true"
+		}
+
+		err = ensureDHCPOptions(internalSwitchName, existingOpts, cidrV6, dhcpv6Options)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create logical switch router port and connect logical router port to switch.
+	err = ensureLogicalSwitchPort(internalSwitch, &nbLogicalSwitchPort{
+		Name:      internalSwitchRouterPortName,
+		Type:      "router",
+		Addresses: []string{"router"},
+		Options: map[string]string{
+			"router-port": internalRouterPortName,
+		},
+	})
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	instancePortMAC, err := networkRandomMAC()
+	return nil
+}
+
+// createLogicalRouterRoutes makes the static routes of a project network's router match those in the network
+// definition, after checking that each nexthop is in the subnet of one of the router's ports. The routes are marked
+// with the router name in their external_ids, so that routes added by other means are left alone.
+func createLogicalRouterRoutes(projectName string, network network) error {
+	logicalRouterName := getLogicalRouterName(projectName, network)
+	router, err := getExistingLogicalRouter(logicalRouterName)
 	if err != nil {
-		return "", "", err
+		return err
+	}
+
+	// Find the subnets of the router's ports, which were created or updated earlier in the transaction.
+	externalRouterPortName, _ := getLogicalExtSwitchRouterPortNames(projectName, network)
+	internalRouterPortName, _ := getLogicalIntSwitchRouterPortNames(projectName, network)
+	routerPortNames := []string{externalRouterPortName, internalRouterPortName}
+	if network.transitSwitch != "" {
+		transitRouterPortName, _ := getLogicalTransitSwitchRouterPortNames(projectName, network)
+		routerPortNames = append(routerPortNames, transitRouterPortName)
+	}
+
+	portSubnets := map[string][]*net.IPNet{}
+	for _, portName := range routerPortNames {
+		port, err := nb.GetLogicalRouterPort(portName)
+		if err != nil {
+			return err
+		}
+
+		if port == nil {
+			continue
+		}
+
+		for _, cidr := range port.Networks {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err == nil {
+				portSubnets[portName] = append(portSubnets[portName], subnet)
+			}
+		}
 	}
 
-	_, err = ovnNbctl("lsp-set-addresses", instancePortName, fmt.Sprintf("%s dynamic", instancePortMAC))
+	for _, route := range network.routes {
+		nexthop := net.ParseIP(route.nexthop)
+		portNames := routerPortNames
+		if route.outputPort != "" {
+			_, found := portSubnets[route.outputPort]
+			if !found && !(dryRun && shared.StringInSlice(route.outputPort, portNames)) {
+				return fmt.Errorf("Route %q output port %q is not a port of logical router %q", route.prefix, route.outputPort, logicalRouterName)
+			}
+
+			portNames = []string{route.outputPort}
+		}
+
+		// The ports may not exist yet in dry-run mode, so their addresses are unknown.
+		reachable := dryRun && len(portSubnets) == 0
+		for _, portName := range portNames {
+			for _, subnet := range portSubnets[portName] {
+				if subnet.Contains(nexthop) {
+					reachable = true
+				}
+			}
+		}
+
+		if !reachable {
+			return fmt.Errorf("Route %q nexthop %q is not in the subnet of any port of logical router %q", route.prefix, route.nexthop, logicalRouterName)
+		}
+	}
+
+	routes, err := nb.GetLogicalRouterStaticRoutes(router)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	_, err = ovnNbctl("lsp-set-dhcpv4-options", instancePortName, DHCPv4Opt)
+	// Remove the routes no longer in the network definition, and skip creating those that already exist.
+	existing := map[staticRoute]bool{}
+	for i, route := range routes {
+		if route.ExternalIDs["lxd_network"] != logicalRouterName {
+			continue
+		}
+
+		key := staticRoute{prefix: route.IPPrefix, nexthop: route.Nexthop, policy: "dst-ip"}
+		_, prefix, err := net.ParseCIDR(route.IPPrefix)
+		if err == nil {
+			key.prefix = prefix.String()
+		}
+
+		if net.ParseIP(route.Nexthop) != nil {
+			key.nexthop = net.ParseIP(route.Nexthop).String()
+		}
+
+		if route.OutputPort != nil {
+			key.outputPort = *route.OutputPort
+		}
+
+		if route.Policy != nil {
+			key.policy = *route.Policy
+		}
+
+		wanted := false
+		for _, want := range network.routes {
+			if want == key {
+				wanted = true
+			}
+		}
+
+		// Updating a kept route without columns changes nothing, but accounts for it when looking for drift.
+		if wanted && !existing[key] {
+			existing[key] = true
+			err = nb.Update(&routes[i])
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		err = nb.DeleteLogicalRouterStaticRoute(router, &routes[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, route := range network.routes {
+		if existing[route] {
+			continue
+		}
+
+		want := &nbLogicalRouterStaticRoute{
+			IPPrefix:    route.prefix,
+			Nexthop:     route.nexthop,
+			ExternalIDs: map[string]string{"lxd_network": logicalRouterName},
+		}
+
+		if route.outputPort != "" {
+			outputPort := route.outputPort
+			want.OutputPort = &outputPort
+		}
+
+		if route.policy != "dst-ip" {
+			policy := route.policy
+			want.Policy = &policy
+		}
+
+		err = nb.CreateLogicalRouterStaticRoute(router, want)
+		if err != nil {
+			return err
+		}
+
+		existing[route] = true
+	}
+
+	return nil
+}
+
+// addInstancePort creates veth pair and connects host side to internal switch. Returns peer interface name for
+// adding to an instance, MAC address of the port and the addresses the instance will get, which OVN allocates unless
+// they are static.
+func addInstancePort(projectName string, network network, instanceName string) (string, string, instanceAddresses, error) {
+	internalSwitchName := getLogicalIntSwitchName(projectName, network)
+	internalSwitch, err := nb.GetLogicalSwitch(internalSwitchName)
+	if err != nil {
+		return "", "", instanceAddresses{}, err
+	}
+
+	if internalSwitch == nil {
+		if !dryRun {
+			return "", "", instanceAddresses{}, fmt.Errorf("Logical switch %q not found", internalSwitchName)
+		}
+
+		// Switch would have been created earlier in the plan.
+		internalSwitch = &nbLogicalSwitch{UUID: dryRunUUID("logical_switch", internalSwitchName), Name: internalSwitchName}
+	}
+
+	// Get DHCP option IDs of the IP families the network has.
+	existingOpts, err := nb.GetDHCPOptions(internalSwitchName)
+	if err != nil {
+		return "", "", instanceAddresses{}, err
+	}
+
+	var intNet4, intNet6 *net.IPNet
+	var DHCPv4Opt, DHCPv6Opt *string
+	if network.ipv4 {
+		_, intNet4, err = net.ParseCIDR(network.gw4)
+		if err != nil {
+			return "", "", instanceAddresses{}, err
+		}
+
+		id, err := getDHCPOptionsID(internalSwitchName, existingOpts, intNet4)
+		if err != nil {
+			return "", "", instanceAddresses{}, err
+		}
+
+		DHCPv4Opt = &id
+	}
+
+	if network.ipv6 {
+		_, intNet6, err = net.ParseCIDR(network.gw6)
+		if err != nil {
+			return "", "", instanceAddresses{}, err
+		}
+
+		id, err := getDHCPOptionsID(internalSwitchName, existingOpts, intNet6)
+		if err != nil {
+			return "", "", instanceAddresses{}, err
+		}
+
+		DHCPv6Opt = &id
+	}
+
+	// Replace any existing port, as the instance is recreated. It gets the same MAC address as before.
+	instancePortName := getInstancePortName(projectName, network, instanceName)
+	instancePortMAC, err := networkStableMAC(instancePortName)
 	if err != nil {
-		return "", "", err
+		return "", "", instanceAddresses{}, err
+	}
+
+	// Let OVN allocate the addresses unless the instance has static ones, which port security then restricts the
+	// instance to. In stateful mode northd allocates the IPv6 address that DHCPv6 hands out. In the other modes the
+	// instance configures its IPv6 address from the router advertisements, which is derived from the MAC address like
+	// the one northd allocates, so a port without IPv4 is given that address rather than waiting for northd.
+	instancePort := &nbLogicalSwitchPort{
+		Name:          instancePortName,
+		Addresses:     []string{fmt.Sprintf("%s dynamic", instancePortMAC)},
+		Dhcpv4Options: DHCPv4Opt,
+		Dhcpv6Options: DHCPv6Opt,
+	}
+
+	static, found := network.instanceIPs[instanceName]
+	dynamic := !found && (network.ipv4 || network.ipv6Mode == "dhcpv6_stateful")
+	if !found && !dynamic {
+		hwAddr, err := net.ParseMAC(instancePortMAC)
+		if err != nil {
+			return "", "", instanceAddresses{}, err
+		}
+
+		ip6, err := eui64.ParseMAC(intNet6.IP, hwAddr)
+		if err != nil {
+			return "", "", instanceAddresses{}, err
+		}
+
+		instancePort.Addresses = []string{fmt.Sprintf("%s %s", instancePortMAC, ip6.String())}
+	} else if found {
+		addresses, err := getInstanceStaticAddresses(internalSwitch, intNet4, intNet6, instancePortName, instancePortMAC, static)
+		if err != nil {
+			return "", "", instanceAddresses{}, fmt.Errorf("Instance %q: %w", instanceName, err)
+		}
+
+		instancePort.Addresses = []string{addresses}
+		instancePort.PortSecurity = []string{addresses}
 	}
 
-	_, err = ovnNbctl("lsp-set-dhcpv6-options", instancePortName, DHCPv6Opt)
+	err = replaceInstancePort(internalSwitch, instancePort)
 	if err != nil {
-		return "", "", err
+		return "", "", instanceAddresses{}, err
 	}
 
 	// Clear existing OVS ports.
 	err = clearOVSPort(instancePortName)
 	if err != nil {
-		return "", "", err
+		return "", "", instanceAddresses{}, err
 	}
 
 	// Create veth pair from project network namespace to host network namespace.
 	hostName := networkRandomDevName("insth")
 	peerName := networkRandomDevName("instp")
 
-	_, err = shared.RunCommand("ip", "link", "add", "dev", hostName, "type", "veth", "peer", "name", peerName)
+	_, err = runCommand("ip", "link", "add", "dev", hostName, "type", "veth", "peer", "name", peerName)
 	if err != nil {
-		return "", "", err
+		return "", "", instanceAddresses{}, err
 	}
 
 	// No need for auto-generated link-local IPv6 addresses on host interface connected to bridge.
-	_, err = shared.RunCommand("sysctl",
+	_, err = runCommand("sysctl",
 		fmt.Sprintf("net.ipv6.conf.%s.disable_ipv6=1", hostName),
 		fmt.Sprintf("net.ipv4.conf.%s.forwarding=0", hostName),
 	)
 	if err != nil {
-		return "", "", err
+		return "", "", instanceAddresses{}, err
 	}
 
-	_, err = shared.RunCommand("ip", "link", "set", "dev", peerName, "address", instancePortMAC)
+	_, err = runCommand("ip", "link", "set", "dev", peerName, "address", instancePortMAC)
 	if err != nil {
-		return "", "", err
+		return "", "", instanceAddresses{}, err
 	}
 
 	// Connect host end to integration bridge.
-	_, err = shared.RunCommand("ovs-vsctl", "add-port", "br-int", hostName)
+	_, err = runCommand("ovs-vsctl", "add-port", "br-int", hostName)
+	if err != nil {
+		return "", "", instanceAddresses{}, err
+	}
+
+	_, err = runCommand("ovs-vsctl", "set", "interface", hostName, fmt.Sprintf("external_ids:iface-id=%s", instancePortName))
+	if err != nil {
+		return "", "", instanceAddresses{}, err
+	}
+
+	_, err = runCommand("ip", "link", "set", "dev", hostName, "up")
+	if err != nil {
+		return "", "", instanceAddresses{}, err
+	}
+
+	addresses := instanceAddresses{}
+	if dynamic {
+		addresses, err = waitInstancePortDynamicAddresses(instancePortName, intNet4, intNet6)
+		if err != nil {
+			return "", "", instanceAddresses{}, err
+		}
+	} else {
+		for _, field := range strings.Fields(instancePort.Addresses[0])[1:] {
+			ip := net.ParseIP(field)
+			if ip.To4() != nil {
+				addresses.ipv4 = ip.String()
+			} else {
+				addresses.ipv6 = ip.String()
+			}
+		}
+	}
+
+	return peerName, instancePortMAC, addresses, nil
+}
+
+// waitInstancePortDynamicAddresses waits for northd to allocate addresses to an instance port and returns them.
+// The IPv6 address is derived from the MAC address and the internal IPv6 subnet if northd doesn't report one.
+// The subnet of an IP family the network doesn't have is nil. In dry-run mode the port doesn't exist, so placeholders
+// are returned.
+func waitInstancePortDynamicAddresses(portName string, intNet4 *net.IPNet, intNet6 *net.IPNet) (instanceAddresses, error) {
+	if dryRun {
+		addresses := instanceAddresses{}
+		if intNet4 != nil {
+			addresses.ipv4 = fmt.Sprintf("<ipv4:%s>", portName)
+		}
+
+		if intNet6 != nil {
+			addresses.ipv6 = fmt.Sprintf("<ipv6:%s>", portName)
+		}
+
+		return addresses, nil
+	}
+
+	for i := 0; i < 50; i++ {
+		port, err := nb.GetLogicalSwitchPort(portName)
+		if err != nil {
+			return instanceAddresses{}, err
+		}
+
+		if port == nil {
+			return instanceAddresses{}, fmt.Errorf("Logical switch port %q not found", portName)
+		}
+
+		if port.DynamicAddresses == nil || *port.DynamicAddresses == "" {
+			time.Sleep(200 * time.Millisecond)
+			continue
+		}
+
+		// The dynamic addresses are the MAC address followed by the IPv4 and IPv6 addresses northd allocated.
+		fields := strings.Fields(*port.DynamicAddresses)
+		mac, err := net.ParseMAC(fields[0])
+		if err != nil {
+			return instanceAddresses{}, fmt.Errorf("Invalid dynamic addresses %q of port %q: %w", *port.DynamicAddresses, portName, err)
+		}
+
+		addresses := instanceAddresses{}
+		for _, field := range fields[1:] {
+			ip := net.ParseIP(field)
+			if ip != nil && ip.To4() != nil {
+				addresses.ipv4 = ip.String()
+			} else if ip != nil {
+				addresses.ipv6 = ip.String()
+			}
+		}
+
+		if addresses.ipv6 == "" && intNet6 != nil {
+			ip6, err := eui64.ParseMAC(intNet6.IP, mac)
+			if err != nil {
+				return instanceAddresses{}, err
+			}
+
+			addresses.ipv6 = ip6.String()
+		}
+
+		return addresses, nil
+	}
+
+	return instanceAddresses{}, fmt.Errorf("Timed out waiting for northd to allocate addresses to port %q", portName)
+}
+
+// getInstanceStaticAddresses returns the addresses column entry for an instance port with static addresses, after
+// checking them against the internal switch's subnet, ipv6_prefix and exclude_ips and the addresses of its other
+// ports. The subnets of the network are used if the switch doesn't exist yet in dry-run mode. The subnet of an IP
+// family the network doesn't have is nil, and the port gets no address of that family.
+func getInstanceStaticAddresses(internalSwitch *nbLogicalSwitch, intNet4 *net.IPNet, intNet6 *net.IPNet, portName string, mac string, static instanceAddresses) (string, error) {
+	subnet4, subnet6 := "", ""
+	if intNet4 != nil {
+		subnet4 = intNet4.String()
+	}
+
+	if intNet6 != nil {
+		subnet6 = intNet6.String()
+	}
+
+	excludeIPs := ""
+	if internalSwitch.OtherConfig != nil {
+		subnet4 = internalSwitch.OtherConfig["subnet"]
+		subnet6 = internalSwitch.OtherConfig["ipv6_prefix"]
+		excludeIPs = internalSwitch.OtherConfig["exclude_ips"]
+	}
+
+	fields := []string{mac}
+
+	var ip4 net.IP
+	if intNet4 != nil {
+		_, switchNet4, err := net.ParseCIDR(subnet4)
+		if err != nil {
+			return "", fmt.Errorf("Logical switch %q has no valid subnet", internalSwitch.Name)
+		}
+
+		broadcast4 := make(net.IP, len(switchNet4.IP))
+		for i := range switchNet4.IP {
+			broadcast4[i] = switchNet4.IP[i] | ^switchNet4.Mask[i]
+		}
+
+		ip4 = net.ParseIP(static.ipv4)
+		if ip4 == nil || ip4.To4() == nil || !switchNet4.Contains(ip4) || ip4.Equal(switchNet4.IP) || ip4.Equal(broadcast4) {
+			return "", fmt.Errorf("Static IPv4 address %q is not a host address in subnet %q", static.ipv4, switchNet4.String())
+		}
+
+		for _, exclude := range strings.Fields(excludeIPs) {
+			first, last := exclude, exclude
+			parts := strings.SplitN(exclude, "..", 2)
+			if len(parts) == 2 {
+				first, last = parts[0], parts[1]
+			}
+
+			if bytes.Compare(ip4.To4(), net.ParseIP(first).To4()) >= 0 && bytes.Compare(ip4.To4(), net.ParseIP(last).To4()) <= 0 {
+				return "", fmt.Errorf("Static IPv4 address %q is in the excluded addresses %q", static.ipv4, excludeIPs)
+			}
+		}
+
+		fields = append(fields, ip4.String())
+	}
+
+	var ip6 net.IP
+	if intNet6 != nil {
+		_, switchNet6, err := net.ParseCIDR(subnet6)
+		if err != nil {
+			return "", fmt.Errorf("Logical switch %q has no valid ipv6_prefix", internalSwitch.Name)
+		}
+
+		// Use the address that OVN would derive from the MAC address if there is no static IPv6 address.
+		if static.ipv6 != "" {
+			ip6 = net.ParseIP(static.ipv6)
+			if ip6 == nil || ip6.To4() != nil || !switchNet6.Contains(ip6) {
+				return "", fmt.Errorf("Static IPv6 address %q is not in prefix %q", static.ipv6, switchNet6.String())
+			}
+		} else {
+			hwAddr, err := net.ParseMAC(mac)
+			if err != nil {
+				return "", err
+			}
+
+			ip6, err = eui64.ParseMAC(switchNet6.IP, hwAddr)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		fields = append(fields, ip6.String())
+	}
+
+	// Check that no other port on the switch has the addresses.
+	ports, err := nb.GetLogicalSwitchPorts(internalSwitch)
 	if err != nil {
-		return "", "", err
+		return "", err
 	}
 
-	_, err = shared.RunCommand("ovs-vsctl", "set", "interface", hostName, fmt.Sprintf("external_ids:iface-id=%s", instancePortName))
+	for _, port := range ports {
+		if port.Name == portName {
+			continue
+		}
+
+		addresses := append([]string{}, port.Addresses...)
+		if port.DynamicAddresses != nil {
+			addresses = append(addresses, *port.DynamicAddresses)
+		}
+
+		for _, address := range addresses {
+			for _, field := range strings.Fields(address) {
+				ip := net.ParseIP(field)
+				if ip != nil && ((ip4 != nil && ip.Equal(ip4)) || (ip6 != nil && ip.Equal(ip6))) {
+					return "", fmt.Errorf("Static address %q is already used by port %q", ip.String(), port.Name)
+				}
+			}
+		}
+	}
+
+	return strings.Join(fields, " "), nil
+}
+
+// replaceInstancePort replaces any existing instance port of the same name with port in a single transaction.
+func replaceInstancePort(internalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	nb.Begin()
+	defer nb.Abort()
+
+	existingPort, err := nb.GetLogicalSwitchPort(port.Name)
 	if err != nil {
-		return "", "", err
+		return err
+	}
+
+	if existingPort != nil {
+		err = nb.DeleteLogicalSwitchPort(internalSwitch, existingPort)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = shared.RunCommand("ip", "link", "set", "dev", hostName, "up")
+	err = nb.CreateLogicalSwitchPort(internalSwitch, port)
 	if err != nil {
-		return "", "", err
+		return err
 	}
 
-	return peerName, instancePortMAC, nil
+	return nb.Commit()
 }
 
-func createInstance(projectName string, network network, instanceName string, instPortName string) error {
-	instName := fmt.Sprintf("%s-%s-%s", projectName, network.name, instanceName)
-	shared.RunCommand("lxc", "delete", "-f", instName)
+// createInstance creates and starts an instance using the peer interface of its port, recording the port's addresses
+// in the instance's user.ipv4_address and user.ipv6_address config keys for DNS records and ACLs.
+func createInstance(projectName string, network network, instanceName string, instPortName string, addresses instanceAddresses) error {
+	instName := getInstanceName(projectName, network, instanceName)
+	runCommand("lxc", "delete", "-f", instName)
 
-	_, err := shared.RunCommand("lxc", "init", "images:alpine/3.12", instName)
+	_, err := runCommand("lxc", "init", "images:alpine/3.12", instName)
 	if err != nil {
 		return err
 	}
 
-	_, err = shared.RunCommand("lxc", "config", "device", "add", instName, "eth0", "nic", "nictype=physical", "name=eth0", fmt.Sprintf("parent=%s", instPortName))
+	_, err = runCommand("lxc", "config", "device", "add", instName, "eth0", "nic", "nictype=physical", "name=eth0", fmt.Sprintf("parent=%s", instPortName))
 	if err != nil {
 		return err
 	}
 
-	_, err = shared.RunCommand("lxc", "start", instName)
+	for _, config := range [][2]string{{"user.ipv4_address", addresses.ipv4}, {"user.ipv6_address", addresses.ipv6}} {
+		if config[1] == "" {
+			continue
+		}
+
+		_, err = runCommand("lxc", "config", "set", instName, config[0], config[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = runCommand("lxc", "start", instName)
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// deleteProjectNetwork removes the instances, OVS ports, logical switches, logical router and DHCP options that
+// were created for a project network.
+func deleteProjectNetwork(projectName string, network network) error {
+	logicalRouterName := getLogicalRouterName(projectName, network)
+	internalSwitchName := getLogicalIntSwitchName(projectName, network)
+	externalSwitchName := getLogicalExtSwitchName(projectName, network)
+
+	// Find the instances connected to the internal switch, including those no longer in the topology.
+	instances := append([]string{}, network.instances...)
+	internalSwitchPorts, err := getLogicalSwitchPorts(internalSwitchName)
+	if err != nil {
+		return err
+	}
+
+	instancePortPrefix := getInstancePortName(projectName, network, "")
+	for _, port := range internalSwitchPorts {
+		if !strings.HasPrefix(port.Name, instancePortPrefix) {
+			continue
+		}
+
+		instanceName := strings.TrimPrefix(port.Name, instancePortPrefix)
+		if !shared.StringInSlice(instanceName, instances) {
+			instances = append(instances, instanceName)
+		}
+	}
+
+	for _, instanceName := range instances {
+		// Instance may have never been created, so ignore errors.
+		runCommand("lxc", "delete", "-f", getInstanceName(projectName, network, instanceName))
+
+		// Remove OVS port and veth pair connected to the instance port.
+		err = clearOVSPort(getInstancePortName(projectName, network, instanceName))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Delete the NB records in a single transaction.
+	nb.Begin()
+	defer nb.Abort()
+
+	// Delete the switches, which also removes their ports.
+	for _, switchName := range []string{internalSwitchName, externalSwitchName} {
+		logicalSwitch, err := nb.GetLogicalSwitch(switchName)
+		if err != nil {
+			return err
+		}
+
+		if logicalSwitch == nil {
+			continue
+		}
+
+		err = nb.DeleteLogicalSwitch(logicalSwitch)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Delete the router, which also removes its ports, NAT entries and routes.
+	router, err := nb.GetLogicalRouter(logicalRouterName)
+	if err != nil {
+		return err
+	}
+
+	if router != nil {
+		// Remove the port on the transit switch, which isn't deleted with the router.
+		err = detachTransitSwitch(projectName, network)
+		if err != nil {
+			return err
+		}
+
+		// Remove the other side of any peer links, which would otherwise point at a missing port.
+		err = removePeers(router)
+		if err != nil {
+			return err
+		}
+
+		err = nb.DeleteLogicalRouter(router)
+		if err != nil {
+			return err
+		}
+	}
+
+	// DHCP options can only be removed once the ports referencing them are gone.
+	err = clearDHCPOptions(internalSwitchName)
+	if err != nil {
+		return err
+	}
+
+	return nb.Commit()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// nbEndpoints are the addresses of the members of the NB database cluster.
+var nbEndpoints []string
+
+// sbEndpoints are the addresses of the members of the SB database cluster.
+var sbEndpoints []string
+
+// ovnDBAddress returns the address of the OVN database on ndbIP listening on port, using SSL if enabled.
+func ovnDBAddress(port int) string {
+	proto := "tcp"
+	if ovnSSL.enabled() {
+		proto = "ssl"
+	}
+
+	return fmt.Sprintf("%s:%s:%d", proto, ndbIP, port)
+}
+
+// parseDBEndpoints parses a comma separated list of database endpoints (tcp:IP:PORT or ssl:IP:PORT, with IPv6
+// addresses in brackets). If value is empty the database on ndbIP listening on port is used.
+func parseDBEndpoints(value string, port int) ([]string, error) {
+	if value == "" {
+		return []string{ovnDBAddress(port)}, nil
+	}
+
+	endpoints := []string{}
+	for _, endpoint := range strings.Split(value, ",") {
+		endpoint = strings.TrimSpace(endpoint)
+
+		parts := strings.SplitN(endpoint, ":", 2)
+		if len(parts) != 2 || (parts[0] != "tcp" && parts[0] != "ssl") {
+			return nil, fmt.Errorf("Invalid database endpoint %q (must be tcp:IP:PORT or ssl:IP:PORT)", endpoint)
+		}
+
+		host, portStr, err := net.SplitHostPort(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid database endpoint %q: %w", endpoint, err)
+		}
+
+		_, err = strconv.ParseUint(portStr, 10, 16)
+		if host == "" || err != nil {
+			return nil, fmt.Errorf("Invalid database endpoint %q", endpoint)
+		}
+
+		if parts[0] == "ssl" && !ovnSSL.enabled() {
+			return nil, fmt.Errorf("Database endpoint %q requires the SSL private key, certificate and CA certificate", endpoint)
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, nil
+}
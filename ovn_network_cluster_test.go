@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParseDBEndpoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		ssl    bool
+		want   []string
+		errMsg string
+	}{
+		{
+			name:  "empty list",
+			value: "",
+			want:  []string{fmt.Sprintf("tcp:%s:6643", ndbIP)},
+		},
+		{
+			name:  "empty list with SSL",
+			value: "",
+			ssl:   true,
+			want:  []string{fmt.Sprintf("ssl:%s:6643", ndbIP)},
+		},
+		{
+			name:  "cluster",
+			value: "tcp:10.0.0.1:6641, tcp:10.0.0.2:6641,tcp:[fd00::3]:6641",
+			want:  []string{"tcp:10.0.0.1:6641", "tcp:10.0.0.2:6641", "tcp:[fd00::3]:6641"},
+		},
+		{
+			name:  "mixed tcp and ssl",
+			value: "ssl:10.0.0.1:6641,tcp:10.0.0.2:6641",
+			ssl:   true,
+			want:  []string{"ssl:10.0.0.1:6641", "tcp:10.0.0.2:6641"},
+		},
+		{
+			name:   "ssl without certificates",
+			value:  "tcp:10.0.0.1:6641,ssl:10.0.0.2:6641",
+			errMsg: `Database endpoint "ssl:10.0.0.2:6641" requires the SSL private key, certificate and CA certificate`,
+		},
+		{
+			name:   "missing port",
+			value:  "tcp:10.0.0.1",
+			errMsg: `Invalid database endpoint "tcp:10.0.0.1": address 10.0.0.1: missing port in address`,
+		},
+		{
+			name:   "empty port",
+			value:  "tcp:10.0.0.1:",
+			errMsg: `Invalid database endpoint "tcp:10.0.0.1:"`,
+		},
+		{
+			name:   "missing protocol",
+			value:  "10.0.0.1:6641",
+			errMsg: `Invalid database endpoint "10.0.0.1:6641" (must be tcp:IP:PORT or ssl:IP:PORT)`,
+		},
+		{
+			name:   "empty member",
+			value:  "tcp:10.0.0.1:6641,",
+			errMsg: `Invalid database endpoint "" (must be tcp:IP:PORT or ssl:IP:PORT)`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldSSL := ovnSSL
+			t.Cleanup(func() { ovnSSL = oldSSL })
+
+			ovnSSL = ovnSSLConfig{}
+			if tt.ssl {
+				ovnSSL = ovnSSLConfig{privateKey: "key.pem", certificate: "cert.pem", caCert: "ca.pem"}
+			}
+
+			got, err := parseDBEndpoints(tt.value, 6643)
+			if tt.errMsg != "" {
+				if err == nil || err.Error() != tt.errMsg {
+					t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
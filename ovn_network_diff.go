@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"text/tabwriter"
+)
+
+// drift is a difference between what the topology wants and what is in the NB database.
+type drift struct {
+	Project string `json:"project"`
+	Network string `json:"network"`
+	Kind    string `json:"kind"` // missing, extra or changed.
+	Table   string `json:"table"`
+	Record  string `json:"record"`
+	Column  string `json:"column,omitempty"`
+	Have    string `json:"have,omitempty"`
+	Want    string `json:"want,omitempty"`
+}
+
+// driftClient is an nbClient that reads from the live NB database and records the changes it is asked to make as
+// drift instead of making them. Running the provisioning functions with it reports what they would change.
+type driftClient struct {
+	nbClient
+
+	project string
+	network string
+	txn     nbTxn
+	drift   []drift
+
+	// seen holds the rows returned by the Get functions by UUID, to compare updates against.
+	seen map[string]interface{}
+
+	// wanted holds the UUIDs of the existing rows that the provisioning functions updated, even if nothing changed.
+	wanted map[string]bool
+}
+
+// newDriftClient returns a driftClient reading from live for a project network.
+func newDriftClient(live nbClient, projectName string, network network) *driftClient {
+	return &driftClient{
+		nbClient: live,
+		project:  projectName,
+		network:  network.name,
+		seen:     map[string]interface{}{},
+		wanted:   map[string]bool{},
+	}
+}
+
+// nbRowName returns a description of row (a pointer to an NB row) that identifies it within its parent.
+func nbRowName(row interface{}) string {
+	switch r := row.(type) {
+	case *nbLogicalRouterStaticRoute:
+		return fmt.Sprintf("%s via %s", r.IPPrefix, r.Nexthop)
+	case *nbNAT:
+		return fmt.Sprintf("%s %s -> %s", r.Type, r.LogicalIP, r.ExternalIP)
+	case *nbDHCPOptions:
+		return r.Cidr
+	case *nbHAChassis:
+		return r.ChassisName
+	case *nbGlobal:
+		return "."
+	}
+
+	name, err := nbField(row, "name")
+	if err != nil {
+		return ""
+	}
+
+	return name.String()
+}
+
+// add records drift for row (a pointer to an NB row).
+func (c *driftClient) add(kind string, row interface{}, column string, have string, want string) {
+	c.drift = append(c.drift, drift{
+		Project: c.project,
+		Network: c.network,
+		Kind:    kind,
+		Table:   nbTableName(row),
+		Record:  nbRowName(row),
+		Column:  column,
+		Have:    have,
+		Want:    want,
+	})
+}
+
+// see remembers copies of rows (pointers to NB rows, or a pointer to a slice of them) returned by the live
+// database, as the provisioning functions modify the rows they are given before updating them.
+func (c *driftClient) see(rows interface{}) {
+	value := reflect.ValueOf(rows)
+	if value.IsNil() {
+		return
+	}
+
+	if value.Elem().Kind() != reflect.Slice {
+		c.seen[c.uuid(rows)] = nbCopy(rows)
+		return
+	}
+
+	for i := 0; i < value.Elem().Len(); i++ {
+		row := value.Elem().Index(i).Addr().Interface()
+		c.seen[c.uuid(row)] = nbCopy(row)
+	}
+}
+
+// uuid returns the UUID of row (a pointer to an NB row).
+func (c *driftClient) uuid(row interface{}) string {
+	uuid, _ := nbField(row, "_uuid")
+	return uuid.String()
+}
+
+// create records row as missing and gives it a placeholder UUID so that it can be found by later lookups.
+func (c *driftClient) create(row interface{}, placeholder string) error {
+	c.add("missing", row, "", "", "")
+
+	uuid, _ := nbField(row, "_uuid")
+	uuid.SetString(placeholder)
+	c.txn.create(row, placeholder)
+
+	return nil
+}
+
+// Begin does nothing as no changes are made.
+func (c *driftClient) Begin() {}
+
+// Commit forgets the rows that would have been created.
+func (c *driftClient) Commit() error {
+	c.txn.reset()
+	return nil
+}
+
+// Abort forgets the rows that would have been created.
+func (c *driftClient) Abort() {
+	c.txn.reset()
+}
+
+// GetLogicalRouter returns the logical router with the given name.
+func (c *driftClient) GetLogicalRouter(name string) (*nbLogicalRouter, error) {
+	router, err := c.nbClient.GetLogicalRouter(name)
+	if err != nil || router != nil {
+		c.see(router)
+		return router, err
+	}
+
+	router = &nbLogicalRouter{}
+	if !c.txn.getCreated(router, "name", name) {
+		return nil, nil
+	}
+
+	return router, nil
+}
+
+// GetLogicalRouterPort returns the logical router port with the given name.
+func (c *driftClient) GetLogicalRouterPort(name string) (*nbLogicalRouterPort, error) {
+	port, err := c.nbClient.GetLogicalRouterPort(name)
+	c.see(port)
+	return port, err
+}
+
+// GetLogicalRouterNATs returns the NAT rules of a logical router.
+func (c *driftClient) GetLogicalRouterNATs(router *nbLogicalRouter) ([]nbNAT, error) {
+	nats, err := c.nbClient.GetLogicalRouterNATs(router)
+	c.see(&nats)
+	return nats, err
+}
+
+// GetLogicalRouterStaticRoutes returns the static routes of a logical router.
+func (c *driftClient) GetLogicalRouterStaticRoutes(router *nbLogicalRouter) ([]nbLogicalRouterStaticRoute, error) {
+	routes, err := c.nbClient.GetLogicalRouterStaticRoutes(router)
+	c.see(&routes)
+	return routes, err
+}
+
+// GetLogicalSwitch returns the logical switch with the given name.
+func (c *driftClient) GetLogicalSwitch(name string) (*nbLogicalSwitch, error) {
+	logicalSwitch, err := c.nbClient.GetLogicalSwitch(name)
+	if err != nil || logicalSwitch != nil {
+		c.see(logicalSwitch)
+		return logicalSwitch, err
+	}
+
+	logicalSwitch = &nbLogicalSwitch{}
+	if !c.txn.getCreated(logicalSwitch, "name", name) {
+		return nil, nil
+	}
+
+	return logicalSwitch, nil
+}
+
+// GetLogicalSwitchPort returns the logical switch port with the given name.
+func (c *driftClient) GetLogicalSwitchPort(name string) (*nbLogicalSwitchPort, error) {
+	port, err := c.nbClient.GetLogicalSwitchPort(name)
+	c.see(port)
+	return port, err
+}
+
+// GetDHCPOptions returns the DHCP options associated to a logical switch.
+func (c *driftClient) GetDHCPOptions(switchName string) ([]nbDHCPOptions, error) {
+	opts, err := c.nbClient.GetDHCPOptions(switchName)
+	if err != nil {
+		return nil, err
+	}
+
+	c.see(&opts)
+	for _, created := range c.txn.createdRows("DHCP_Options", "external_ids:lxd_network", switchName) {
+		opts = append(opts, *created.(*nbDHCPOptions))
+	}
+
+	return opts, nil
+}
+
+// GetNBGlobal returns the NB_Global row.
+func (c *driftClient) GetNBGlobal() (*nbGlobal, error) {
+	global, err := c.nbClient.GetNBGlobal()
+	c.see(global)
+	return global, err
+}
+
+// CreateLogicalRouter records the logical router as missing.
+func (c *driftClient) CreateLogicalRouter(router *nbLogicalRouter) error {
+	return c.create(router, dryRunUUID("logical_router", router.Name))
+}
+
+// CreateLogicalRouterPort records the logical router port as missing.
+func (c *driftClient) CreateLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	return c.create(port, dryRunUUID("logical_router_port", port.Name))
+}
+
+// CreateLogicalRouterStaticRoute records the static route as missing.
+func (c *driftClient) CreateLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	return c.create(route, dryRunUUID("logical_router_static_route", route.IPPrefix))
+}
+
+// CreateNAT records the NAT rule as missing.
+func (c *driftClient) CreateNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	return c.create(nat, dryRunUUID("nat", nat.LogicalIP))
+}
+
+// CreateLogicalSwitch records the logical switch as missing.
+func (c *driftClient) CreateLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	return c.create(logicalSwitch, dryRunUUID("logical_switch", logicalSwitch.Name))
+}
+
+// CreateLogicalSwitchPort records the logical switch port as missing.
+func (c *driftClient) CreateLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	return c.create(port, dryRunUUID("logical_switch_port", port.Name))
+}
+
+// CreateDHCPOptions records the DHCP options as missing.
+func (c *driftClient) CreateDHCPOptions(opts *nbDHCPOptions) error {
+	return c.create(opts, dryRunUUID("dhcp_options", opts.Cidr))
+}
+
+// CreateHAChassisGroup records the HA chassis group as missing.
+func (c *driftClient) CreateHAChassisGroup(group *nbHAChassisGroup) error {
+	return c.create(group, dryRunUUID("ha_chassis_group", group.Name))
+}
+
+// CreateHAChassis records the HA chassis as missing.
+func (c *driftClient) CreateHAChassis(group *nbHAChassisGroup, chassis *nbHAChassis) error {
+	return c.create(chassis, dryRunUUID("ha_chassis", chassis.ChassisName))
+}
+
+// Update records the named columns of an existing row as changed. Rows that would have been created are already
+// recorded as missing.
+func (c *driftClient) Update(row interface{}, columns ...string) error {
+	have, found := c.seen[c.uuid(row)]
+	if !found {
+		return nil
+	}
+
+	c.wanted[c.uuid(row)] = true
+	for _, column := range columns {
+		haveVal, err := nbField(have, column)
+		if err != nil {
+			return err
+		}
+
+		wantVal, err := nbField(row, column)
+		if err != nil {
+			return err
+		}
+
+		c.add("changed", have, column, nbctlEncodeValue(haveVal), nbctlEncodeValue(wantVal))
+	}
+
+	return nil
+}
+
+// DeleteLogicalRouter records the logical router as extra.
+func (c *driftClient) DeleteLogicalRouter(router *nbLogicalRouter) error {
+	c.add("extra", router, "", "", "")
+	return nil
+}
+
+// DeleteLogicalRouterPort records the logical router port as extra.
+func (c *driftClient) DeleteLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	c.add("extra", port, "", "", "")
+	return nil
+}
+
+// DeleteLogicalRouterStaticRoute records the static route as extra. It is then treated as accounted for, so that it
+// isn't reported again with the static routes the provisioning functions didn't touch.
+func (c *driftClient) DeleteLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	c.add("extra", route, "", "", "")
+	c.wanted[c.uuid(route)] = true
+	return nil
+}
+
+// DeleteNAT records the NAT rule as extra.
+func (c *driftClient) DeleteNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	c.add("extra", nat, "", "", "")
+	return nil
+}
+
+// DeleteLogicalSwitch records the logical switch as extra.
+func (c *driftClient) DeleteLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	c.add("extra", logicalSwitch, "", "", "")
+	return nil
+}
+
+// DeleteLogicalSwitchPort records the logical switch port as extra.
+func (c *driftClient) DeleteLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	c.add("extra", port, "", "", "")
+	return nil
+}
+
+// DeleteDHCPOptions records the DHCP options as extra. They are then treated as accounted for, so that they aren't
+// reported again with the DHCP options the provisioning functions didn't touch.
+func (c *driftClient) DeleteDHCPOptions(opts *nbDHCPOptions) error {
+	c.add("extra", opts, "", "", "")
+	c.wanted[c.uuid(opts)] = true
+	return nil
+}
+
+// diffProjectNetwork returns the drift between a project network's definition and the NB database.
+// The provisioning functions are run against a driftClient to find the records they would create or change, and
+// then the router ports, static routes, switch ports and DHCP options they didn't account for are reported as extra.
+func diffProjectNetwork(projectName string, network network) ([]drift, error) {
+	live := nb
+	c := newDriftClient(live, projectName, network)
+	nb = c
+	defer func() { nb = live }()
+
+	err := createProjectNetwork(projectName, network)
+	if err != nil {
+		return nil, err
+	}
+
+	// The instance ports are replaced whenever an instance is added, so only check that they exist.
+	instancePorts := map[string]bool{}
+	for _, instance := range network.instances {
+		name := getInstancePortName(projectName, network, instance)
+		instancePorts[name] = true
+
+		port, err := live.GetLogicalSwitchPort(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if port == nil {
+			c.add("missing", &nbLogicalSwitchPort{Name: name}, "", "", "")
+		}
+	}
+
+	router, err := live.GetLogicalRouter(getLogicalRouterName(projectName, network))
+	if err != nil {
+		return nil, err
+	}
+
+	if router != nil {
+		ports, err := live.GetLogicalRouterPorts(router)
+		if err != nil {
+			return nil, err
+		}
+
+		// Peer ports are added by the peer mode rather than from the topology.
+		for i := range ports {
+			if !c.wanted[ports[i].UUID] && ports[i].Peer == nil {
+				c.add("extra", &ports[i], "", "", "")
+			}
+		}
+
+		routes, err := live.GetLogicalRouterStaticRoutes(router)
+		if err != nil {
+			return nil, err
+		}
+
+		// As are the routes through the peer ports, and ovn-ic manages the routes learned from other availability
+		// zones.
+		for i := range routes {
+			_, peer := routes[i].ExternalIDs["lxd_peer"]
+			if !c.wanted[routes[i].UUID] && !peer && !isICLearnedRoute(routes[i]) {
+				c.add("extra", &routes[i], "", "", "")
+			}
+		}
+	}
+
+	for _, switchName := range []string{getLogicalExtSwitchName(projectName, network), getLogicalIntSwitchName(projectName, network)} {
+		logicalSwitch, err := live.GetLogicalSwitch(switchName)
+		if err != nil {
+			return nil, err
+		}
+
+		if logicalSwitch == nil {
+			continue
+		}
+
+		ports, err := live.GetLogicalSwitchPorts(logicalSwitch)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range ports {
+			if !c.wanted[ports[i].UUID] && !instancePorts[ports[i].Name] {
+				c.add("extra", &ports[i], "", "", "")
+			}
+		}
+	}
+
+	opts, err := live.GetDHCPOptions(getLogicalIntSwitchName(projectName, network))
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range opts {
+		if !c.wanted[opts[i].UUID] {
+			c.add("extra", &opts[i], "", "", "")
+		}
+	}
+
+	return c.drift, nil
+}
+
+// diffHAChassisGroup returns drift if the HA chassis group that external router ports use doesn't exist.
+func diffHAChassisGroup() ([]drift, error) {
+	group, err := nb.GetHAChassisGroup(haChassisGroup)
+	if err != nil || group != nil {
+		return nil, err
+	}
+
+	return []drift{{Project: "-", Network: "-", Kind: "missing", Table: "HA_Chassis_Group", Record: haChassisGroup}}, nil
+}
+
+// diffInterconnection returns the drift between the interconnection settings and NB_Global, and reports the transit
+// switches that ovn-ic hasn't added to the NB database.
+func diffInterconnection(ic *topologyInterconnection) ([]drift, error) {
+	live := nb
+	c := newDriftClient(live, "-", network{name: "-"})
+	nb = c
+	defer func() { nb = live }()
+
+	err := configureInterconnection(ic)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ts := range ic.TransitSwitches {
+		transitSwitch, err := live.GetLogicalSwitch(ts.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if transitSwitch == nil || transitSwitch.OtherConfig["interconn-ts"] != ts.Name {
+			c.add("missing", &nbLogicalSwitch{Name: ts.Name}, "", "", "")
+		}
+	}
+
+	return c.drift, nil
+}
+
+// printDriftJSON writes the drift to w as JSON.
+func printDriftJSON(w io.Writer, drift []drift) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(drift)
+}
+
+// printDriftTable writes the drift to w as a table with a row per difference.
+func printDriftTable(w io.Writer, drift []drift) error {
+	if len(drift) == 0 {
+		_, err := fmt.Fprintln(w, "No drift found")
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tNETWORK\tDRIFT\tTABLE\tRECORD\tCOLUMN\tHAVE\tWANT")
+	for _, d := range drift {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.Project, d.Network, d.Kind, d.Table, d.Record, d.Column, d.Have, d.Want)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffProjectNetwork(t *testing.T) {
+	outputPort := "p-n-lrp-ext"
+	srcIP := "src-ip"
+
+	// defaultRoute returns the IPv4 default route of the network's router.
+	defaultRoute := func(t *testing.T) *nbLogicalRouterStaticRoute {
+		router, err := nb.GetLogicalRouter("p-n")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		routes, err := nb.GetLogicalRouterStaticRoutes(router)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := range routes {
+			if routes[i].IPPrefix == "0.0.0.0/0" {
+				return &routes[i]
+			}
+		}
+
+		t.Fatal("Default route not found")
+		return nil
+	}
+
+	// createCustomRoute adds a route from the network definition to the network's router.
+	createCustomRoute := func(t *testing.T) {
+		router, _ := nb.GetLogicalRouter("p-n")
+		err := nb.CreateLogicalRouterStaticRoute(router, &nbLogicalRouterStaticRoute{IPPrefix: "10.50.0.0/16", Nexthop: "10.0.0.254", ExternalIDs: map[string]string{"lxd_network": "p-n"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T)
+		network func(n *network) // Changes the network definition after it was set up.
+		want    []drift
+	}{
+		{
+			name:  "no drift",
+			setup: func(t *testing.T) {},
+		},
+		{
+			name: "extra route",
+			setup: func(t *testing.T) {
+				router, _ := nb.GetLogicalRouter("p-n")
+				err := nb.CreateLogicalRouterStaticRoute(router, &nbLogicalRouterStaticRoute{IPPrefix: "10.1.0.0/16", Nexthop: "192.0.2.5"})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []drift{{Kind: "extra", Table: "Logical_Router_Static_Route", Record: "10.1.0.0/16 via 192.0.2.5"}},
+		},
+		{
+			name: "default route nexthop",
+			setup: func(t *testing.T) {
+				route := defaultRoute(t)
+				route.Nexthop = "192.0.2.254"
+				err := nb.Update(route, "nexthop")
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []drift{{Kind: "changed", Table: "Logical_Router_Static_Route", Record: "0.0.0.0/0 via 192.0.2.254", Column: "nexthop", Have: `"192.0.2.254"`, Want: `"192.0.2.1"`}},
+		},
+		{
+			name: "default route output port and policy",
+			setup: func(t *testing.T) {
+				route := defaultRoute(t)
+				route.OutputPort = &outputPort
+				route.Policy = &srcIP
+				err := nb.Update(route, "output_port", "policy")
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: []drift{
+				{Kind: "changed", Table: "Logical_Router_Static_Route", Record: "0.0.0.0/0 via 192.0.2.1", Column: "output_port", Have: `"p-n-lrp-ext"`, Want: "[]"},
+				{Kind: "changed", Table: "Logical_Router_Static_Route", Record: "0.0.0.0/0 via 192.0.2.1", Column: "policy", Have: `"src-ip"`, Want: "[]"},
+			},
+		},
+		{
+			name:  "custom route",
+			setup: func(t *testing.T) { createCustomRoute(t) },
+			network: func(n *network) {
+				n.routes = []staticRoute{{prefix: "10.50.0.0/16", nexthop: "10.0.0.254", policy: "dst-ip"}}
+			},
+		},
+		{
+			name:  "custom route removed from the definition",
+			setup: func(t *testing.T) { createCustomRoute(t) },
+			want:  []drift{{Kind: "extra", Table: "Logical_Router_Static_Route", Record: "10.50.0.0/16 via 10.0.0.254"}},
+		},
+		{
+			name: "route learned from another availability zone",
+			setup: func(t *testing.T) {
+				router, _ := nb.GetLogicalRouter("p-n")
+				err := nb.CreateLogicalRouterStaticRoute(router, &nbLogicalRouterStaticRoute{IPPrefix: "10.9.0.0/24", Nexthop: "169.254.100.2", ExternalIDs: map[string]string{"ic-learned-route": "x"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:  "dropped IPv6",
+			setup: func(t *testing.T) {},
+			network: func(n *network) {
+				n.ipv6 = false
+				n.gw6, n.dns6, n.ipv6Mode, n.extIP6Prefix, n.extGW6 = "", "", "", "", ""
+			},
+			// The IPv6 default route is reported once, though it is both removed and left untouched.
+			want: []drift{
+				{Kind: "changed", Table: "Logical_Router_Port", Record: "p-n-lrp-ext", Column: "networks", Have: `["192.0.2.10/24","2001:db8::216:3eff:fe09:182d/64"]`, Want: `["192.0.2.10/24"]`},
+				{Kind: "extra", Table: "Logical_Router_Static_Route", Record: "::/0 via 2001:db8::1"},
+				{Kind: "extra", Table: "NAT", Record: "snat fd00::/64 -> 2001:db8::216:3eff:fe09:182d"},
+				{Kind: "changed", Table: "Logical_Router_Port", Record: "p-n-lrp-int", Column: "networks", Have: `["10.0.0.1/24","fd00::1/64"]`, Want: `["10.0.0.1/24"]`},
+				{Kind: "changed", Table: "Logical_Router_Port", Record: "p-n-lrp-int", Column: "ipv6_ra_configs", Have: `{"address_mode"="slaac","dnssl"="lxd","max_interval"="15","min_interval"="10","rdnss"="fd00::53","send_periodic"="true"}`, Want: "{}"},
+				{Kind: "changed", Table: "Logical_Switch", Record: "p-n-ls-int", Column: "other_config", Have: `{"exclude_ips"="10.0.0.1","ipv6_prefix"="fd00::/64","subnet"="10.0.0.0/24"}`, Want: `{"exclude_ips"="10.0.0.1","subnet"="10.0.0.0/24"}`},
+				{Kind: "extra", Table: "DHCP_Options", Record: "fd00::/64"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _ = setupTestNB(t)
+			n := testNetwork("n")
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.setup(t)
+			if tt.network != nil {
+				tt.network(&n)
+			}
+
+			got, err := diffProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range tt.want {
+				tt.want[i].Project = "p"
+				tt.want[i].Network = "n"
+			}
+
+			if len(got) != 0 || len(tt.want) != 0 {
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("Expected drift %+v, got %+v", tt.want, got)
+				}
+			}
+
+			// Reconciling removes the drift, apart from extra records that aren't the network's to remove.
+			err = createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err = diffProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, d := range got {
+				if d.Kind != "extra" {
+					t.Errorf("Unexpected drift after reconciling %+v", d)
+				}
+			}
+		})
+	}
+}
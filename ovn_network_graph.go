@@ -0,0 +1,334 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// graphNode is a router, switch, instance port or uplink bridge in the logical topology graph.
+type graphNode struct {
+	id      string
+	project string // Empty for nodes shared between projects, such as uplink bridges.
+	kind    string // router, switch, instance or uplink.
+	name    string
+}
+
+// graphEdge is a link between two graph nodes, labelled with the ports and addresses on each side.
+type graphEdge struct {
+	from  string
+	to    string
+	kind  string // router-switch, instance, localnet or peer.
+	label []string
+}
+
+// graph is the logical topology of the project networks, as found in the NB database.
+type graph struct {
+	nodes []graphNode
+	index map[string]string
+	edges []graphEdge
+	peers map[string]bool
+
+	// routerPorts maps router port names to the name of the router they belong to. It is only loaded when a peer
+	// link is found, as it needs every router port in the NB database.
+	routerPorts map[string]string
+}
+
+// newGraph returns an empty graph.
+func newGraph() *graph {
+	return &graph{index: map[string]string{}, peers: map[string]bool{}}
+}
+
+// node returns the ID of the node of kind with the given name, adding it if it isn't in the graph yet.
+// A node added without a project, such as a peer router, is moved into the project if it is found in one later.
+func (g *graph) node(project string, kind string, name string) string {
+	key := kind + "/" + name
+	id, found := g.index[key]
+	if found {
+		for i := range g.nodes {
+			if g.nodes[i].id == id && g.nodes[i].project == "" {
+				g.nodes[i].project = project
+			}
+		}
+
+		return id
+	}
+
+	id = fmt.Sprintf("n%d", len(g.nodes))
+	g.index[key] = id
+	g.nodes = append(g.nodes, graphNode{id: id, project: project, kind: kind, name: name})
+
+	return id
+}
+
+// edge adds an edge between from and to.
+func (g *graph) edge(from string, to string, kind string, label ...string) {
+	g.edges = append(g.edges, graphEdge{from: from, to: to, kind: kind, label: label})
+}
+
+// getRouterPortOwner returns the name of the router that the named router port belongs to, or an empty string if
+// it doesn't belong to any router.
+func (g *graph) getRouterPortOwner(portName string) (string, error) {
+	if g.routerPorts == nil {
+		routers, err := nb.GetLogicalRouters()
+		if err != nil {
+			return "", err
+		}
+
+		g.routerPorts = map[string]string{}
+		for i := range routers {
+			ports, err := nb.GetLogicalRouterPorts(&routers[i])
+			if err != nil {
+				return "", err
+			}
+
+			for _, port := range ports {
+				g.routerPorts[port.Name] = routers[i].Name
+			}
+		}
+	}
+
+	return g.routerPorts[portName], nil
+}
+
+// addProjectNetwork adds the router and switches of a project network to the graph, along with the links between
+// them, the instance ports, the uplink bridge, the transit switch and any peer routers. Records that don't exist are
+// left out.
+func (g *graph) addProjectNetwork(projectName string, network network) error {
+	// Find the router ports that each switch port connects to.
+	switchRouterPorts := map[string]nbLogicalSwitchPort{}
+	switchNodes := map[string]string{}
+	switchNames := []string{getLogicalExtSwitchName(projectName, network), getLogicalIntSwitchName(projectName, network)}
+	if network.transitSwitch != "" {
+		switchNames = append(switchNames, network.transitSwitch)
+	}
+
+	for _, switchName := range switchNames {
+		logicalSwitch, err := nb.GetLogicalSwitch(switchName)
+		if err != nil {
+			return err
+		}
+
+		if logicalSwitch == nil {
+			continue
+		}
+
+		// Transit switches are shared between projects.
+		switchProject := projectName
+		if switchName == network.transitSwitch {
+			switchProject = ""
+		}
+
+		switchNode := g.node(switchProject, "switch", logicalSwitch.Name)
+
+		ports, err := nb.GetLogicalSwitchPorts(logicalSwitch)
+		if err != nil {
+			return err
+		}
+
+		sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+
+		for _, port := range ports {
+			switch port.Type {
+			case "router":
+				switchRouterPorts[port.Options["router-port"]] = port
+				switchNodes[port.Options["router-port"]] = switchNode
+			case "localnet":
+				uplinkNode := g.node("", "uplink", port.Options["network_name"])
+				g.edge(switchNode, uplinkNode, "localnet", port.Name)
+			case "":
+				addresses := strings.Join(port.Addresses, " ")
+				if port.DynamicAddresses != nil && *port.DynamicAddresses != "" {
+					addresses = *port.DynamicAddresses
+				}
+
+				instanceNode := g.node(projectName, "instance", port.Name)
+				g.edge(switchNode, instanceNode, "instance", addresses)
+			}
+		}
+	}
+
+	router, err := nb.GetLogicalRouter(getLogicalRouterName(projectName, network))
+	if err != nil || router == nil {
+		return err
+	}
+
+	routerNode := g.node(projectName, "router", router.Name)
+
+	ports, err := nb.GetLogicalRouterPorts(router)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Name < ports[j].Name })
+
+	for _, port := range ports {
+		routerPort := fmt.Sprintf("%s %s", port.Name, strings.Join(port.Networks, " "))
+
+		if port.Peer != nil {
+			// Both ends of a peer link are found when both routers are in the graph, so only add it once.
+			key := strings.Join([]string{port.Name, *port.Peer}, "/")
+			if port.Name > *port.Peer {
+				key = strings.Join([]string{*port.Peer, port.Name}, "/")
+			}
+
+			if g.peers[key] {
+				continue
+			}
+
+			g.peers[key] = true
+
+			peerRouterName, err := g.getRouterPortOwner(*port.Peer)
+			if err != nil {
+				return err
+			}
+
+			if peerRouterName == "" {
+				continue
+			}
+
+			peerPort, err := nb.GetLogicalRouterPort(*port.Peer)
+			if err != nil {
+				return err
+			}
+
+			peerRouterPort := *port.Peer
+			if peerPort != nil {
+				peerRouterPort = fmt.Sprintf("%s %s", peerPort.Name, strings.Join(peerPort.Networks, " "))
+			}
+
+			// The peer router may be in a project that isn't in the topology.
+			peerNode := g.node("", "router", peerRouterName)
+			g.edge(routerNode, peerNode, "peer", routerPort, peerRouterPort)
+			continue
+		}
+
+		switchPort, found := switchRouterPorts[port.Name]
+		if !found {
+			continue
+		}
+
+		g.edge(routerNode, switchNodes[port.Name], "router-switch", routerPort, switchPort.Name)
+	}
+
+	return nil
+}
+
+// printGraphDOT writes the graph to w in Graphviz DOT format, with a cluster per project.
+func printGraphDOT(w io.Writer, g *graph) error {
+	shapes := map[string]string{"router": "box", "switch": "ellipse", "instance": "note", "uplink": "cylinder"}
+	styles := map[string]string{"peer": "dashed", "localnet": "bold"}
+
+	quote := func(s string) string {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+	}
+
+	fmt.Fprintln(w, "graph ovn {")
+	fmt.Fprintln(w, "  node [fontname=monospace];")
+	fmt.Fprintln(w, "  edge [fontname=monospace, fontsize=10];")
+
+	for _, project := range graphProjects(g) {
+		indent := "  "
+		if project != "" {
+			fmt.Fprintf(w, "  subgraph %s {\n", quote("cluster_"+project))
+			fmt.Fprintf(w, "    label=%s;\n", quote(project))
+			indent = "    "
+		}
+
+		for _, n := range g.nodes {
+			if n.project == project {
+				fmt.Fprintf(w, "%s%s [label=%s, shape=%s];\n", indent, n.id, quote(n.name), shapes[n.kind])
+			}
+		}
+
+		if project != "" {
+			fmt.Fprintln(w, "  }")
+		}
+	}
+
+	for _, e := range g.edges {
+		style := ""
+		if styles[e.kind] != "" {
+			style = fmt.Sprintf(", style=%s", styles[e.kind])
+		}
+
+		fmt.Fprintf(w, "  %s -- %s [label=%s%s];\n", e.from, e.to, quote(strings.Join(e.label, "\n")), style)
+	}
+
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
+
+// printGraphMermaid writes the graph to w as a Mermaid flowchart, with a subgraph per project.
+func printGraphMermaid(w io.Writer, g *graph) error {
+	shapes := map[string][2]string{"router": {"[", "]"}, "switch": {"([", "])"}, "instance": {">", "]"}, "uplink": {"[(", ")]"}}
+	links := map[string]string{"peer": "-.-", "localnet": "==="}
+
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, "#quot;") + `"`
+	}
+
+	fmt.Fprintln(w, "flowchart LR")
+
+	for _, project := range graphProjects(g) {
+		indent := "  "
+		if project != "" {
+			fmt.Fprintf(w, "  subgraph %s[%s]\n", "project_"+graphMermaidID(project), quote(project))
+			indent = "    "
+		}
+
+		for _, n := range g.nodes {
+			if n.project == project {
+				shape := shapes[n.kind]
+				fmt.Fprintf(w, "%s%s%s%s%s\n", indent, n.id, shape[0], quote(n.name), shape[1])
+			}
+		}
+
+		if project != "" {
+			fmt.Fprintln(w, "  end")
+		}
+	}
+
+	for _, e := range g.edges {
+		link := links[e.kind]
+		if link == "" {
+			link = "---"
+		}
+
+		label := make([]string, 0, len(e.label))
+		for _, line := range e.label {
+			label = append(label, strings.ReplaceAll(line, `"`, "#quot;"))
+		}
+
+		fmt.Fprintf(w, "  %s %s|\"%s\"| %s\n", e.from, link, strings.Join(label, "<br>"), e.to)
+	}
+
+	return nil
+}
+
+// graphProjects returns the projects that have nodes in the graph, in the order they were added, followed by an
+// empty string for the nodes that don't belong to a project.
+func graphProjects(g *graph) []string {
+	projects := []string{}
+	for _, n := range g.nodes {
+		if n.project != "" && !shared.StringInSlice(n.project, projects) {
+			projects = append(projects, n.project)
+		}
+	}
+
+	return append(projects, "")
+}
+
+// graphMermaidID returns name with the characters that Mermaid doesn't allow in IDs replaced.
+func graphMermaidID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+
+		return '_'
+	}, name)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// testGraphNodes returns the nodes of g as "project/kind/name" strings, in the order they were added.
+func testGraphNodes(g *graph) []string {
+	nodes := make([]string, 0, len(g.nodes))
+	for _, n := range g.nodes {
+		nodes = append(nodes, strings.Join([]string{n.project, n.kind, n.name}, "/"))
+	}
+
+	return nodes
+}
+
+// testGraphEdges returns the edges of g as "kind from-name to-name" strings, in the order they were added.
+func testGraphEdges(g *graph) []string {
+	names := map[string]string{}
+	for _, n := range g.nodes {
+		names[n.id] = n.name
+	}
+
+	edges := make([]string, 0, len(g.edges))
+	for _, e := range g.edges {
+		edges = append(edges, strings.Join([]string{e.kind, names[e.from], names[e.to]}, " "))
+	}
+
+	return edges
+}
+
+// createTestPeerPorts links the routers of two project networks with a pair of peer router ports.
+func createTestPeerPorts(t *testing.T, routerA string, routerB string) {
+	t.Helper()
+
+	portA, portB := routerA+"-lrp-peer", routerB+"-lrp-peer"
+	for _, end := range []struct {
+		router  string
+		port    string
+		peer    string
+		network string
+	}{
+		{routerA, portA, portB, "169.254.0.1/30"},
+		{routerB, portB, portA, "169.254.0.2/30"},
+	} {
+		router, err := nb.GetLogicalRouter(end.router)
+		if err != nil || router == nil {
+			t.Fatalf("Router %q not found: %v", end.router, err)
+		}
+
+		peer := end.peer
+		err = nb.CreateLogicalRouterPort(router, &nbLogicalRouterPort{Name: end.port, MAC: "00:16:3e:00:00:01", Networks: []string{end.network}, Peer: &peer})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGraphAddProjectNetwork(t *testing.T) {
+	_, _ = setupTestNB(t)
+	n := testNetwork("n")
+	err := createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, _, err = addInstancePort("p", n, "c1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := newGraph()
+	err = g.addProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Networks that don't exist add nothing.
+	err = g.addProjectNetwork("p", testNetwork("missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantNodes := []string{"p/switch/p-n-ls-ext", "/uplink/br0", "p/switch/p-n-ls-int", "p/instance/p-n-ls-inst-c1", "p/router/p-n"}
+	if strings.Join(testGraphNodes(g), ", ") != strings.Join(wantNodes, ", ") {
+		t.Errorf("Expected nodes %v, got %v", wantNodes, testGraphNodes(g))
+	}
+
+	wantEdges := []string{
+		"localnet p-n-ls-ext br0",
+		"instance p-n-ls-int p-n-ls-inst-c1",
+		"router-switch p-n p-n-ls-ext",
+		"router-switch p-n p-n-ls-int",
+	}
+
+	if strings.Join(testGraphEdges(g), ", ") != strings.Join(wantEdges, ", ") {
+		t.Errorf("Expected edges %v, got %v", wantEdges, testGraphEdges(g))
+	}
+}
+
+func TestGraphPeerRouters(t *testing.T) {
+	_, _ = setupTestNB(t)
+	a, b := testNetwork("a"), testNetwork("b")
+	for _, project := range []struct {
+		name    string
+		network network
+	}{{"p", a}, {"q", b}} {
+		err := createProjectNetwork(project.name, project.network)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	createTestPeerPorts(t, "p-a", "q-b")
+
+	g := newGraph()
+	err := g.addProjectNetwork("p", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The peer router is added without a project, as its network hasn't been added yet.
+	found := false
+	for _, n := range g.nodes {
+		if n.kind == "router" && n.name == "q-b" {
+			found = true
+			if n.project != "" {
+				t.Errorf("Peer router added to project %q", n.project)
+			}
+		}
+	}
+
+	if !found {
+		t.Fatalf("Peer router not in graph: %v", testGraphNodes(g))
+	}
+
+	// Adding the peer's network moves the peer router into its project, and the link is only added once.
+	err = g.addProjectNetwork("q", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range g.nodes {
+		if n.kind == "router" && n.name == "q-b" && n.project != "q" {
+			t.Errorf("Peer router left in project %q", n.project)
+		}
+	}
+
+	peerEdges := []graphEdge{}
+	for _, e := range g.edges {
+		if e.kind == "peer" {
+			peerEdges = append(peerEdges, e)
+		}
+	}
+
+	if len(peerEdges) != 1 {
+		t.Fatalf("Expected one peer edge, got %+v", peerEdges)
+	}
+
+	wantLabel := "p-a-lrp-peer 169.254.0.1/30, q-b-lrp-peer 169.254.0.2/30"
+	if strings.Join(peerEdges[0].label, ", ") != wantLabel {
+		t.Errorf("Expected peer edge label %q, got %q", wantLabel, strings.Join(peerEdges[0].label, ", "))
+	}
+}
+
+// testGraph returns a small graph with a router and switch in a project, and an uplink bridge outside of it.
+func testGraph() *graph {
+	g := newGraph()
+	router := g.node("p", "router", "p-n")
+	ls := g.node("p", "switch", "p-n-ls-ext")
+	uplink := g.node("", "uplink", `br"0`)
+	g.edge(router, ls, "router-switch", "p-n-lrp-ext 192.0.2.10/24", "p-n-lsp-router-ext")
+	g.edge(ls, uplink, "localnet", "p-n-lsp-parent-ext")
+
+	return g
+}
+
+func TestPrintGraphDOT(t *testing.T) {
+	var out bytes.Buffer
+	err := printGraphDOT(&out, testGraph())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `graph ovn {
+  node [fontname=monospace];
+  edge [fontname=monospace, fontsize=10];
+  subgraph "cluster_p" {
+    label="p";
+    n0 [label="p-n", shape=box];
+    n1 [label="p-n-ls-ext", shape=ellipse];
+  }
+  n2 [label="br\"0", shape=cylinder];
+  n0 -- n1 [label="p-n-lrp-ext 192.0.2.10/24\np-n-lsp-router-ext"];
+  n1 -- n2 [label="p-n-lsp-parent-ext", style=bold];
+}
+`
+
+	if out.String() != want {
+		t.Errorf("Unexpected DOT output:\n%s", out.String())
+	}
+}
+
+func TestPrintGraphMermaid(t *testing.T) {
+	var out bytes.Buffer
+	err := printGraphMermaid(&out, testGraph())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `flowchart LR
+  subgraph project_p["p"]
+    n0["p-n"]
+    n1(["p-n-ls-ext"])
+  end
+  n2[("br#quot;0")]
+  n0 ---|"p-n-lrp-ext 192.0.2.10/24<br>p-n-lsp-router-ext"| n1
+  n1 ===|"p-n-lsp-parent-ext"| n2
+`
+
+	if out.String() != want {
+		t.Errorf("Unexpected Mermaid output:\n%s", out.String())
+	}
+}
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// importedNetwork is a project network found in the NB database, along with the uplink settings it uses.
+type importedNetwork struct {
+	project string
+	network topologyNetwork
+	uplink  topologyUplink
+
+	// transitSwitch is the transit switch the router is attached to, with the subnets of its router port.
+	transitSwitch *topologyTransitSwitch
+}
+
+// importTopology builds a topology from the project networks in the NB database, so that they can be managed by
+// this tool. If prefix is set, only logical routers named "<prefix>-<network>" are imported into the prefix project.
+// Otherwise the project name is taken to be the part of the router name up to the first "-".
+// Routers that don't have the ports, switches, routes and DHCP options the tool creates are skipped, as they can't be
+// adopted without renaming them.
+func importTopology(prefix string) (*topology, error) {
+	routers, err := nb.GetLogicalRouters()
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(routers, func(i, j int) bool { return routers[i].Name < routers[j].Name })
+
+	imported := []importedNetwork{}
+	for i := range routers {
+		projectName, networkName := "", ""
+		if prefix != "" {
+			if !strings.HasPrefix(routers[i].Name, prefix+"-") {
+				continue
+			}
+
+			projectName, networkName = prefix, strings.TrimPrefix(routers[i].Name, prefix+"-")
+		} else {
+			parts := strings.SplitN(routers[i].Name, "-", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				log.Printf("Skipping logical router %q: name isn't of the form <project>-<network>", routers[i].Name)
+				continue
+			}
+
+			projectName, networkName = parts[0], parts[1]
+		}
+
+		n, err := importProjectNetwork(&routers[i], projectName, network{name: networkName})
+		if err != nil {
+			return nil, err
+		}
+
+		if n == nil {
+			continue
+		}
+
+		imported = append(imported, *n)
+	}
+
+	t := &topology{Uplinks: []topologyUplink{}, Projects: []topologyProject{}}
+	for _, n := range imported {
+		// Networks share an uplink when they use the same bridge and external addressing, where a single-stack
+		// network only has to match the IP family it has. The uplink takes the DNS servers of the first network
+		// using it, and other networks only override them where they differ.
+		var uplink *topologyUplink
+		for i := range t.Uplinks {
+			u := &t.Uplinks[i]
+			if u.Bridge != n.uplink.Bridge {
+				continue
+			}
+
+			compatible := true
+			for _, field := range [][2]string{{u.IPv6Prefix, n.uplink.IPv6Prefix}, {u.Gateway4, n.uplink.Gateway4}, {u.Gateway6, n.uplink.Gateway6}} {
+				if field[0] != "" && field[1] != "" && field[0] != field[1] {
+					compatible = false
+				}
+			}
+
+			if !compatible {
+				continue
+			}
+
+			for _, field := range [][2]*string{{&u.IPv6Prefix, &n.uplink.IPv6Prefix}, {&u.Gateway4, &n.uplink.Gateway4}, {&u.Gateway6, &n.uplink.Gateway6}, {&u.DNS4, &n.uplink.DNS4}, {&u.DNS6, &n.uplink.DNS6}} {
+				if *field[0] == "" {
+					*field[0] = *field[1]
+				}
+			}
+
+			uplink = u
+			break
+		}
+
+		if uplink == nil {
+			n.uplink.Name = n.uplink.Bridge
+			for i := 2; t.hasUplink(n.uplink.Name); i++ {
+				n.uplink.Name = fmt.Sprintf("%s-%d", n.uplink.Bridge, i)
+			}
+
+			t.Uplinks = append(t.Uplinks, n.uplink)
+			uplink = &t.Uplinks[len(t.Uplinks)-1]
+		}
+
+		n.network.Uplink = uplink.Name
+		if n.network.DNS4 == uplink.DNS4 {
+			n.network.DNS4 = ""
+		}
+
+		if n.network.DNS6 == uplink.DNS6 {
+			n.network.DNS6 = ""
+		}
+
+		if len(t.Projects) == 0 || t.Projects[len(t.Projects)-1].Name != n.project {
+			t.Projects = append(t.Projects, topologyProject{Name: n.project})
+		}
+
+		project := &t.Projects[len(t.Projects)-1]
+		project.Networks = append(project.Networks, n.network)
+	}
+
+	err = importInterconnection(t, imported)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Imported topology is invalid: %w", err)
+	}
+
+	return t, nil
+}
+
+// importedUplinksNote is written above an imported topology, as the uplinks can't be fully recovered from the NB
+// database.
+const importedUplinksNote = `# Uplinks are named after their bridge, with a -N suffix when networks on the same bridge use different external
+# addressing. Rename them as needed, along with the uplink keys of the networks using them.
+# The ipv4_subnet and ipv4_range of the uplinks aren't recorded in the NB database, so they are left out. The imported
+# networks keep their external_ip4, but the uplinks need both set before networks without one can be added.
+`
+
+// writeImportedTopology writes an imported topology to w as YAML, after a note on the uplink settings that have to
+// be reviewed by hand.
+func writeImportedTopology(w io.Writer, t *topology) error {
+	if len(t.Uplinks) > 0 {
+		_, err := fmt.Fprint(w, importedUplinksNote)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.write(w)
+}
+
+// importInterconnection sets the interconnection settings of the topology from NB_Global, with the transit switches
+// the imported networks are attached to. Transit switches attached to networks of more than one IP family get the
+// subnets of each. If NB_Global has no availability zone name, the networks are imported without transit switches.
+func importInterconnection(t *topology, imported []importedNetwork) error {
+	switches := []topologyTransitSwitch{}
+	for _, n := range imported {
+		if n.transitSwitch == nil {
+			continue
+		}
+
+		found := false
+		for i := range switches {
+			if switches[i].Name != n.transitSwitch.Name {
+				continue
+			}
+
+			if switches[i].IPv4 == "" {
+				switches[i].IPv4 = n.transitSwitch.IPv4
+			}
+
+			if switches[i].IPv6 == "" {
+				switches[i].IPv6 = n.transitSwitch.IPv6
+			}
+
+			found = true
+		}
+
+		if !found {
+			switches = append(switches, *n.transitSwitch)
+		}
+	}
+
+	if len(switches) == 0 {
+		return nil
+	}
+
+	global, err := nb.GetNBGlobal()
+	if err != nil {
+		return err
+	}
+
+	if global == nil || global.Name == "" {
+		log.Printf("Skipping transit switches: NB_Global has no availability zone name")
+		for i := range t.Projects {
+			for j := range t.Projects[i].Networks {
+				t.Projects[i].Networks[j].TransitSwitch = ""
+			}
+		}
+
+		return nil
+	}
+
+	sort.Slice(switches, func(i, j int) bool { return switches[i].Name < switches[j].Name })
+
+	t.Interconnection = &topologyInterconnection{
+		AvailabilityZone:      global.Name,
+		RouteAdvertise:        global.Options["ic-route-adv"] == "true",
+		RouteAdvertiseDefault: global.Options["ic-route-adv-default"] == "true",
+		RouteLearn:            global.Options["ic-route-learn"] == "true",
+		RouteLearnDefault:     global.Options["ic-route-learn-default"] == "true",
+		TransitSwitches:       switches,
+	}
+
+	return nil
+}
+
+// hasUplink returns whether the topology has an uplink with the given name.
+func (t *topology) hasUplink(name string) bool {
+	_, err := t.uplink(name)
+	return err == nil
+}
+
+// importProjectNetwork returns the definition of the project network whose logical router is router, or nil if the
+// router doesn't have the records the tool creates for a project network.
+func importProjectNetwork(router *nbLogicalRouter, projectName string, network network) (*importedNetwork, error) {
+	skip := func(format string, args ...interface{}) (*importedNetwork, error) {
+		log.Printf("Skipping logical router %q: %s", router.Name, fmt.Sprintf(format, args...))
+		return nil, nil
+	}
+
+	externalRouterPortName, _ := getLogicalExtSwitchRouterPortNames(projectName, network)
+	internalRouterPortName, _ := getLogicalIntSwitchRouterPortNames(projectName, network)
+
+	ports := map[string]*nbLogicalRouterPort{}
+	for _, name := range []string{externalRouterPortName, internalRouterPortName} {
+		port, err := nb.GetLogicalRouterPort(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if port == nil || !shared.StringInSlice(port.UUID, router.Ports) {
+			return skip("no router port %q", name)
+		}
+
+		ports[name] = port
+	}
+
+	extIP4, extNet6, err := importIPv4AndIPv6(ports[externalRouterPortName].Networks)
+	if err != nil {
+		return skip("router port %q: %v", externalRouterPortName, err)
+	}
+
+	// The IP families of the network are those of the internal router port, which the external one must also have.
+	gw4, gw6, err := importIPv4AndIPv6(ports[internalRouterPortName].Networks)
+	if err != nil {
+		return skip("router port %q: %v", internalRouterPortName, err)
+	}
+
+	if (gw4 != "" && extIP4 == "") || (gw6 != "" && extNet6 == "") {
+		return skip("router port %q doesn't have the IP families of %q", externalRouterPortName, internalRouterPortName)
+	}
+
+	families := []string{}
+	extPrefix6, ipv6Mode := "", ""
+	if gw4 != "" {
+		families = append(families, "ipv4")
+	} else {
+		extIP4 = ""
+	}
+
+	if gw6 != "" {
+		families = append(families, "ipv6")
+
+		_, extNet, _ := net.ParseCIDR(extNet6)
+		extPrefix6 = extNet.String()
+
+		// SLAAC is the default IPv6 mode, so is left out.
+		ipv6Mode = ports[internalRouterPortName].Ipv6RaConfigs["address_mode"]
+		if ipv6Mode == "slaac" {
+			ipv6Mode = ""
+		}
+	}
+
+	// Dual-stack is the default, so only single-stack networks list their family.
+	if len(families) == 2 {
+		families = nil
+	}
+
+	// Find the default routes, which are the ones ensureStaticRoute manages, and the routes from the network
+	// definition, which createLogicalRouterRoutes marks with the router name. A default route marked with the router
+	// name takes precedence over an unmarked one.
+	routes, err := nb.GetLogicalRouterStaticRoutes(router)
+	if err != nil {
+		return nil, err
+	}
+
+	nexthops := map[string]string{}
+	customRoutes := []topologyRoute{}
+	for _, route := range routes {
+		if route.ExternalIDs["lxd_network"] == router.Name {
+			customRoute := topologyRoute{Prefix: route.IPPrefix, Nexthop: route.Nexthop}
+			if route.OutputPort != nil {
+				customRoute.OutputPort = *route.OutputPort
+			}
+
+			if route.Policy != nil && *route.Policy != "dst-ip" {
+				customRoute.Policy = *route.Policy
+			}
+
+			customRoutes = append(customRoutes, customRoute)
+			continue
+		}
+
+		marked := route.ExternalIDs["lxd_default_route"] == router.Name
+		if isICLearnedRoute(route) || (!marked && (route.OutputPort != nil || (route.Policy != nil && *route.Policy != "dst-ip"))) {
+			continue
+		}
+
+		_, routeNet, err := net.ParseCIDR(route.IPPrefix)
+		if err == nil && (marked || nexthops[routeNet.String()] == "") {
+			nexthops[routeNet.String()] = route.Nexthop
+		}
+	}
+
+	// The transit switch comes from the external_ids of the transit router port, and its subnets from the port's
+	// networks.
+	var transitSwitch *topologyTransitSwitch
+	transitSwitchName := ""
+	transitRouterPortName, _ := getLogicalTransitSwitchRouterPortNames(projectName, network)
+	transitRouterPort, err := nb.GetLogicalRouterPort(transitRouterPortName)
+	if err != nil {
+		return nil, err
+	}
+
+	if transitRouterPort != nil && shared.StringInSlice(transitRouterPort.UUID, router.Ports) && transitRouterPort.ExternalIDs["lxd_transit_switch"] != "" {
+		transitSwitchName = transitRouterPort.ExternalIDs["lxd_transit_switch"]
+		transitSwitch = &topologyTransitSwitch{Name: transitSwitchName}
+		for _, cidr := range transitRouterPort.Networks {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return skip("router port %q: %v", transitRouterPortName, err)
+			}
+
+			if ipFamily(subnet) == "ipv4" {
+				transitSwitch.IPv4 = subnet.String()
+			} else {
+				transitSwitch.IPv6 = subnet.String()
+			}
+		}
+	}
+
+	sort.Slice(customRoutes, func(i, j int) bool {
+		if customRoutes[i].Prefix != customRoutes[j].Prefix {
+			return customRoutes[i].Prefix < customRoutes[j].Prefix
+		}
+
+		return customRoutes[i].Nexthop < customRoutes[j].Nexthop
+	})
+
+	for _, route := range []struct {
+		prefix string
+		family bool
+	}{{"0.0.0.0/0", gw4 != ""}, {"::/0", gw6 != ""}} {
+		if !route.family {
+			delete(nexthops, route.prefix)
+		} else if nexthops[route.prefix] == "" {
+			return skip("no %s route", route.prefix)
+		}
+	}
+
+	// IP families without a SNAT rule for the internal subnet are routed.
+	nats, err := nb.GetLogicalRouterNATs(router)
+	if err != nil {
+		return nil, err
+	}
+
+	snats := map[string]bool{}
+	for _, nat := range nats {
+		_, logicalNet, err := net.ParseCIDR(nat.LogicalIP)
+		if nat.Type == "snat" && err == nil {
+			snats[logicalNet.String()] = true
+		}
+	}
+
+	routed := []string{}
+	for _, gw := range []string{gw4, gw6} {
+		if gw == "" {
+			continue
+		}
+
+		_, subnet, _ := net.ParseCIDR(gw)
+		if !snats[subnet.String()] {
+			routed = append(routed, ipFamily(subnet))
+		}
+	}
+
+	// The bridge comes from the localnet port on the external switch.
+	externalSwitchName := getLogicalExtSwitchName(projectName, network)
+	parentPortName := getLogicalExtSwitchParentPortName(projectName, network)
+	parentPort, err := nb.GetLogicalSwitchPort(parentPortName)
+	if err != nil {
+		return nil, err
+	}
+
+	externalSwitch, err := nb.GetLogicalSwitch(externalSwitchName)
+	if err != nil {
+		return nil, err
+	}
+
+	if externalSwitch == nil || parentPort == nil || !shared.StringInSlice(parentPort.UUID, externalSwitch.Ports) || parentPort.Options["network_name"] == "" {
+		return skip("no localnet port %q on %q", parentPortName, externalSwitchName)
+	}
+
+	// The DNS servers come from the DHCP options of the internal switch.
+	internalSwitchName := getLogicalIntSwitchName(projectName, network)
+	internalSwitch, err := nb.GetLogicalSwitch(internalSwitchName)
+	if err != nil {
+		return nil, err
+	}
+
+	if internalSwitch == nil {
+		return skip("no logical switch %q", internalSwitchName)
+	}
+
+	// The router address is always excluded from dynamic allocation, the rest are the reserved addresses. A reserved
+	// range may cover the router address, in which case it isn't listed on its own.
+	routerIP4, _, _ := net.ParseCIDR(gw4)
+	reservedIPs := []string{}
+	for _, exclude := range strings.Fields(internalSwitch.OtherConfig["exclude_ips"]) {
+		if gw4 != "" && exclude != routerIP4.String() {
+			reservedIPs = append(reservedIPs, strings.Replace(exclude, "..", "-", 1))
+		}
+	}
+
+	existingOpts, err := nb.GetDHCPOptions(internalSwitchName)
+	if err != nil {
+		return nil, err
+	}
+
+	dns := map[string]string{}
+	for _, gw := range []string{gw4, gw6} {
+		if gw == "" {
+			continue
+		}
+
+		_, subnet, _ := net.ParseCIDR(gw)
+		opts := getDHCPOptionsForSubnet(existingOpts, subnet)
+		if opts == nil || opts.Options["dns_server"] == "" {
+			return skip("no %s DHCP options with a DNS server on %q", ipFamily(subnet), internalSwitchName)
+		}
+
+		dns[ipFamily(subnet)] = opts.Options["dns_server"]
+	}
+
+	// Instances are found from their ports on the internal switch.
+	switchPorts, err := nb.GetLogicalSwitchPorts(internalSwitch)
+	if err != nil {
+		return nil, err
+	}
+
+	// Instances with static addresses have them in the addresses column instead of "dynamic".
+	instances := []topologyInstance{}
+	instancePortPrefix := getInstancePortName(projectName, network, "")
+	for _, port := range switchPorts {
+		if !strings.HasPrefix(port.Name, instancePortPrefix) {
+			continue
+		}
+
+		instance := topologyInstance{Name: strings.TrimPrefix(port.Name, instancePortPrefix)}
+		for _, address := range port.Addresses {
+			for _, field := range strings.Fields(address) {
+				ip := net.ParseIP(field)
+				if ip == nil {
+					continue
+				}
+
+				// Only stateful DHCPv6 can hand out a static IPv6 address, otherwise it is derived from the MAC.
+				if ip.To4() != nil {
+					instance.IPv4 = ip.String()
+				} else if ipv6Mode == "dhcpv6_stateful" {
+					instance.IPv6 = ip.String()
+				}
+			}
+		}
+
+		instances = append(instances, instance)
+	}
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].Name < instances[j].Name })
+
+	return &importedNetwork{
+		project: projectName,
+		network: topologyNetwork{
+			Name:          network.name,
+			Families:      families,
+			Routed:        routed,
+			Routes:        customRoutes,
+			Gateway4:      gw4,
+			Gateway6:      gw6,
+			ExtIP4:        extIP4,
+			DNS4:          dns["ipv4"],
+			DNS6:          dns["ipv6"],
+			IPv6Mode:      ipv6Mode,
+			Instances:     instances,
+			ReservedIPs:   reservedIPs,
+			TransitSwitch: transitSwitchName,
+		},
+		transitSwitch: transitSwitch,
+		uplink: topologyUplink{
+			Bridge:     parentPort.Options["network_name"],
+			IPv6Prefix: extPrefix6,
+			Gateway4:   nexthops["0.0.0.0/0"],
+			Gateway6:   nexthops["::/0"],
+			DNS4:       dns["ipv4"],
+			DNS6:       dns["ipv6"],
+		},
+	}, nil
+}
+
+// importIPv4AndIPv6 returns the IPv4 and IPv6 addresses (in CIDR notation) of a router port's networks, which must
+// have at most one of each. The address of an IP family the port doesn't have is empty.
+func importIPv4AndIPv6(networks []string) (string, string, error) {
+	ip4, ip6 := "", ""
+	for _, network := range networks {
+		ip, _, err := net.ParseCIDR(network)
+		if err != nil {
+			return "", "", err
+		}
+
+		if ip.To4() != nil && ip4 == "" {
+			ip4 = network
+		} else if ip.To4() == nil && ip6 == "" {
+			ip6 = network
+		} else {
+			return "", "", fmt.Errorf("More than one network of the same IP family")
+		}
+	}
+
+	if ip4 == "" && ip6 == "" {
+		return "", "", fmt.Errorf("Networks %q don't include an IPv4 or an IPv6 address", networks)
+	}
+
+	return ip4, ip6, nil
+}
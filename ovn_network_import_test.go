@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportTopologyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		excludeIPs   string // exclude_ips of the internal switch, as set up by hand or by other tools.
+		wantReserved []string
+	}{
+		{
+			name:       "router address only",
+			excludeIPs: "10.0.0.1",
+		},
+		{
+			name:         "reserved range",
+			excludeIPs:   "10.0.0.1 10.0.0.5..10.0.0.9",
+			wantReserved: []string{"10.0.0.5-10.0.0.9"},
+		},
+		{
+			name:         "reserved range covering the router address",
+			excludeIPs:   "10.0.0.1..10.0.0.10",
+			wantReserved: []string{"10.0.0.1-10.0.0.10"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			err := createProjectNetwork("p", testNetwork("n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = addInstancePort("p", testNetwork("n"), "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			internalSwitch, _ := nb.GetLogicalSwitch("p-n-ls-int")
+			internalSwitch.OtherConfig["exclude_ips"] = tt.excludeIPs
+			err = nb.Update(internalSwitch, "other_config")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			imported, err := importTopology("")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(imported.Projects) != 1 || len(imported.Projects[0].Networks) != 1 {
+				t.Fatalf("Unexpected imported projects %+v", imported.Projects)
+			}
+
+			got := imported.Projects[0].Networks[0]
+			if got.Name != "n" || got.Gateway4 != "10.0.0.1/24" || len(got.Instances) != 1 || got.Instances[0].Name != "c1" {
+				t.Errorf("Unexpected imported network %+v", got)
+			}
+
+			reserved := got.ReservedIPs
+			if strings.Join(reserved, " ") != strings.Join(tt.wantReserved, " ") {
+				t.Errorf("Expected reserved_ips %v, got %v", tt.wantReserved, reserved)
+			}
+
+			// The imported topology is written out and read back in, as by the import mode and a later run.
+			buf := &bytes.Buffer{}
+			err = writeImportedTopology(buf, imported)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !strings.HasPrefix(buf.String(), "# Uplinks are named after their bridge") {
+				t.Errorf("Imported topology doesn't start with the uplinks note")
+			}
+
+			path := filepath.Join(t.TempDir(), "topology.yaml")
+			err = ioutil.WriteFile(path, buf.Bytes(), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			top, err := loadTopology(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			networks, err := top.networks(top.Projects[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Reconciling the imported network makes no changes.
+			requireNoWrites(t, db, func() error { return createProjectNetwork("p", networks[0]) })
+			requireNoDrift(t, "p", networks[0])
+		})
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdlayher/netx/eui64"
+)
+
+// transitSwitchTimeout is how long to wait for ovn-ic to add the transit switches to the NB database.
+const transitSwitchTimeout = 60 * time.Second
+
+// transitIPsInUse maps the transit router port IPv4 addresses allocated so far to the port they were allocated to, so
+// that networks attached in the same run don't get the same address before the first has been committed.
+var transitIPsInUse = map[string]string{}
+
+// getLogicalTransitSwitchRouterPortNames returns the names of the router port connecting a project network's router
+// to its transit switch, and of the switch port on the transit switch. Transit switch ports are seen by every
+// availability zone, so the switch port name includes the availability zone.
+func getLogicalTransitSwitchRouterPortNames(projectName string, network network) (string, string) {
+	return fmt.Sprintf("%s-%s-lrp-ts", projectName, network.name), fmt.Sprintf("%s-%s-lsp-ts-%s", projectName, network.name, network.availabilityZone)
+}
+
+// configureInterconnection sets the availability zone name and the route options that ovn-ic reads from NB_Global,
+// leaving its other options alone. ovn-ic only adds the transit switches once the availability zone is named.
+func configureInterconnection(ic *topologyInterconnection) error {
+	global, err := nb.GetNBGlobal()
+	if err != nil {
+		return err
+	}
+
+	if global == nil {
+		return fmt.Errorf("NB_Global row not found")
+	}
+
+	want := nbCopy(global).(*nbGlobal)
+	want.Name = ic.AvailabilityZone
+	if want.Options == nil {
+		want.Options = map[string]string{}
+	}
+
+	for key, value := range map[string]bool{
+		"ic-route-adv":           ic.RouteAdvertise,
+		"ic-route-adv-default":   ic.RouteAdvertiseDefault,
+		"ic-route-learn":         ic.RouteLearn,
+		"ic-route-learn-default": ic.RouteLearnDefault,
+	} {
+		want.Options[key] = strconv.FormatBool(value)
+	}
+
+	changed, err := nbDiffColumns(global, want, "name", "options")
+	if err != nil {
+		return err
+	}
+
+	return nb.Update(want, changed...)
+}
+
+// getTransitSwitch returns the transit switch with the given name, as added to the NB database by ovn-ic. In dry-run
+// mode a placeholder is returned if ovn-ic hasn't added it yet.
+func getTransitSwitch(name string) (*nbLogicalSwitch, error) {
+	transitSwitch, err := nb.GetLogicalSwitch(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if transitSwitch != nil && transitSwitch.OtherConfig["interconn-ts"] == name {
+		return transitSwitch, nil
+	}
+
+	if dryRun {
+		return &nbLogicalSwitch{UUID: dryRunUUID("logical_switch", name), Name: name}, nil
+	}
+
+	return nil, fmt.Errorf("Transit switch %q not found", name)
+}
+
+// waitTransitSwitches waits for ovn-ic to add the topology's transit switches to the NB database. They must have been
+// created in the interconnection NB database. In dry-run mode NB_Global hasn't been changed, so there is no point
+// waiting.
+func waitTransitSwitches(ic *topologyInterconnection) error {
+	if dryRun {
+		return nil
+	}
+
+	deadline := time.Now().Add(transitSwitchTimeout)
+	for _, ts := range ic.TransitSwitches {
+		for {
+			transitSwitch, err := nb.GetLogicalSwitch(ts.Name)
+			if err != nil {
+				return err
+			}
+
+			if transitSwitch != nil && transitSwitch.OtherConfig["interconn-ts"] == ts.Name {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("Transit switch %q not found after %s (is ovn-ic running and does the switch exist in the interconnection NB database?)", ts.Name, transitSwitchTimeout)
+			}
+
+			time.Sleep(time.Second)
+		}
+	}
+
+	return nil
+}
+
+// createLogicalRouterTransitPort attaches a project network's router to its transit switch, through a router port
+// assigned to the HA chassis group like the external router port. A router that is no longer attached to a transit
+// switch, or is attached to a different one, is detached from the old one. The transit switch the router port is
+// attached to is recorded in its external_ids, so that it can be detached later.
+func createLogicalRouterTransitPort(projectName string, network network) error {
+	router, err := getExistingLogicalRouter(getLogicalRouterName(projectName, network))
+	if err != nil {
+		return err
+	}
+
+	transitRouterPortName, transitSwitchPortName := getLogicalTransitSwitchRouterPortNames(projectName, network)
+	transitRouterPort, err := nb.GetLogicalRouterPort(transitRouterPortName)
+	if err != nil {
+		return err
+	}
+
+	if transitRouterPort != nil && transitRouterPort.ExternalIDs["lxd_transit_switch"] != network.transitSwitch {
+		err = removeTransitSwitchPorts(transitRouterPort.ExternalIDs["lxd_transit_switch"], transitRouterPortName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if network.transitSwitch == "" {
+		if transitRouterPort == nil {
+			return nil
+		}
+
+		return nb.DeleteLogicalRouterPort(router, transitRouterPort)
+	}
+
+	transitSwitch, err := getTransitSwitch(network.transitSwitch)
+	if err != nil {
+		return err
+	}
+
+	// The MAC address is derived from the switch port name, which is unique across the availability zones.
+	mac := ""
+	if transitRouterPort != nil {
+		mac = transitRouterPort.MAC
+	} else {
+		mac, err = networkStableMAC(transitSwitchPortName)
+		if err != nil {
+			return err
+		}
+	}
+
+	networks, err := allocateTransitAddresses(transitSwitch, transitRouterPortName, network, transitRouterPort, mac)
+	if err != nil {
+		return err
+	}
+
+	chassisGroupID, err := getHAChassisGroupID()
+	if err != nil {
+		return err
+	}
+
+	err = ensureLogicalRouterPort(router, transitRouterPort, &nbLogicalRouterPort{
+		Name:           transitRouterPortName,
+		MAC:            mac,
+		Networks:       networks,
+		HaChassisGroup: &chassisGroupID,
+		ExternalIDs:    map[string]string{"lxd_transit_switch": network.transitSwitch},
+	}, "mac", "networks", "ha_chassis_group", "external_ids")
+	if err != nil {
+		return err
+	}
+
+	// Remove the switch ports of the network named after an earlier availability zone name, which point at the same
+	// router port. The ports of other availability zones are of type remote and belong to ovn-ic.
+	ports, err := nb.GetLogicalSwitchPorts(transitSwitch)
+	if err != nil {
+		return err
+	}
+
+	stalePrefix := fmt.Sprintf("%s-%s-lsp-ts-", projectName, network.name)
+	for i := range ports {
+		if ports[i].Type != "router" || ports[i].Name == transitSwitchPortName || !strings.HasPrefix(ports[i].Name, stalePrefix) {
+			continue
+		}
+
+		err = nb.DeleteLogicalSwitchPort(transitSwitch, &ports[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return ensureLogicalSwitchPort(transitSwitch, &nbLogicalSwitchPort{
+		Name:      transitSwitchPortName,
+		Type:      "router",
+		Addresses: []string{"router"},
+		Options:   map[string]string{"router-port": transitRouterPortName},
+	})
+}
+
+// allocateTransitAddresses returns the networks of a transit router port. The IPv4 address of the existing port is
+// kept if it is still in the transit switch's subnet and no other port uses it. Otherwise the search for an address
+// that no port on the transit switch uses starts from one derived from the availability zone and port name, so that
+// availability zones attaching routers before ovn-ic has added each other's ports are unlikely to pick the same
+// address. Once added, the ports of other availability zones are on the transit switch as remote ports, so their
+// addresses are avoided. The IPv6 address is derived from the MAC address, which is unique on the transit switch.
+func allocateTransitAddresses(transitSwitch *nbLogicalSwitch, portName string, network network, port *nbLogicalRouterPort, mac string) ([]string, error) {
+	networks := []string{}
+
+	if network.transitNet4 != "" {
+		_, subnet, err := net.ParseCIDR(network.transitNet4)
+		if err != nil {
+			return nil, err
+		}
+
+		used, err := getTransitIPsInUse(transitSwitch, portName)
+		if err != nil {
+			return nil, err
+		}
+
+		prefixLen, _ := subnet.Mask.Size()
+		free := func(ip net.IP) bool {
+			owner, found := transitIPsInUse[ip.String()]
+			return subnet.Contains(ip) && !used[ip.String()] && (!found || owner == portName)
+		}
+
+		ip4 := net.IP(nil)
+		if port != nil {
+			for _, cidr := range port.Networks {
+				ip, _, err := net.ParseCIDR(cidr)
+				if err == nil && ip.To4() != nil && free(ip) {
+					ip4 = ip.To4()
+				}
+			}
+		}
+
+		// The host addresses are tried in turn starting from one derived from the availability zone and the port
+		// name, skipping the network and broadcast addresses.
+		if ip4 == nil {
+			ones, bits := subnet.Mask.Size()
+			hosts := big.NewInt(0).Lsh(big.NewInt(1), uint(bits-ones))
+			hosts.Sub(hosts, big.NewInt(2))
+
+			hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s", network.availabilityZone, portName)))
+			start := big.NewInt(0).Mod(big.NewInt(0).SetBytes(hash[:]), hosts)
+			base := big.NewInt(0).SetBytes(subnet.IP)
+
+			for i := big.NewInt(0); i.Cmp(hosts) < 0; i.Add(i, big.NewInt(1)) {
+				host := big.NewInt(0).Add(start, i)
+				host.Mod(host, hosts)
+				host.Add(host, big.NewInt(1))
+
+				ip := make(net.IP, len(subnet.IP))
+				host.Add(host, base).FillBytes(ip)
+				if free(ip) {
+					ip4 = ip
+					break
+				}
+			}
+		}
+
+		if ip4 == nil {
+			return nil, fmt.Errorf("No free address in transit switch %q subnet %q", transitSwitch.Name, subnet.String())
+		}
+
+		transitIPsInUse[ip4.String()] = portName
+		networks = append(networks, fmt.Sprintf("%s/%d", ip4.String(), prefixLen))
+	}
+
+	if network.transitNet6 != "" {
+		_, subnet, err := net.ParseCIDR(network.transitNet6)
+		if err != nil {
+			return nil, err
+		}
+
+		hwAddr, err := net.ParseMAC(mac)
+		if err != nil {
+			return nil, err
+		}
+
+		ip6, err := eui64.ParseMAC(subnet.IP, hwAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, (&net.IPNet{IP: ip6, Mask: subnet.Mask}).String())
+	}
+
+	return networks, nil
+}
+
+// getTransitIPsInUse returns the addresses of the ports on a transit switch, other than those of the named router
+// port. The switch ports of router ports in this availability zone have the "router" address, so their addresses are
+// taken from the router port. Remote ports list their MAC address followed by their addresses.
+func getTransitIPsInUse(transitSwitch *nbLogicalSwitch, portName string) (map[string]bool, error) {
+	used := map[string]bool{}
+
+	// The dry-run placeholder for a transit switch that doesn't exist yet has no ports.
+	if len(transitSwitch.Ports) == 0 {
+		return used, nil
+	}
+
+	ports, err := nb.GetLogicalSwitchPorts(transitSwitch)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, port := range ports {
+		addresses := []string{}
+		if port.Type == "router" {
+			if port.Options["router-port"] == portName {
+				continue
+			}
+
+			routerPort, err := nb.GetLogicalRouterPort(port.Options["router-port"])
+			if err != nil {
+				return nil, err
+			}
+
+			if routerPort != nil {
+				addresses = routerPort.Networks
+			}
+		} else {
+			for _, address := range port.Addresses {
+				fields := strings.Fields(address)
+				if len(fields) > 1 {
+					addresses = append(addresses, fields[1:]...)
+				}
+			}
+		}
+
+		for _, address := range addresses {
+			ip, _, err := net.ParseCIDR(address)
+			if err != nil {
+				ip = net.ParseIP(address)
+			}
+
+			if ip != nil {
+				used[ip.String()] = true
+			}
+		}
+	}
+
+	return used, nil
+}
+
+// removeTransitSwitchPorts removes the switch ports that connect the named router port to a transit switch, if the
+// transit switch exists.
+func removeTransitSwitchPorts(switchName string, routerPortName string) error {
+	if switchName == "" {
+		return nil
+	}
+
+	transitSwitch, err := nb.GetLogicalSwitch(switchName)
+	if err != nil || transitSwitch == nil {
+		return err
+	}
+
+	ports, err := nb.GetLogicalSwitchPorts(transitSwitch)
+	if err != nil {
+		return err
+	}
+
+	for i := range ports {
+		if ports[i].Type != "router" || ports[i].Options["router-port"] != routerPortName {
+			continue
+		}
+
+		err = nb.DeleteLogicalSwitchPort(transitSwitch, &ports[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// detachTransitSwitch removes the switch port on the transit switch that a project network's router is attached to,
+// if it is attached to one. The router port is left for the router to be deleted with.
+func detachTransitSwitch(projectName string, network network) error {
+	transitRouterPortName, _ := getLogicalTransitSwitchRouterPortNames(projectName, network)
+	transitRouterPort, err := nb.GetLogicalRouterPort(transitRouterPortName)
+	if err != nil || transitRouterPort == nil {
+		return err
+	}
+
+	return removeTransitSwitchPorts(transitRouterPort.ExternalIDs["lxd_transit_switch"], transitRouterPortName)
+}
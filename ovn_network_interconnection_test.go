@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// testTransitNetwork returns a network attached to transit switch "ts1" in availability zone az.
+func testTransitNetwork(name string, az string) network {
+	n := testNetwork(name)
+	n.transitSwitch = "ts1"
+	n.transitNet4 = "169.254.100.0/24"
+	n.transitNet6 = "fd10::/64"
+	n.availabilityZone = az
+
+	return n
+}
+
+// createTestTransitSwitch adds transit switch "ts1" with a remote port for each of the given addresses, as ovn-ic
+// does.
+func createTestTransitSwitch(t *testing.T, remoteIPs ...string) *nbLogicalSwitch {
+	t.Helper()
+
+	transitSwitch := &nbLogicalSwitch{Name: "ts1", OtherConfig: map[string]string{"interconn-ts": "ts1"}}
+	err := nb.CreateLogicalSwitch(transitSwitch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ip := range remoteIPs {
+		err = nb.CreateLogicalSwitchPort(transitSwitch, &nbLogicalSwitchPort{
+			Name:      "remote-" + ip,
+			Type:      "remote",
+			Addresses: []string{fmt.Sprintf("00:16:3e:00:00:%02x %s/24", i+1, ip)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transitSwitch, err = nb.GetLogicalSwitch("ts1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return transitSwitch
+}
+
+// testTransitIP4 returns the IPv4 address allocated to a transit router port when no other port is in the way.
+func testTransitIP4(t *testing.T, portName string, network network) string {
+	t.Helper()
+
+	oldTransitIPsInUse := transitIPsInUse
+	transitIPsInUse = map[string]string{}
+	defer func() { transitIPsInUse = oldTransitIPsInUse }()
+
+	networks, err := allocateTransitAddresses(&nbLogicalSwitch{Name: "ts1"}, portName, network, nil, "00:16:3e:aa:bb:cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return networks[0]
+}
+
+func TestAllocateTransitAddresses(t *testing.T) {
+	n := testTransitNetwork("n", "az1")
+
+	tests := []struct {
+		name      string
+		network   network
+		remoteIPs []string // Addresses of the ports of other availability zones. "start" is the first one tried.
+		existing  []string // Networks of the existing transit router port.
+		want4     string   // Expected IPv4 network, or "start" for the first one tried.
+		notWant4  string
+		wantErr   bool
+	}{
+		{
+			name:    "new port",
+			network: n,
+			want4:   "start",
+		},
+		{
+			name:      "start address used by another availability zone",
+			network:   n,
+			remoteIPs: []string{"start"},
+			notWant4:  "start",
+		},
+		{
+			name:     "existing address kept",
+			network:  n,
+			existing: []string{"169.254.100.7/24", "fd10::216:3eff:feaa:bbcc/64"},
+			want4:    "169.254.100.7/24",
+		},
+		{
+			name:      "existing address used by another availability zone",
+			network:   n,
+			remoteIPs: []string{"169.254.100.7"},
+			existing:  []string{"169.254.100.7/24"},
+			notWant4:  "169.254.100.7/24",
+		},
+		{
+			name: "subnet exhausted",
+			network: func() network {
+				n := testTransitNetwork("n", "az1")
+				n.transitNet4 = "169.254.100.0/30"
+				return n
+			}(),
+			remoteIPs: []string{"169.254.100.1", "169.254.100.2"},
+			wantErr:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestNB(t)
+			start := testTransitIP4(t, "p-n-lrp-ts", tt.network)
+			startIP := strings.Split(start, "/")[0]
+
+			remoteIPs := []string{}
+			for _, ip := range tt.remoteIPs {
+				if ip == "start" {
+					ip = startIP
+				}
+
+				remoteIPs = append(remoteIPs, ip)
+			}
+
+			transitSwitch := createTestTransitSwitch(t, remoteIPs...)
+
+			var port *nbLogicalRouterPort
+			if tt.existing != nil {
+				port = &nbLogicalRouterPort{Name: "p-n-lrp-ts", Networks: tt.existing}
+			}
+
+			networks, err := allocateTransitAddresses(transitSwitch, "p-n-lrp-ts", tt.network, port, "00:16:3e:aa:bb:cc")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %v", networks)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(networks) != 2 || networks[1] != "fd10::216:3eff:feaa:bbcc/64" {
+				t.Fatalf("Unexpected networks %v", networks)
+			}
+
+			want4, notWant4 := tt.want4, tt.notWant4
+			if want4 == "start" {
+				want4 = start
+			}
+
+			if notWant4 == "start" {
+				notWant4 = start
+			}
+
+			if want4 != "" && networks[0] != want4 {
+				t.Errorf("Expected %q, got %q", want4, networks[0])
+			}
+
+			if notWant4 != "" && networks[0] == notWant4 {
+				t.Errorf("Got address %q used by another port", networks[0])
+			}
+
+			for _, ip := range remoteIPs {
+				if networks[0] == ip+"/24" {
+					t.Errorf("Got address %q of a remote port", networks[0])
+				}
+			}
+		})
+	}
+}
+
+func TestAllocateTransitAddressesAcrossAvailabilityZones(t *testing.T) {
+	setupTestNB(t)
+
+	// Availability zones attaching the same project network before ovn-ic has added each other's ports get different
+	// addresses, as do networks in the same availability zone.
+	seen := map[string]string{}
+	for _, az := range []string{"az1", "az2", "az3"} {
+		for _, name := range []string{"a", "b", "c"} {
+			ip := testTransitIP4(t, "p-"+name+"-lrp-ts", testTransitNetwork(name, az))
+
+			other, found := seen[ip]
+			if found {
+				t.Errorf("%s %s got address %q of %s", az, name, ip, other)
+			}
+
+			seen[ip] = az + " " + name
+		}
+	}
+
+	// An address allocated earlier in the same run isn't kept by another port, even before it is committed.
+	transitIPsInUse = map[string]string{}
+	first, err := allocateTransitAddresses(&nbLogicalSwitch{Name: "ts1"}, "p-a-lrp-ts", testTransitNetwork("a", "az1"), nil, "00:16:3e:aa:bb:cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port := &nbLogicalRouterPort{Name: "p-b-lrp-ts", Networks: []string{first[0]}}
+	second, err := allocateTransitAddresses(&nbLogicalSwitch{Name: "ts1"}, "p-b-lrp-ts", testTransitNetwork("b", "az1"), port, "00:16:3e:aa:bb:cd")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first[0] == second[0] {
+		t.Errorf("Both ports got %q", first[0])
+	}
+}
+
+func TestCreateLogicalRouterTransitPort(t *testing.T) {
+	db, _ := setupTestNB(t)
+	createTestTransitSwitch(t, "169.254.100.1")
+
+	n := testTransitNetwork("n", "az1")
+	err := createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	routerPort, err := nb.GetLogicalRouterPort("p-n-lrp-ts")
+	if err != nil || routerPort == nil {
+		t.Fatalf("Transit router port not found: %v", err)
+	}
+
+	if routerPort.ExternalIDs["lxd_transit_switch"] != "ts1" || routerPort.HaChassisGroup == nil {
+		t.Errorf("Unexpected transit router port %+v", routerPort)
+	}
+
+	switchPort, err := nb.GetLogicalSwitchPort("p-n-lsp-ts-az1")
+	if err != nil || switchPort == nil || switchPort.Options["router-port"] != "p-n-lrp-ts" {
+		t.Fatalf("Transit switch port not found: %v", err)
+	}
+
+	// Reconciling again, as on a later run, makes no changes.
+	macsInUse = nil
+	transitIPsInUse = map[string]string{}
+	requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+	requireNoDrift(t, "p", n)
+
+	// Detaching the network removes both ports.
+	n.transitSwitch = ""
+	n.transitNet4 = ""
+	n.transitNet6 = ""
+	err = createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"p-n-lrp-ts", "p-n-lsp-ts-az1"} {
+		routerPort, _ := nb.GetLogicalRouterPort(name)
+		switchPort, _ := nb.GetLogicalSwitchPort(name)
+		if routerPort != nil || switchPort != nil {
+			t.Errorf("Port %q not removed", name)
+		}
+	}
+}
+
+func TestTransitAvailabilityZoneRename(t *testing.T) {
+	setupTestNB(t)
+	transitSwitch := createTestTransitSwitch(t)
+
+	// The same network in another availability zone, whose port ovn-ic added as a remote one.
+	err := nb.CreateLogicalSwitchPort(transitSwitch, &nbLogicalSwitchPort{Name: "p-n-lsp-ts-az2", Type: "remote", Addresses: []string{"00:16:3e:00:00:01 169.254.100.1/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := testTransitNetwork("n", "az1")
+	err = createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Renaming the availability zone replaces the switch port named after the old name.
+	n.availabilityZone = "az3"
+	err = createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transitSwitch, _ = nb.GetLogicalSwitch("ts1")
+	ports, err := nb.GetLogicalSwitchPorts(transitSwitch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := []string{}
+	for _, port := range ports {
+		names = append(names, port.Name)
+	}
+
+	if strings.Join(names, " ") != "p-n-lsp-ts-az2 p-n-lsp-ts-az3" {
+		t.Errorf("Unexpected transit switch ports %v", names)
+	}
+
+	requireNoDrift(t, "p", n)
+}
+
+func TestConnectOVStoOVNInterconnection(t *testing.T) {
+	for _, interconn := range []bool{false, true} {
+		_, host := setupTestNB(t)
+		host.outputs["ip route get 8.8.8.8"] = "8.8.8.8 via 10.0.0.1 dev eth0 src 10.0.0.5 uid 0"
+		host.outputs["ovs-vsctl get open_vswitch . external_ids:system-id"] = `"chassis1"`
+
+		err := connectOVStoOVN(interconn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !host.ran("ovs-vsctl set open_vswitch . external_ids:ovn-remote=") {
+			t.Fatalf("OVS not connected to OVN: %v", host.commands)
+		}
+
+		if strings.Contains(strings.Join(host.commands, "\n"), "ovn-is-interconn") != interconn {
+			t.Errorf("Unexpected ovn-is-interconn setting with interconnection %t: %v", interconn, host.commands)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+)
+
+// subnetPoolExternalID returns the logical router external_ids key that records the internal subnet of the given
+// IP family allocated to a project network.
+func subnetPoolExternalID(family string) string {
+	return fmt.Sprintf("lxd_%s_subnet", family)
+}
+
+// subnetPool hands out non-overlapping internal subnets to project networks that don't have their gateways set in the
+// topology. Allocations are recorded in the external_ids of the project network's logical router, so a network keeps
+// its subnets across runs and the subnets are freed when the router is deleted.
+type subnetPool struct {
+	pools map[string]*net.IPNet // Pool by IP family.
+	sizes map[string]int        // Prefix length of the subnets allocated from each pool.
+
+	// used holds the subnets that allocations must not overlap: the subnets the topology sets explicitly, those
+	// allocated so far in this run and, once loaded, those in use in the NB database.
+	used     []*net.IPNet
+	usedInNB bool
+}
+
+// newSubnetPool returns a subnetPool for the topology, or nil if the topology doesn't define one.
+func newSubnetPool(t *topology) (*subnetPool, error) {
+	if t.SubnetPool == nil {
+		return nil, nil
+	}
+
+	p := &subnetPool{pools: map[string]*net.IPNet{}, sizes: map[string]int{}}
+	for _, pool := range []struct {
+		family string
+		cidr   string
+		size   int
+	}{
+		{"ipv4", t.SubnetPool.IPv4, t.SubnetPool.IPv4SubnetSize},
+		{"ipv6", t.SubnetPool.IPv6, t.SubnetPool.IPv6SubnetSize},
+	} {
+		if pool.cidr == "" {
+			continue
+		}
+
+		_, poolNet, err := net.ParseCIDR(pool.cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		p.pools[pool.family] = poolNet
+		p.sizes[pool.family] = pool.size
+	}
+
+	for _, project := range t.Projects {
+		for _, n := range project.Networks {
+			for _, gw := range []string{n.Gateway4, n.Gateway6} {
+				if gw == "" {
+					continue
+				}
+
+				_, subnet, err := net.ParseCIDR(gw)
+				if err != nil {
+					return nil, err
+				}
+
+				p.used = append(p.used, subnet)
+			}
+		}
+	}
+
+	// Allocations must not overlap the subnets of the transit switches either.
+	if t.Interconnection != nil {
+		for _, ts := range t.Interconnection.TransitSwitches {
+			for _, cidr := range []string{ts.IPv4, ts.IPv6} {
+				if cidr == "" {
+					continue
+				}
+
+				_, subnet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, err
+				}
+
+				p.used = append(p.used, subnet)
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// loadUsed adds the subnets of every logical router port, and the subnets recorded as allocated to every logical
+// router, to the subnets that allocations must not overlap.
+func (p *subnetPool) loadUsed() error {
+	if p.usedInNB {
+		return nil
+	}
+
+	routers, err := nb.GetLogicalRouters()
+	if err != nil {
+		return err
+	}
+
+	cidrs := []string{}
+	for i := range routers {
+		for _, family := range []string{"ipv4", "ipv6"} {
+			cidr := routers[i].ExternalIDs[subnetPoolExternalID(family)]
+			if cidr != "" {
+				cidrs = append(cidrs, cidr)
+			}
+		}
+
+		ports, err := nb.GetLogicalRouterPorts(&routers[i])
+		if err != nil {
+			return err
+		}
+
+		for _, port := range ports {
+			cidrs = append(cidrs, port.Networks...)
+		}
+	}
+
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+
+		p.used = append(p.used, subnet)
+	}
+
+	p.usedInNB = true
+
+	return nil
+}
+
+// allocate sets the gateways of a project network that the topology leaves unset, for the IP families the network
+// has. A network that already has subnets recorded on its logical router keeps them, otherwise the first free
+// subnets in the pool are used. The gateway is the first usable address of the subnet.
+func (p *subnetPool) allocate(projectName string, network network) (network, error) {
+	if (network.gw4 != "" || !network.ipv4) && (network.gw6 != "" || !network.ipv6) {
+		return network, nil
+	}
+
+	router, err := nb.GetLogicalRouter(getLogicalRouterName(projectName, network))
+	if err != nil {
+		return network, err
+	}
+
+	network.subnets = map[string]string{}
+	for _, gw := range []struct {
+		family string
+		value  *string
+		wanted bool
+	}{
+		{"ipv4", &network.gw4, network.ipv4},
+		{"ipv6", &network.gw6, network.ipv6},
+	} {
+		if *gw.value != "" || !gw.wanted {
+			continue
+		}
+
+		var subnet *net.IPNet
+		if router != nil && router.ExternalIDs[subnetPoolExternalID(gw.family)] != "" {
+			_, subnet, err = net.ParseCIDR(router.ExternalIDs[subnetPoolExternalID(gw.family)])
+			if err != nil {
+				return network, fmt.Errorf("Invalid subnet recorded on logical router %q: %w", router.Name, err)
+			}
+		} else {
+			subnet, err = p.next(gw.family)
+			if err != nil {
+				return network, fmt.Errorf("Failed allocating %s subnet for project %q network %q: %w", gw.family, projectName, network.name, err)
+			}
+		}
+
+		p.used = append(p.used, subnet)
+		network.subnets[subnetPoolExternalID(gw.family)] = subnet.String()
+
+		gateway := big.NewInt(0).SetBytes(subnet.IP)
+		gateway.Add(gateway, big.NewInt(1))
+		gatewayNet := net.IPNet{IP: make(net.IP, len(subnet.IP)), Mask: subnet.Mask}
+		gateway.FillBytes(gatewayNet.IP)
+
+		*gw.value = gatewayNet.String()
+	}
+
+	return network, nil
+}
+
+// next returns the first subnet in the pool of the given IP family that doesn't overlap any used subnet.
+func (p *subnetPool) next(family string) (*net.IPNet, error) {
+	pool := p.pools[family]
+	if pool == nil {
+		return nil, fmt.Errorf("No %s subnet pool defined", family)
+	}
+
+	err := p.loadUsed()
+	if err != nil {
+		return nil, err
+	}
+
+	poolSize, bits := pool.Mask.Size()
+	size := p.sizes[family]
+	mask := net.CIDRMask(size, bits)
+
+	base := big.NewInt(0).SetBytes(pool.IP)
+	step := big.NewInt(0).Lsh(big.NewInt(1), uint(bits-size))
+	count := big.NewInt(0).Lsh(big.NewInt(1), uint(size-poolSize))
+
+	for i := big.NewInt(0); i.Cmp(count) < 0; i.Add(i, big.NewInt(1)) {
+		ip := make(net.IP, len(pool.IP))
+		big.NewInt(0).Add(base, big.NewInt(0).Mul(i, step)).FillBytes(ip)
+		candidate := &net.IPNet{IP: ip, Mask: mask}
+
+		free := true
+		for _, used := range p.used {
+			if used.Contains(candidate.IP) || candidate.Contains(used.IP) {
+				free = false
+				break
+			}
+		}
+
+		if free {
+			return candidate, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Subnet pool %q is exhausted", pool.String())
+}
+
+// parseIPRange parses a range of addresses of the form FIRST-LAST, where both addresses are of the same IP family.
+func parseIPRange(value string) (net.IP, net.IP, error) {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("Invalid IP range %q (must be of the form FIRST-LAST)", value)
+	}
+
+	first := net.ParseIP(strings.TrimSpace(parts[0]))
+	last := net.ParseIP(strings.TrimSpace(parts[1]))
+	if first == nil || last == nil || (first.To4() == nil) != (last.To4() == nil) {
+		return nil, nil, fmt.Errorf("Invalid IP range %q", value)
+	}
+
+	if bytes.Compare(first.To16(), last.To16()) > 0 {
+		return nil, nil, fmt.Errorf("Invalid IP range %q (first address is after last address)", value)
+	}
+
+	return first, last, nil
+}
+
+// externalIPsInUse maps the external IPv4 addresses that can't be allocated to the router using them. It holds the
+// addresses set in the topology and those allocated so far, and the addresses in the NB database once loaded.
+var externalIPsInUse = map[string]string{}
+
+// externalIPsLoaded is whether the external IPv4 addresses in the NB database have been added to externalIPsInUse.
+var externalIPsLoaded bool
+
+// reserveExternalIPs stops the external IPv4 addresses set in the topology being allocated to other networks.
+func reserveExternalIPs(t *topology) error {
+	for _, project := range t.Projects {
+		networks, err := t.networks(project)
+		if err != nil {
+			return err
+		}
+
+		for _, n := range networks {
+			if n.extIP4 == "" {
+				continue
+			}
+
+			ip, _, err := net.ParseCIDR(n.extIP4)
+			if err != nil {
+				return err
+			}
+
+			externalIPsInUse[ip.String()] = getLogicalRouterName(project.Name, n)
+		}
+	}
+
+	return nil
+}
+
+// loadExternalIPsInUse adds the NAT external addresses and the router port addresses of every logical router to
+// externalIPsInUse.
+func loadExternalIPsInUse() error {
+	routers, err := nb.GetLogicalRouters()
+	if err != nil {
+		return err
+	}
+
+	for i := range routers {
+		nats, err := nb.GetLogicalRouterNATs(&routers[i])
+		if err != nil {
+			return err
+		}
+
+		for _, nat := range nats {
+			externalIPsInUse[net.ParseIP(nat.ExternalIP).String()] = routers[i].Name
+		}
+
+		ports, err := nb.GetLogicalRouterPorts(&routers[i])
+		if err != nil {
+			return err
+		}
+
+		for _, port := range ports {
+			for _, cidr := range port.Networks {
+				ip, _, err := net.ParseCIDR(cidr)
+				if err == nil {
+					externalIPsInUse[ip.String()] = routers[i].Name
+				}
+			}
+		}
+	}
+
+	externalIPsLoaded = true
+
+	return nil
+}
+
+// allocateExternalIP4 returns the external IPv4 address (in CIDR notation) for the router of a project network that
+// doesn't set one. The address of an existing external router port is kept if it is in the uplink's range, otherwise
+// the first address in the range that no other router uses for a port or NAT rule is taken.
+func allocateExternalIP4(routerName string, network network, externalRouterPort *nbLogicalRouterPort) (string, error) {
+	first, last, err := parseIPRange(network.extIP4Range)
+	if err != nil {
+		return "", err
+	}
+
+	_, subnet, err := net.ParseCIDR(network.extIP4Subnet)
+	if err != nil {
+		return "", err
+	}
+
+	prefixLen, _ := subnet.Mask.Size()
+	inRange := func(ip net.IP) bool {
+		return bytes.Compare(ip.To16(), first.To16()) >= 0 && bytes.Compare(ip.To16(), last.To16()) <= 0
+	}
+
+	if externalRouterPort != nil {
+		for _, cidr := range externalRouterPort.Networks {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err == nil && ip.To4() != nil && inRange(ip) {
+				externalIPsInUse[ip.String()] = routerName
+				return fmt.Sprintf("%s/%d", ip.String(), prefixLen), nil
+			}
+		}
+	}
+
+	if !externalIPsLoaded {
+		err = loadExternalIPsInUse()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	gateway := net.ParseIP(network.extGW4)
+	broadcast := make(net.IP, len(subnet.IP))
+	for i := range subnet.IP {
+		broadcast[i] = subnet.IP[i] | ^subnet.Mask[i]
+	}
+
+	for ip := first.To4(); inRange(ip); ip = nextIP(ip) {
+		if ip.Equal(subnet.IP) || ip.Equal(broadcast) || ip.Equal(gateway) {
+			continue
+		}
+
+		owner, found := externalIPsInUse[ip.String()]
+		if found && owner != routerName {
+			continue
+		}
+
+		externalIPsInUse[ip.String()] = routerName
+
+		return fmt.Sprintf("%s/%d", ip.String(), prefixLen), nil
+	}
+
+	return "", fmt.Errorf("No free address in uplink range %q", network.extIP4Range)
+}
+
+// nextIP returns the address after ip, or nil if ip is the last address.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			return next
+		}
+	}
+
+	return nil
+}
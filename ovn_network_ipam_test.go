@@ -0,0 +1,339 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// testPoolTopology returns a topology whose subnet pool hands out /24 IPv4 and /64 IPv6 subnets, with project "p"
+// having the given networks.
+func testPoolTopology(networks ...topologyNetwork) *topology {
+	return &topology{
+		SubnetPool: &topologySubnetPool{IPv4: "10.10.0.0/16", IPv4SubnetSize: 24, IPv6: "fd10::/48", IPv6SubnetSize: 64},
+		Projects:   []topologyProject{{Name: "p", Networks: networks}},
+	}
+}
+
+// testPoolNetwork returns a network that leaves its gateways to the subnet pool.
+func testPoolNetwork(name string) network {
+	n := testNetwork(name)
+	n.gw4 = ""
+	n.gw6 = ""
+
+	return n
+}
+
+func TestSubnetPoolAllocate(t *testing.T) {
+	tests := []struct {
+		name     string
+		topology *topology
+		routers  map[string]map[string]string // external_ids of existing logical routers by name.
+		ports    map[string][]string          // Networks of existing logical router ports by router name.
+		wantGW4  string
+		wantGW6  string
+	}{
+		{
+			name:     "new network",
+			topology: testPoolTopology(),
+			wantGW4:  "10.10.0.1/24",
+			wantGW6:  "fd10::1/64",
+		},
+		{
+			name:     "subnets recorded on the network's router",
+			topology: testPoolTopology(),
+			routers:  map[string]map[string]string{"p-n": {"lxd_ipv4_subnet": "10.10.5.0/24", "lxd_ipv6_subnet": "fd10:0:0:5::/64"}},
+			wantGW4:  "10.10.5.1/24",
+			wantGW6:  "fd10:0:0:5::1/64",
+		},
+		{
+			name:     "subnets recorded on another router",
+			topology: testPoolTopology(),
+			routers:  map[string]map[string]string{"p-m": {"lxd_ipv4_subnet": "10.10.0.0/24", "lxd_ipv6_subnet": "fd10::/64"}},
+			wantGW4:  "10.10.1.1/24",
+			wantGW6:  "fd10:0:0:1::1/64",
+		},
+		{
+			name:     "subnet of another router's port",
+			topology: testPoolTopology(),
+			routers:  map[string]map[string]string{"q-n": nil},
+			ports:    map[string][]string{"q-n": {"10.10.0.1/24", "10.10.1.1/24"}},
+			wantGW4:  "10.10.2.1/24",
+			wantGW6:  "fd10::1/64",
+		},
+		{
+			name:     "subnet set in the topology",
+			topology: testPoolTopology(topologyNetwork{Name: "m", Gateway4: "10.10.0.1/23"}),
+			wantGW4:  "10.10.2.1/24",
+			wantGW6:  "fd10::1/64",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestNB(t)
+			for name, externalIDs := range tt.routers {
+				router := &nbLogicalRouter{Name: name, ExternalIDs: externalIDs}
+				err := nb.CreateLogicalRouter(router)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for i, cidr := range tt.ports[name] {
+					err = nb.CreateLogicalRouterPort(router, &nbLogicalRouterPort{Name: fmt.Sprintf("%s-lrp-%d", name, i), Networks: []string{cidr}})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			pool, err := newSubnetPool(tt.topology)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := pool.allocate("p", testPoolNetwork("n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n.gw4 != tt.wantGW4 || n.gw6 != tt.wantGW6 {
+				t.Errorf("Expected gateways %q and %q, got %q and %q", tt.wantGW4, tt.wantGW6, n.gw4, n.gw6)
+			}
+
+			// The subnets are recorded under the router external_ids keys.
+			for family, gw := range map[string]string{"ipv4": tt.wantGW4, "ipv6": tt.wantGW6} {
+				_, subnet, _ := net.ParseCIDR(gw)
+				if n.subnets[subnetPoolExternalID(family)] != subnet.String() {
+					t.Errorf("Unexpected recorded subnets %v", n.subnets)
+				}
+			}
+		})
+	}
+}
+
+func TestSubnetPoolKeptAcrossRuns(t *testing.T) {
+	db, _ := setupTestNB(t)
+
+	pool, err := newSubnetPool(testPoolTopology())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocated := map[string]network{}
+	for _, name := range []string{"a", "b"} {
+		n, err := pool.allocate("p", testPoolNetwork(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = createProjectNetwork("p", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		allocated[name] = n
+	}
+
+	if allocated["a"].gw4 == allocated["b"].gw4 || allocated["a"].gw6 == allocated["b"].gw6 {
+		t.Fatalf("Networks got the same subnets: %q %q", allocated["a"].gw4, allocated["a"].gw6)
+	}
+
+	router, _ := nb.GetLogicalRouter("p-a")
+	if router.ExternalIDs[subnetPoolExternalID("ipv4")] != "10.10.0.0/24" || router.ExternalIDs[subnetPoolExternalID("ipv6")] != "fd10::/64" {
+		t.Errorf("Unexpected router external_ids %v", router.ExternalIDs)
+	}
+
+	// A later run, in which network "a" comes after a new network, allocates the same subnets to "a" and "b" and
+	// changes nothing.
+	pool, err = newSubnetPool(testPoolTopology())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := pool.allocate("p", testPoolNetwork("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.gw4 != "10.10.2.1/24" || c.gw6 != "fd10:0:0:2::1/64" {
+		t.Errorf("New network got gateways %q and %q", c.gw4, c.gw6)
+	}
+
+	for _, name := range []string{"a", "b"} {
+		n, err := pool.allocate("p", testPoolNetwork(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n.gw4 != allocated[name].gw4 || n.gw6 != allocated[name].gw6 {
+			t.Errorf("Network %q moved from %q and %q to %q and %q", name, allocated[name].gw4, allocated[name].gw6, n.gw4, n.gw6)
+		}
+
+		requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+		requireNoDrift(t, "p", n)
+	}
+}
+
+func TestSubnetPoolExhausted(t *testing.T) {
+	setupTestNB(t)
+
+	pool, err := newSubnetPool(&topology{SubnetPool: &topologySubnetPool{IPv4: "10.10.0.0/23", IPv4SubnetSize: 24}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := testPoolNetwork("n")
+	n.ipv6 = false
+	for _, name := range []string{"a", "b"} {
+		n.name = name
+		_, err = pool.allocate("p", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n.name = "c"
+	_, err = pool.allocate("p", n)
+	if err == nil || !strings.Contains(err.Error(), "exhausted") {
+		t.Errorf("Expected the pool to be exhausted, got %v", err)
+	}
+}
+
+func TestAllocateExternalIP4(t *testing.T) {
+	tests := []struct {
+		name     string
+		ipRange  string
+		inUse    map[string]string // Addresses set in the topology or allocated earlier in the run, by router name.
+		natIPs   []string          // External addresses of NAT rules on another router in the NB database.
+		existing []string          // Networks of the router's existing external port.
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:    "first address",
+			ipRange: "192.0.2.10-192.0.2.12",
+			want:    "192.0.2.10/24",
+		},
+		{
+			name:    "network and gateway addresses skipped",
+			ipRange: "192.0.2.0-192.0.2.255",
+			inUse:   map[string]string{"192.0.2.2": "q-n"},
+			want:    "192.0.2.3/24",
+		},
+		{
+			name:    "address used by another router",
+			ipRange: "192.0.2.10-192.0.2.12",
+			inUse:   map[string]string{"192.0.2.10": "q-n"},
+			want:    "192.0.2.11/24",
+		},
+		{
+			name:    "address already allocated to the router",
+			ipRange: "192.0.2.10-192.0.2.12",
+			inUse:   map[string]string{"192.0.2.10": "p-n"},
+			want:    "192.0.2.10/24",
+		},
+		{
+			name:    "NAT address of another router",
+			ipRange: "192.0.2.10-192.0.2.12",
+			natIPs:  []string{"192.0.2.10", "192.0.2.11"},
+			want:    "192.0.2.12/24",
+		},
+		{
+			name:     "existing address kept",
+			ipRange:  "192.0.2.10-192.0.2.12",
+			inUse:    map[string]string{"192.0.2.10": "q-n"},
+			existing: []string{"192.0.2.12/24", "2001:db8::216:3eff:fe00:1/64"},
+			want:     "192.0.2.12/24",
+		},
+		{
+			name:     "existing address outside the range",
+			ipRange:  "192.0.2.10-192.0.2.12",
+			existing: []string{"192.0.2.50/24"},
+			want:     "192.0.2.10/24",
+		},
+		{
+			name:    "range exhausted",
+			ipRange: "192.0.2.10-192.0.2.11",
+			inUse:   map[string]string{"192.0.2.10": "q-n"},
+			natIPs:  []string{"192.0.2.11"},
+			wantErr: true,
+		},
+		{
+			name:    "range of gateway only",
+			ipRange: "192.0.2.1-192.0.2.1",
+			wantErr: true,
+		},
+		{
+			name:    "range of broadcast address only",
+			ipRange: "192.0.2.255-192.0.2.255",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestNB(t)
+			for ip, routerName := range tt.inUse {
+				externalIPsInUse[ip] = routerName
+			}
+
+			if tt.natIPs != nil {
+				router := &nbLogicalRouter{Name: "r"}
+				err := nb.CreateLogicalRouter(router)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				for _, ip := range tt.natIPs {
+					err = nb.CreateNAT(router, &nbNAT{Type: "snat", ExternalIP: ip, LogicalIP: "10.1.0.0/24"})
+					if err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			n := testNetwork("n")
+			n.extIP4 = ""
+			n.extIP4Subnet = "192.0.2.0/24"
+			n.extIP4Range = tt.ipRange
+
+			var port *nbLogicalRouterPort
+			if tt.existing != nil {
+				port = &nbLogicalRouterPort{Name: "p-n-lrp-ext", Networks: tt.existing}
+			}
+
+			got, err := allocateExternalIP4("p-n", n, port)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("Expected an error, got %q", got)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Fatalf("Expected %q, got %q", tt.want, got)
+			}
+
+			// The address is held for the router, so other networks in the same run don't get it.
+			ip, _, _ := net.ParseCIDR(got)
+			if externalIPsInUse[ip.String()] != "p-n" {
+				t.Errorf("Address %q not recorded as in use by the router", got)
+			}
+
+			other := testNetwork("m")
+			other.extIP4Subnet = n.extIP4Subnet
+			other.extIP4Range = n.extIP4Range
+			otherGot, err := allocateExternalIP4("p-m", other, nil)
+			if err == nil && otherGot == got {
+				t.Errorf("Address %q allocated to two routers", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// macSeed is mixed into the hash that port MAC addresses are derived from, so that separate deployments sharing a
+// layer 2 network get different MAC addresses for ports of the same name.
+var macSeed string
+
+// macOUI is the prefix of the MAC addresses generated for ports.
+var macOUI = "00:16:3e"
+
+// macsInUse maps the MAC addresses in the NB database to the ports using them. It is loaded on first use and then
+// kept up to date with the MAC addresses handed out, including those not yet committed.
+var macsInUse map[string]string
+
+// portMACs maps port names to the MAC address they were first found with or handed out, the reverse of macsInUse.
+var portMACs map[string]string
+
+// validateMACOUI checks that oui is the first three octets of a unicast MAC address.
+func validateMACOUI(oui string) error {
+	mac, err := net.ParseMAC(oui + ":00:00:00")
+	if err != nil || len(mac) != 6 {
+		return fmt.Errorf("Invalid MAC OUI %q (must be of the form 00:16:3e)", oui)
+	}
+
+	if mac[0]&0x01 != 0 {
+		return fmt.Errorf("Invalid MAC OUI %q (must not be a multicast prefix)", oui)
+	}
+
+	return nil
+}
+
+// loadMACsInUse fills macsInUse and portMACs with the MAC addresses of every logical router port and logical switch
+// port.
+func loadMACsInUse() error {
+	macs := map[string]string{}
+	ports := map[string]string{}
+
+	// Entries that aren't MAC addresses, such as "router" in the addresses of switch ports, are skipped.
+	use := func(mac string, portName string) {
+		_, err := net.ParseMAC(mac)
+		if err != nil {
+			return
+		}
+
+		mac = strings.ToLower(mac)
+		_, found := macs[mac]
+		if !found {
+			macs[mac] = portName
+		}
+
+		_, found = ports[portName]
+		if !found && macs[mac] == portName {
+			ports[portName] = mac
+		}
+	}
+
+	routers, err := nb.GetLogicalRouters()
+	if err != nil {
+		return err
+	}
+
+	for i := range routers {
+		ports, err := nb.GetLogicalRouterPorts(&routers[i])
+		if err != nil {
+			return err
+		}
+
+		for _, port := range ports {
+			use(port.MAC, port.Name)
+		}
+	}
+
+	switches, err := nb.GetLogicalSwitches()
+	if err != nil {
+		return err
+	}
+
+	for i := range switches {
+		ports, err := nb.GetLogicalSwitchPorts(&switches[i])
+		if err != nil {
+			return err
+		}
+
+		for _, port := range ports {
+			addresses := append([]string{}, port.Addresses...)
+			if port.DynamicAddresses != nil {
+				addresses = append(addresses, *port.DynamicAddresses)
+			}
+
+			// The MAC address is the first field of an address entry.
+			for _, address := range addresses {
+				fields := strings.Fields(address)
+				if len(fields) > 0 {
+					use(fields[0], port.Name)
+				}
+			}
+		}
+	}
+
+	macsInUse = macs
+	portMACs = ports
+
+	return nil
+}
+
+// networkStableMAC returns the MAC address for the named port. A port that already has a MAC address in the NB
+// database keeps it. Otherwise the address is derived from macSeed and the port name, so a port gets the same MAC
+// address every time it is created. If another port already uses the address, the hash is repeated with a counter
+// until a free address is found. The counter only applies to new ports, as the address a port gets from it depends
+// on which ports were created before it.
+func networkStableMAC(portName string) (string, error) {
+	if macsInUse == nil {
+		err := loadMACsInUse()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	mac, found := portMACs[portName]
+	if found && macsInUse[mac] == portName {
+		return mac, nil
+	}
+
+	for i := 0; i < 1000; i++ {
+		hash := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", macSeed, portName, i)))
+		mac := strings.ToLower(fmt.Sprintf("%s:%02x:%02x:%02x", macOUI, hash[0], hash[1], hash[2]))
+
+		owner, found := macsInUse[mac]
+		if found && owner != portName {
+			continue
+		}
+
+		macsInUse[mac] = portName
+		portMACs[portName] = mac
+
+		return mac, nil
+	}
+
+	return "", fmt.Errorf("No free MAC address found for port %q", portName)
+}
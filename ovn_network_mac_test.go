@@ -0,0 +1,150 @@
+package main
+
+import (
+	"testing"
+)
+
+// testHashMAC returns the MAC address the hash gives a port when no other port is in the way.
+func testHashMAC(t *testing.T, portName string) string {
+	t.Helper()
+
+	oldMACsInUse, oldPortMACs := macsInUse, portMACs
+	macsInUse, portMACs = map[string]string{}, map[string]string{}
+	defer func() { macsInUse, portMACs = oldMACsInUse, oldPortMACs }()
+
+	mac, err := networkStableMAC(portName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return mac
+}
+
+func TestNetworkStableMAC(t *testing.T) {
+	tests := []struct {
+		name string
+
+		// ports maps the names of the switch ports in the NB database to their MAC addresses. An empty address
+		// stands for the hash MAC address of port "b".
+		ports map[string]string
+
+		want       string // Expected MAC address of port "b", or empty for its hash MAC address.
+		wantNoHash bool   // Whether port "b" must not get its hash MAC address.
+	}{
+		{
+			name: "new port",
+		},
+		{
+			name:       "collision with another port",
+			ports:      map[string]string{"a": ""},
+			wantNoHash: true,
+		},
+		{
+			name:  "existing port keeps its address",
+			ports: map[string]string{"b": "00:16:3e:12:34:56"},
+			want:  "00:16:3e:12:34:56",
+		},
+		{
+			name:  "existing port keeps its address despite a collision",
+			ports: map[string]string{"a": "", "b": "00:16:3e:12:34:56"},
+			want:  "00:16:3e:12:34:56",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestNB(t)
+			hashMAC := testHashMAC(t, "b")
+
+			logicalSwitch := &nbLogicalSwitch{Name: "s"}
+			err := nb.CreateLogicalSwitch(logicalSwitch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for name, mac := range tt.ports {
+				if mac == "" {
+					mac = hashMAC
+				}
+
+				err = nb.CreateLogicalSwitchPort(logicalSwitch, &nbLogicalSwitchPort{Name: name, Addresses: []string{mac + " dynamic"}})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			mac, err := networkStableMAC("b")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.want
+			if want == "" && !tt.wantNoHash {
+				want = hashMAC
+			}
+
+			if want != "" && mac != want {
+				t.Errorf("Expected %q, got %q", want, mac)
+			}
+
+			if tt.wantNoHash && mac == hashMAC {
+				t.Errorf("Got MAC address %q of another port", mac)
+			}
+
+			// The address is stable for the rest of the run and on later runs.
+			again, err := networkStableMAC("b")
+			if err != nil || again != mac {
+				t.Errorf("MAC address changed from %q to %q (%v)", mac, again, err)
+			}
+
+			macsInUse = nil
+			again, err = networkStableMAC("b")
+			if err != nil || again != mac {
+				t.Errorf("MAC address changed from %q to %q after reload (%v)", mac, again, err)
+			}
+		})
+	}
+}
+
+func TestNetworkStableMACKeptAfterCollisionResolves(t *testing.T) {
+	setupTestNB(t)
+
+	logicalSwitch := &nbLogicalSwitch{Name: "s"}
+	err := nb.CreateLogicalSwitch(logicalSwitch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Port "a" holds the hash MAC address of port "b", so "b" is given the next one.
+	a := &nbLogicalSwitchPort{Name: "a", Addresses: []string{testHashMAC(t, "b") + " dynamic"}}
+	err = nb.CreateLogicalSwitchPort(logicalSwitch, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac, err := networkStableMAC("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = nb.CreateLogicalSwitchPort(logicalSwitch, &nbLogicalSwitchPort{Name: "b", Addresses: []string{mac + " dynamic"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Once "a" is gone, "b" keeps the address it has rather than moving to its hash MAC address.
+	err = nb.DeleteLogicalSwitchPort(logicalSwitch, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	macsInUse = nil
+	again, err := networkStableMAC("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again != mac {
+		t.Errorf("MAC address changed from %q to %q", mac, again)
+	}
+}
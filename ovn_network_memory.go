@@ -0,0 +1,521 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// memoryChildren lists the columns of each table that hold its child rows. Child rows are deleted along with their
+// parent, or when they are removed from it, like the non-root tables in the real database.
+var memoryChildren = map[string][]string{
+	"Logical_Router":   {"ports", "static_routes", "nat"},
+	"Logical_Switch":   {"ports"},
+	"HA_Chassis_Group": {"ha_chassis"},
+}
+
+// memoryReferences lists the columns of each table that refer to rows in other tables.
+var memoryReferences = map[string]map[string]string{
+	"Logical_Router_Port": {"ha_chassis_group": "HA_Chassis_Group"},
+	"Logical_Switch_Port": {"dhcpv4_options": "DHCP_Options", "dhcpv6_options": "DHCP_Options"},
+}
+
+// memoryIndexes lists the columns whose values must be unique in each table.
+var memoryIndexes = map[string]string{
+	"Logical_Router_Port": "name",
+	"Logical_Switch_Port": "name",
+	"HA_Chassis_Group":    "name",
+}
+
+// memoryClient is an nbClient that keeps the NB database in memory. It models the relations between routers,
+// switches and their child rows so that provisioning can be exercised without a running OVN. Nothing is ever sent to
+// OVN, so dry-run mode makes no difference to it.
+type memoryClient struct {
+	// rows maps table names to their rows (pointers to NB rows) by UUID.
+	rows map[string]map[string]interface{}
+
+	// snapshot holds the rows as they were when the current transaction was begun.
+	snapshot map[string]map[string]interface{}
+
+	lastUUID int
+}
+
+// newMemoryClient returns a memoryClient with an empty database, apart from the NB_Global row that a real database
+// always has.
+func newMemoryClient() *memoryClient {
+	c := &memoryClient{rows: map[string]map[string]interface{}{}}
+	c.create(&nbGlobal{}, nil, "")
+
+	return c
+}
+
+// uuid returns the UUID of row (a pointer to an NB row).
+func (c *memoryClient) uuid(row interface{}) string {
+	uuid, _ := nbField(row, "_uuid")
+	return uuid.String()
+}
+
+// table returns the rows of the named table sorted by UUID, so that lookups are deterministic.
+func (c *memoryClient) table(name string) []interface{} {
+	uuids := make([]string, 0, len(c.rows[name]))
+	for uuid := range c.rows[name] {
+		uuids = append(uuids, uuid)
+	}
+
+	sort.Strings(uuids)
+
+	rows := make([]interface{}, 0, len(uuids))
+	for _, uuid := range uuids {
+		rows = append(rows, c.rows[name][uuid])
+	}
+
+	return rows
+}
+
+// lookup returns the stored row with the same table and UUID as row, or an error if it doesn't exist.
+func (c *memoryClient) lookup(row interface{}) (interface{}, error) {
+	table := nbTableName(row)
+	stored, found := c.rows[table][c.uuid(row)]
+	if !found {
+		return nil, fmt.Errorf("%s row %q not found", table, c.uuid(row))
+	}
+
+	return stored, nil
+}
+
+// get populates row (a pointer to an NB row) with a copy of the first row whose column has the given value.
+// Returns false if there is no such row.
+func (c *memoryClient) get(row interface{}, column string, value string) bool {
+	for _, stored := range c.table(nbTableName(row)) {
+		if nbColumnMatches(stored, column, value) {
+			reflect.ValueOf(row).Elem().Set(reflect.ValueOf(nbCopy(stored)).Elem())
+			return true
+		}
+	}
+
+	return false
+}
+
+// list populates rows (a pointer to a slice of NB rows) with copies of the rows identified by UUIDs.
+func (c *memoryClient) list(rows interface{}, uuids ...string) error {
+	rowsVal := reflect.ValueOf(rows).Elem()
+	table := nbTables[rowsVal.Type().Elem()]
+	for _, uuid := range uuids {
+		stored, found := c.rows[table][uuid]
+		if !found {
+			return fmt.Errorf("%s row %q not found", table, uuid)
+		}
+
+		rowsVal.Set(reflect.Append(rowsVal, reflect.ValueOf(nbCopy(stored)).Elem()))
+	}
+
+	return nil
+}
+
+// check validates the indexed and reference columns of row (a pointer to an NB row) against the other rows.
+func (c *memoryClient) check(row interface{}) error {
+	table := nbTableName(row)
+
+	column, found := memoryIndexes[table]
+	if found {
+		value, _ := nbField(row, column)
+		for _, stored := range c.table(table) {
+			if c.uuid(stored) != c.uuid(row) && nbColumnMatches(stored, column, value.String()) {
+				return fmt.Errorf("%s row with %s %q already exists", table, column, value.String())
+			}
+		}
+	}
+
+	for column, refTable := range memoryReferences[table] {
+		value, _ := nbField(row, column)
+		if value.IsNil() {
+			continue
+		}
+
+		_, found := c.rows[refTable][value.Elem().String()]
+		if !found {
+			return fmt.Errorf("%s column %q refers to missing %s row %q", table, column, refTable, value.Elem().String())
+		}
+	}
+
+	return nil
+}
+
+// create stores a copy of row and sets its UUID. When parent is not nil the new row is added to the parent's
+// column, which must exist.
+func (c *memoryClient) create(row interface{}, parent interface{}, parentColumn string) error {
+	var storedParent interface{}
+	if parent != nil {
+		var err error
+		storedParent, err = c.lookup(parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.lastUUID++
+	uuid, _ := nbField(row, "_uuid")
+	uuid.SetString(fmt.Sprintf("00000000-0000-4000-8000-%012x", c.lastUUID))
+
+	err := c.check(row)
+	if err != nil {
+		uuid.SetString("")
+		return err
+	}
+
+	table := nbTableName(row)
+	if c.rows[table] == nil {
+		c.rows[table] = map[string]interface{}{}
+	}
+
+	c.rows[table][uuid.String()] = nbCopy(row)
+
+	if storedParent != nil {
+		children, _ := nbField(storedParent, parentColumn)
+		children.Set(reflect.Append(children, uuid))
+	}
+
+	return nil
+}
+
+// destroy deletes row (a pointer to an NB row) along with its child rows, and clears any references to it.
+func (c *memoryClient) destroy(row interface{}) error {
+	stored, err := c.lookup(row)
+	if err != nil {
+		return err
+	}
+
+	table := nbTableName(stored)
+	for _, column := range memoryChildren[table] {
+		children, _ := nbField(stored, column)
+		for _, child := range children.Interface().([]string) {
+			for childTable := range c.rows {
+				delete(c.rows[childTable], child)
+			}
+		}
+	}
+
+	delete(c.rows[table], c.uuid(stored))
+
+	for refTable, columns := range memoryReferences {
+		for column, target := range columns {
+			if target != table {
+				continue
+			}
+
+			for _, referrer := range c.rows[refTable] {
+				value, _ := nbField(referrer, column)
+				if !value.IsNil() && value.Elem().String() == c.uuid(stored) {
+					value.Set(reflect.Zero(value.Type()))
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeChild removes child from the parent's column and deletes it.
+func (c *memoryClient) removeChild(parent interface{}, column string, child interface{}) error {
+	storedParent, err := c.lookup(parent)
+	if err != nil {
+		return err
+	}
+
+	children, _ := nbField(storedParent, column)
+	remaining := []string{}
+	for _, uuid := range children.Interface().([]string) {
+		if uuid != c.uuid(child) {
+			remaining = append(remaining, uuid)
+		}
+	}
+
+	if len(remaining) == children.Len() {
+		return fmt.Errorf("%s row %q not in %s column %q", nbTableName(child), c.uuid(child), nbTableName(parent), column)
+	}
+
+	children.Set(reflect.ValueOf(remaining))
+	return c.destroy(child)
+}
+
+// Begin takes a snapshot of the database to return to if the transaction is aborted.
+func (c *memoryClient) Begin() {
+	c.snapshot = make(map[string]map[string]interface{}, len(c.rows))
+	for table, rows := range c.rows {
+		c.snapshot[table] = make(map[string]interface{}, len(rows))
+		for uuid, row := range rows {
+			c.snapshot[table][uuid] = nbCopy(row)
+		}
+	}
+}
+
+// Commit keeps the changes made since Begin.
+func (c *memoryClient) Commit() error {
+	c.snapshot = nil
+	return nil
+}
+
+// Abort returns the database to the snapshot taken by Begin.
+func (c *memoryClient) Abort() {
+	if c.snapshot == nil {
+		return
+	}
+
+	c.rows = c.snapshot
+	c.snapshot = nil
+}
+
+// GetLogicalRouters returns all logical routers.
+func (c *memoryClient) GetLogicalRouters() ([]nbLogicalRouter, error) {
+	routers := []nbLogicalRouter{}
+	for _, stored := range c.table("Logical_Router") {
+		routers = append(routers, *nbCopy(stored).(*nbLogicalRouter))
+	}
+
+	return routers, nil
+}
+
+// GetLogicalRouter returns the logical router with the given name.
+func (c *memoryClient) GetLogicalRouter(name string) (*nbLogicalRouter, error) {
+	router := &nbLogicalRouter{}
+	if !c.get(router, "name", name) {
+		return nil, nil
+	}
+
+	return router, nil
+}
+
+// GetLogicalRouterPort returns the logical router port with the given name.
+func (c *memoryClient) GetLogicalRouterPort(name string) (*nbLogicalRouterPort, error) {
+	port := &nbLogicalRouterPort{}
+	if !c.get(port, "name", name) {
+		return nil, nil
+	}
+
+	return port, nil
+}
+
+// GetLogicalRouterPorts returns the ports of a logical router.
+func (c *memoryClient) GetLogicalRouterPorts(router *nbLogicalRouter) ([]nbLogicalRouterPort, error) {
+	ports := []nbLogicalRouterPort{}
+	err := c.list(&ports, router.Ports...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ports, nil
+}
+
+// GetLogicalRouterNATs returns the NAT rules of a logical router.
+func (c *memoryClient) GetLogicalRouterNATs(router *nbLogicalRouter) ([]nbNAT, error) {
+	nats := []nbNAT{}
+	err := c.list(&nats, router.Nat...)
+	if err != nil {
+		return nil, err
+	}
+
+	return nats, nil
+}
+
+// GetLogicalRouterStaticRoutes returns the static routes of a logical router.
+func (c *memoryClient) GetLogicalRouterStaticRoutes(router *nbLogicalRouter) ([]nbLogicalRouterStaticRoute, error) {
+	routes := []nbLogicalRouterStaticRoute{}
+	err := c.list(&routes, router.StaticRoutes...)
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// GetLogicalSwitches returns all logical switches.
+func (c *memoryClient) GetLogicalSwitches() ([]nbLogicalSwitch, error) {
+	switches := []nbLogicalSwitch{}
+	for _, stored := range c.table("Logical_Switch") {
+		switches = append(switches, *nbCopy(stored).(*nbLogicalSwitch))
+	}
+
+	return switches, nil
+}
+
+// GetLogicalSwitch returns the logical switch with the given name.
+func (c *memoryClient) GetLogicalSwitch(name string) (*nbLogicalSwitch, error) {
+	logicalSwitch := &nbLogicalSwitch{}
+	if !c.get(logicalSwitch, "name", name) {
+		return nil, nil
+	}
+
+	return logicalSwitch, nil
+}
+
+// GetLogicalSwitchPort returns the logical switch port with the given name.
+func (c *memoryClient) GetLogicalSwitchPort(name string) (*nbLogicalSwitchPort, error) {
+	port := &nbLogicalSwitchPort{}
+	if !c.get(port, "name", name) {
+		return nil, nil
+	}
+
+	return port, nil
+}
+
+// GetLogicalSwitchPorts returns the ports of a logical switch.
+func (c *memoryClient) GetLogicalSwitchPorts(logicalSwitch *nbLogicalSwitch) ([]nbLogicalSwitchPort, error) {
+	ports := []nbLogicalSwitchPort{}
+	err := c.list(&ports, logicalSwitch.Ports...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ports, nil
+}
+
+// GetDHCPOptions returns the DHCP options associated to a logical switch.
+func (c *memoryClient) GetDHCPOptions(switchName string) ([]nbDHCPOptions, error) {
+	opts := []nbDHCPOptions{}
+	for _, stored := range c.table("DHCP_Options") {
+		if nbColumnMatches(stored, "external_ids:lxd_network", switchName) {
+			opts = append(opts, *nbCopy(stored).(*nbDHCPOptions))
+		}
+	}
+
+	return opts, nil
+}
+
+// GetHAChassisGroup returns the HA chassis group with the given name.
+func (c *memoryClient) GetHAChassisGroup(name string) (*nbHAChassisGroup, error) {
+	group := &nbHAChassisGroup{}
+	if !c.get(group, "name", name) {
+		return nil, nil
+	}
+
+	return group, nil
+}
+
+// GetHAChassis returns the members of an HA chassis group.
+func (c *memoryClient) GetHAChassis(group *nbHAChassisGroup) ([]nbHAChassis, error) {
+	chassis := []nbHAChassis{}
+	err := c.list(&chassis, group.HaChassis...)
+	if err != nil {
+		return nil, err
+	}
+
+	return chassis, nil
+}
+
+// GetNBGlobal returns the NB_Global row.
+func (c *memoryClient) GetNBGlobal() (*nbGlobal, error) {
+	globals := c.table("NB_Global")
+	if len(globals) == 0 {
+		return nil, nil
+	}
+
+	return nbCopy(globals[0]).(*nbGlobal), nil
+}
+
+// CreateLogicalRouter creates a logical router.
+func (c *memoryClient) CreateLogicalRouter(router *nbLogicalRouter) error {
+	return c.create(router, nil, "")
+}
+
+// CreateLogicalRouterPort creates a port on a logical router.
+func (c *memoryClient) CreateLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	return c.create(port, router, "ports")
+}
+
+// CreateLogicalRouterStaticRoute adds a static route to a logical router.
+func (c *memoryClient) CreateLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	return c.create(route, router, "static_routes")
+}
+
+// CreateNAT adds a NAT rule to a logical router.
+func (c *memoryClient) CreateNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	return c.create(nat, router, "nat")
+}
+
+// CreateLogicalSwitch creates a logical switch.
+func (c *memoryClient) CreateLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	return c.create(logicalSwitch, nil, "")
+}
+
+// CreateLogicalSwitchPort creates a port on a logical switch.
+func (c *memoryClient) CreateLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	return c.create(port, logicalSwitch, "ports")
+}
+
+// CreateDHCPOptions creates DHCP options.
+func (c *memoryClient) CreateDHCPOptions(opts *nbDHCPOptions) error {
+	return c.create(opts, nil, "")
+}
+
+// CreateHAChassisGroup creates an HA chassis group.
+func (c *memoryClient) CreateHAChassisGroup(group *nbHAChassisGroup) error {
+	return c.create(group, nil, "")
+}
+
+// CreateHAChassis adds a chassis to an HA chassis group.
+func (c *memoryClient) CreateHAChassis(group *nbHAChassisGroup, chassis *nbHAChassis) error {
+	return c.create(chassis, group, "ha_chassis")
+}
+
+// Update sets the named columns of an existing row.
+func (c *memoryClient) Update(row interface{}, columns ...string) error {
+	stored, err := c.lookup(row)
+	if err != nil {
+		return err
+	}
+
+	updated := nbCopy(stored)
+	for _, column := range columns {
+		src, err := nbField(row, column)
+		if err != nil {
+			return err
+		}
+
+		dst, _ := nbField(updated, column)
+		dst.Set(reflect.Zero(dst.Type()))
+		nbCopyValue(dst, src)
+	}
+
+	err = c.check(updated)
+	if err != nil {
+		return err
+	}
+
+	c.rows[nbTableName(row)][c.uuid(row)] = updated
+	return nil
+}
+
+// DeleteLogicalRouter deletes a logical router along with its ports, routes and NAT rules.
+func (c *memoryClient) DeleteLogicalRouter(router *nbLogicalRouter) error {
+	return c.destroy(router)
+}
+
+// DeleteLogicalRouterPort removes a port from a logical router.
+func (c *memoryClient) DeleteLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	return c.removeChild(router, "ports", port)
+}
+
+// DeleteLogicalRouterStaticRoute removes a static route from a logical router.
+func (c *memoryClient) DeleteLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	return c.removeChild(router, "static_routes", route)
+}
+
+// DeleteNAT removes a NAT rule from a logical router.
+func (c *memoryClient) DeleteNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	return c.removeChild(router, "nat", nat)
+}
+
+// DeleteLogicalSwitch deletes a logical switch along with its ports.
+func (c *memoryClient) DeleteLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	return c.destroy(logicalSwitch)
+}
+
+// DeleteLogicalSwitchPort removes a port from a logical switch.
+func (c *memoryClient) DeleteLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	return c.removeChild(logicalSwitch, "ports", port)
+}
+
+// DeleteDHCPOptions deletes DHCP options, clearing them from any ports that use them.
+func (c *memoryClient) DeleteDHCPOptions(opts *nbDHCPOptions) error {
+	return c.destroy(opts)
+}
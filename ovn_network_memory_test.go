@@ -0,0 +1,786 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/mdlayher/netx/eui64"
+)
+
+// testFamilies are the IP family combinations a network can have.
+var testFamilies = []struct {
+	name string
+	ipv4 bool
+	ipv6 bool
+}{
+	{name: "dual-stack", ipv4: true, ipv6: true},
+	{name: "ipv4", ipv4: true},
+	{name: "ipv6", ipv6: true},
+}
+
+func TestCreateProjectInternalSwitch(t *testing.T) {
+	for _, tt := range testFamilies {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			n := testNetwork("n")
+			n.ipv4 = tt.ipv4
+			n.ipv6 = tt.ipv6
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			internalSwitch, err := nb.GetLogicalSwitch("p-n-ls-int")
+			if err != nil || internalSwitch == nil {
+				t.Fatalf("Internal switch not found: %v", err)
+			}
+
+			if (internalSwitch.OtherConfig["subnet"] == "10.0.0.0/24") != tt.ipv4 {
+				t.Errorf("Unexpected subnet %q", internalSwitch.OtherConfig["subnet"])
+			}
+
+			if tt.ipv4 && internalSwitch.OtherConfig["exclude_ips"] != "10.0.0.1" {
+				t.Errorf("Unexpected exclude_ips %q", internalSwitch.OtherConfig["exclude_ips"])
+			}
+
+			if (internalSwitch.OtherConfig["ipv6_prefix"] == "fd00::/64") != tt.ipv6 {
+				t.Errorf("Unexpected ipv6_prefix %q", internalSwitch.OtherConfig["ipv6_prefix"])
+			}
+
+			opts, err := nb.GetDHCPOptions("p-n-ls-int")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			families := 0
+			for _, family := range []bool{tt.ipv4, tt.ipv6} {
+				if family {
+					families++
+				}
+			}
+
+			if len(opts) != families {
+				t.Errorf("Expected %d DHCP options, got %d", families, len(opts))
+			}
+
+			ports, err := nb.GetLogicalSwitchPorts(internalSwitch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(ports) != 1 || ports[0].Name != "p-n-lsrp-int" || ports[0].Options["router-port"] != "p-n-lrp-int" {
+				t.Fatalf("Unexpected internal switch ports %+v", ports)
+			}
+
+			routerPort, err := nb.GetLogicalRouterPort("p-n-lrp-int")
+			if err != nil || routerPort == nil {
+				t.Fatalf("Internal router port not found: %v", err)
+			}
+
+			if len(routerPort.Networks) != families {
+				t.Errorf("Unexpected internal router port networks %v", routerPort.Networks)
+			}
+
+			if (routerPort.Ipv6RaConfigs["address_mode"] == "slaac") != tt.ipv6 {
+				t.Errorf("Unexpected ipv6_ra_configs %v", routerPort.Ipv6RaConfigs)
+			}
+
+			// Running again with no changes leaves the database alone.
+			requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+			requireNoDrift(t, "p", n)
+		})
+	}
+}
+
+func TestInternalSwitchExcludeIPs(t *testing.T) {
+	tests := []struct {
+		name     string
+		reserved []string
+		want     string
+	}{
+		{
+			name: "router address only",
+			want: "10.0.0.1",
+		},
+		{
+			name:     "reserved addresses",
+			reserved: []string{"10.0.0.20", "10.0.0.5-10.0.0.9"},
+			want:     "10.0.0.1 10.0.0.20 10.0.0.5..10.0.0.9",
+		},
+		{
+			name:     "reserved range including the router address",
+			reserved: []string{"10.0.0.1-10.0.0.10"},
+			want:     "10.0.0.1..10.0.0.10",
+		},
+		{
+			name:     "router address reserved on its own",
+			reserved: []string{"10.0.0.20", "10.0.0.1"},
+			want:     "10.0.0.20 10.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			n := testNetwork("n")
+			n.reservedIPs = tt.reserved
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			internalSwitch, err := nb.GetLogicalSwitch("p-n-ls-int")
+			if err != nil || internalSwitch == nil {
+				t.Fatalf("Internal switch not found: %v", err)
+			}
+
+			if internalSwitch.OtherConfig["exclude_ips"] != tt.want {
+				t.Errorf("Expected exclude_ips %q, got %q", tt.want, internalSwitch.OtherConfig["exclude_ips"])
+			}
+
+			requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+			requireNoDrift(t, "p", n)
+		})
+	}
+}
+
+func TestAddInstancePort(t *testing.T) {
+	tests := []struct {
+		name     string
+		static   *instanceAddresses
+		existing string // Name of an OVS port left from an earlier instance with the same name.
+		wantIPv4 string
+		wantIPv6 string
+	}{
+		{
+			name:     "dynamic",
+			wantIPv4: "10.0.0.101",
+		},
+		{
+			name:     "static",
+			static:   &instanceAddresses{ipv4: "10.0.0.50", ipv6: "fd00::50"},
+			wantIPv4: "10.0.0.50",
+			wantIPv6: "fd00::50",
+		},
+		{
+			name:     "replaced",
+			existing: "insthold",
+			wantIPv4: "10.0.0.101",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, host := setupTestNB(t)
+			n := testNetwork("n")
+			if tt.static != nil {
+				n.instanceIPs = map[string]instanceAddresses{"c1": *tt.static}
+			}
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			findCommand := quoteCommand("ovs-vsctl", "--format=csv", "--no-headings", "--data=bare", "--colum=name", "find", "interface", "external-ids:iface-id=p-n-ls-inst-c1")
+			host.outputs[findCommand] = tt.existing
+
+			peerName, mac, addresses, err := addInstancePort("p", n, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			port, err := nb.GetLogicalSwitchPort("p-n-ls-inst-c1")
+			if err != nil || port == nil {
+				t.Fatalf("Instance port not found: %v", err)
+			}
+
+			if port.Dhcpv4Options == nil || port.Dhcpv6Options == nil {
+				t.Errorf("Instance port is missing DHCP options")
+			}
+
+			if !strings.HasPrefix(port.Addresses[0], mac+" ") {
+				t.Errorf("Instance port addresses %v don't start with MAC %q", port.Addresses, mac)
+			}
+
+			if tt.static != nil && (len(port.PortSecurity) != 1 || port.PortSecurity[0] != port.Addresses[0]) {
+				t.Errorf("Unexpected port security %v", port.PortSecurity)
+			}
+
+			if addresses.ipv4 != tt.wantIPv4 {
+				t.Errorf("Expected IPv4 address %q, got %q", tt.wantIPv4, addresses.ipv4)
+			}
+
+			if tt.wantIPv6 != "" && addresses.ipv6 != tt.wantIPv6 {
+				t.Errorf("Expected IPv6 address %q, got %q", tt.wantIPv6, addresses.ipv6)
+			}
+
+			if addresses.ipv6 == "" {
+				t.Errorf("No IPv6 address")
+			}
+
+			for _, prefix := range []string{
+				fmt.Sprintf("ip link set dev %s address %s", peerName, mac),
+				"ovs-vsctl add-port br-int insth",
+				"ovs-vsctl set interface insth",
+			} {
+				if !host.ran(prefix) {
+					t.Errorf("Command %q not run", prefix)
+				}
+			}
+
+			if (tt.existing != "") != host.ran("ovs-vsctl del-port "+tt.existing) {
+				t.Errorf("Unexpected removal of existing OVS ports: %v", host.commands)
+			}
+
+			// Adding the instance again replaces its port, which keeps its MAC address.
+			_, secondMAC, _, err := addInstancePort("p", n, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if secondMAC != mac {
+				t.Errorf("MAC address changed from %q to %q", mac, secondMAC)
+			}
+
+			internalSwitch, _ := nb.GetLogicalSwitch("p-n-ls-int")
+			ports, _ := nb.GetLogicalSwitchPorts(internalSwitch)
+			if len(ports) != 2 {
+				t.Errorf("Expected the router and instance ports, got %d ports", len(ports))
+			}
+		})
+	}
+}
+
+func TestAddInstancePortStaticAddresses(t *testing.T) {
+	tests := []struct {
+		name   string
+		static instanceAddresses
+		want   string // Addresses after the MAC address, if the port is added.
+		errMsg string
+	}{
+		{
+			name:   "static IPv4 and IPv6",
+			static: instanceAddresses{ipv4: "10.0.0.10", ipv6: "fd00::10"},
+			want:   "10.0.0.10 fd00::10",
+		},
+		{
+			name:   "IPv6 derived from the MAC address",
+			static: instanceAddresses{ipv4: "10.0.0.10"},
+		},
+		{
+			name:   "outside the subnet",
+			static: instanceAddresses{ipv4: "10.0.1.10"},
+			errMsg: `Static IPv4 address "10.0.1.10" is not a host address in subnet "10.0.0.0/24"`,
+		},
+		{
+			name:   "network address",
+			static: instanceAddresses{ipv4: "10.0.0.0"},
+			errMsg: `Static IPv4 address "10.0.0.0" is not a host address in subnet "10.0.0.0/24"`,
+		},
+		{
+			name:   "broadcast address",
+			static: instanceAddresses{ipv4: "10.0.0.255"},
+			errMsg: `Static IPv4 address "10.0.0.255" is not a host address in subnet "10.0.0.0/24"`,
+		},
+		{
+			name:   "gateway address",
+			static: instanceAddresses{ipv4: "10.0.0.1"},
+			errMsg: `Static IPv4 address "10.0.0.1" is in the excluded addresses "10.0.0.1"`,
+		},
+		{
+			name:   "IPv6 outside the prefix",
+			static: instanceAddresses{ipv4: "10.0.0.10", ipv6: "fd01::10"},
+			errMsg: `Static IPv6 address "fd01::10" is not in prefix "fd00::/64"`,
+		},
+		{
+			name:   "used by another port",
+			static: instanceAddresses{ipv4: "10.0.0.20"},
+			errMsg: `Static address "10.0.0.20" is already used by port "p-n-ls-inst-c2"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _ = setupTestNB(t)
+			n := testNetwork("n")
+			n.instanceIPs = map[string]instanceAddresses{"c1": tt.static, "c2": {ipv4: "10.0.0.20"}}
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = addInstancePort("p", n, "c2")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, mac, addresses, err := addInstancePort("p", n, "c1")
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+				}
+
+				port, _ := nb.GetLogicalSwitchPort("p-n-ls-inst-c1")
+				if port != nil {
+					t.Errorf("Instance port added despite the error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.want
+			if want == "" {
+				hwAddr, _ := net.ParseMAC(mac)
+				ip6, _ := eui64.ParseMAC(net.ParseIP("fd00::"), hwAddr)
+				want = fmt.Sprintf("%s %s", tt.static.ipv4, ip6)
+			}
+
+			want = mac + " " + want
+			port, err := nb.GetLogicalSwitchPort("p-n-ls-inst-c1")
+			if err != nil || port == nil {
+				t.Fatalf("Instance port not found: %v", err)
+			}
+
+			if strings.Join(port.Addresses, ",") != want || strings.Join(port.PortSecurity, ",") != want {
+				t.Errorf("Expected addresses and port security %q, got %v and %v", want, port.Addresses, port.PortSecurity)
+			}
+
+			// The static addresses are the ones reported for the instance.
+			if mac+" "+addresses.ipv4+" "+addresses.ipv6 != want {
+				t.Errorf("Expected instance addresses %q, got %+v", want, addresses)
+			}
+		})
+	}
+}
+
+func TestCreateProjectNetworkRollback(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(n *network)
+		errMsg string
+	}{
+		{
+			name:   "invalid IPv6 gateway",
+			setup:  func(n *network) { n.gw6 = "nope" },
+			errMsg: "Failed creating logical router uplink",
+		},
+		{
+			name: "missing transit switch",
+			setup: func(n *network) {
+				n.transitSwitch = "ts1"
+				n.transitNet4 = "169.254.100.0/24"
+				n.availabilityZone = "az1"
+			},
+			errMsg: "Failed attaching to transit switch",
+		},
+		{
+			name: "unreachable static route nexthop",
+			setup: func(n *network) {
+				n.routes = []staticRoute{{prefix: "10.50.0.0/16", nexthop: "198.51.100.1", policy: "dst-ip"}}
+			},
+			errMsg: "Failed creating static routes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			err := createProjectNetwork("p", testNetwork("n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Changes made before the failure, to the existing network and to a new one, are all rolled back.
+			for _, name := range []string{"n", "m"} {
+				n := testNetwork(name)
+				n.dns4 = "8.8.8.8"
+				tt.setup(&n)
+
+				before := db.snapshot()
+				err = createProjectNetwork("p", n)
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+				}
+
+				requireUnchanged(t, db, before)
+			}
+		})
+	}
+}
+
+func TestReconcileTwice(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(n *network)
+	}{
+		{
+			name: "default",
+		},
+		{
+			name: "routed",
+			setup: func(n *network) {
+				n.routed4 = true
+				n.routed6 = true
+			},
+		},
+		{
+			name: "static routes",
+			setup: func(n *network) {
+				n.routes = []staticRoute{
+					{prefix: "10.50.0.0/16", nexthop: "10.0.0.254", policy: "dst-ip"},
+					{prefix: "fd50::/48", nexthop: "fd00::254", policy: "dst-ip"},
+				}
+			},
+		},
+		{
+			name: "reserved addresses and static instance",
+			setup: func(n *network) {
+				n.reservedIPs = []string{"10.0.0.5-10.0.0.9"}
+				n.instanceIPs = map[string]instanceAddresses{"c2": {ipv4: "10.0.0.50"}}
+			},
+		},
+		{
+			name:  "stateful DHCPv6",
+			setup: func(n *network) { n.ipv6Mode = "dhcpv6_stateful" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			n := testNetwork("n")
+			n.instances = []string{"c1", "c2"}
+			if tt.setup != nil {
+				tt.setup(&n)
+			}
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, instanceName := range n.instances {
+				_, _, _, err = addInstancePort("p", n, instanceName)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// A second run, starting afresh as the next invocation does, makes no changes and finds no drift.
+			macsInUse = nil
+			requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+			requireNoDrift(t, "p", n)
+		})
+	}
+}
+
+func TestCreateLogicalRouterRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		routes []staticRoute
+		errMsg string
+	}{
+		{
+			name: "nexthops in the port subnets",
+			routes: []staticRoute{
+				{prefix: "10.50.0.0/16", nexthop: "10.0.0.254", policy: "dst-ip"},
+				{prefix: "198.51.100.0/24", nexthop: "192.0.2.5", policy: "dst-ip"},
+				{prefix: "fd50::/48", nexthop: "fd00::254", policy: "dst-ip"},
+			},
+		},
+		{
+			name:   "output port and policy",
+			routes: []staticRoute{{prefix: "10.0.0.128/25", nexthop: "192.0.2.5", outputPort: "p-n-lrp-ext", policy: "src-ip"}},
+		},
+		{
+			name:   "unreachable nexthop",
+			routes: []staticRoute{{prefix: "10.50.0.0/16", nexthop: "198.51.100.1", policy: "dst-ip"}},
+			errMsg: `Route "10.50.0.0/16" nexthop "198.51.100.1" is not in the subnet of any port of logical router "p-n"`,
+		},
+		{
+			name:   "nexthop outside the output port's subnet",
+			routes: []staticRoute{{prefix: "10.50.0.0/16", nexthop: "10.0.0.254", outputPort: "p-n-lrp-ext", policy: "dst-ip"}},
+			errMsg: `Route "10.50.0.0/16" nexthop "10.0.0.254" is not in the subnet of any port of logical router "p-n"`,
+		},
+		{
+			name:   "unknown output port",
+			routes: []staticRoute{{prefix: "10.50.0.0/16", nexthop: "10.0.0.254", outputPort: "p-m-lrp-int", policy: "dst-ip"}},
+			errMsg: `Route "10.50.0.0/16" output port "p-m-lrp-int" is not a port of logical router "p-n"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			n := testNetwork("n")
+
+			// A route that is no longer in the network definition is removed.
+			n.routes = []staticRoute{{prefix: "10.99.0.0/16", nexthop: "10.0.0.99", policy: "dst-ip"}}
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n.routes = tt.routes
+			err = createProjectNetwork("p", n)
+			if tt.errMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router, _ := nb.GetLogicalRouter("p-n")
+			routes, _ := nb.GetLogicalRouterStaticRoutes(router)
+			got := []staticRoute{}
+			for _, route := range routes {
+				if route.ExternalIDs["lxd_network"] != "p-n" {
+					continue
+				}
+
+				key := staticRoute{prefix: route.IPPrefix, nexthop: route.Nexthop, policy: "dst-ip"}
+				if route.OutputPort != nil {
+					key.outputPort = *route.OutputPort
+				}
+
+				if route.Policy != nil {
+					key.policy = *route.Policy
+				}
+
+				got = append(got, key)
+			}
+
+			if fmt.Sprint(got) != fmt.Sprint(tt.routes) {
+				t.Errorf("Expected routes %+v, got %+v", tt.routes, got)
+			}
+
+			requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+			requireNoDrift(t, "p", n)
+		})
+	}
+}
+
+func TestDropIPFamily(t *testing.T) {
+	for _, tt := range testFamilies[1:] {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestNB(t)
+			n := testNetwork("n")
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The network loses an IP family, whose routes, NAT rules and DHCP options are removed.
+			n.ipv4 = tt.ipv4
+			n.ipv6 = tt.ipv6
+			if !n.ipv4 {
+				n.gw4, n.dns4, n.extIP4, n.extGW4 = "", "", "", ""
+			}
+
+			if !n.ipv6 {
+				n.gw6, n.dns6, n.ipv6Mode, n.extIP6Prefix, n.extGW6 = "", "", "", "", ""
+			}
+
+			err = createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router, _ := nb.GetLogicalRouter("p-n")
+			routes, _ := nb.GetLogicalRouterStaticRoutes(router)
+			nats, _ := nb.GetLogicalRouterNATs(router)
+			opts, _ := nb.GetDHCPOptions("p-n-ls-int")
+			if len(routes) != 1 || len(nats) != 1 || len(opts) != 1 {
+				t.Errorf("Unexpected routes %v, NAT rules %v and DHCP options %+v", testRowNames(routes), testRowNames(nats), opts)
+			}
+
+			requireNoDrift(t, "p", n)
+		})
+	}
+}
+
+func TestRoutedNetwork(t *testing.T) {
+	tests := []struct {
+		name       string
+		routed4    bool
+		routed6    bool
+		wantNATs   []string
+		wantRoutes []string // As "<router> <prefix> <nexthop>", with the external IPv6 address as ext6.
+	}{
+		{
+			name:     "SNAT",
+			wantNATs: []string{"snat 10.0.0.0/24 -> 192.0.2.10", "snat fd00::/64 -> ext6"},
+		},
+		{
+			name:       "routed IPv4",
+			routed4:    true,
+			wantNATs:   []string{"snat fd00::/64 -> ext6"},
+			wantRoutes: []string{"192.0.2.1 10.0.0.0/24 192.0.2.10"},
+		},
+		{
+			name:       "routed IPv6",
+			routed6:    true,
+			wantNATs:   []string{"snat 10.0.0.0/24 -> 192.0.2.10"},
+			wantRoutes: []string{"2001:db8::1 fd00::/64 ext6"},
+		},
+		{
+			name:       "routed",
+			routed4:    true,
+			routed6:    true,
+			wantNATs:   []string{},
+			wantRoutes: []string{"192.0.2.1 10.0.0.0/24 192.0.2.10", "2001:db8::1 fd00::/64 ext6"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			n := testNetwork("n")
+
+			// The SNAT rules of a network that was set up without routing are removed.
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n.routed4 = tt.routed4
+			n.routed6 = tt.routed6
+			err = createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			externalRouterPort, _ := nb.GetLogicalRouterPort("p-n-lrp-ext")
+			ext6, _, _ := net.ParseCIDR(externalRouterPort.Networks[1])
+
+			router, _ := nb.GetLogicalRouter("p-n")
+			nats, _ := nb.GetLogicalRouterNATs(router)
+			got := strings.ReplaceAll(strings.Join(testRowNames(nats), ","), ext6.String(), "ext6")
+			if got != strings.Join(tt.wantNATs, ",") {
+				t.Errorf("Expected NAT rules %v, got %v", tt.wantNATs, got)
+			}
+
+			routes, err := getUpstreamRoutes("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotRoutes := []string{}
+			for _, route := range routes {
+				gotRoutes = append(gotRoutes, strings.ReplaceAll(fmt.Sprintf("%s %s %s", route.router, route.prefix, route.nexthop), ext6.String(), "ext6"))
+			}
+
+			if strings.Join(gotRoutes, ",") != strings.Join(tt.wantRoutes, ",") {
+				t.Errorf("Expected upstream routes %v, got %v", tt.wantRoutes, gotRoutes)
+			}
+
+			requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+			requireNoDrift(t, "p", n)
+		})
+	}
+}
+
+func TestUpstreamRoutesDryRun(t *testing.T) {
+	setupTestNB(t)
+	n := testNetwork("n")
+	n.routed4 = true
+
+	// Without the external router port its address is a placeholder in a plan, and an error otherwise.
+	_, err := getUpstreamRoutes("p", n)
+	if err == nil || err.Error() != `Logical router port "p-n-lrp-ext" has no ipv4 address` {
+		t.Fatalf("Expected missing address error, got %v", err)
+	}
+
+	dryRun = true
+	routes, err := getUpstreamRoutes("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(routes) != 1 || routes[0].nexthop != "<ipv4:p-n-lrp-ext>" {
+		t.Errorf("Unexpected upstream routes %+v", routes)
+	}
+}
+
+func TestIPv6Modes(t *testing.T) {
+	tests := []struct {
+		mode          string
+		ipv4          bool
+		wantStateless bool
+		wantDynamic   bool
+	}{
+		{mode: "slaac", ipv4: true, wantStateless: true, wantDynamic: true},
+		{mode: "slaac", wantStateless: true},
+		{mode: "dhcpv6_stateless", ipv4: true, wantStateless: true, wantDynamic: true},
+		{mode: "dhcpv6_stateless", wantStateless: true},
+		{mode: "dhcpv6_stateful", ipv4: true, wantDynamic: true},
+		{mode: "dhcpv6_stateful", wantDynamic: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s ipv4=%t", tt.mode, tt.ipv4), func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			n := testNetwork("n")
+			n.ipv4 = tt.ipv4
+			n.ipv6Mode = tt.mode
+			n.instances = []string{"c1"}
+
+			err := createProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			routerPort, _ := nb.GetLogicalRouterPort("p-n-lrp-int")
+			if routerPort.Ipv6RaConfigs["address_mode"] != tt.mode {
+				t.Errorf("Unexpected RA address mode %q", routerPort.Ipv6RaConfigs["address_mode"])
+			}
+
+			_, cidrV6, _ := net.ParseCIDR(n.gw6)
+			opts, _ := nb.GetDHCPOptions("p-n-ls-int")
+			dhcpv6Opts := getDHCPOptionsForSubnet(opts, cidrV6)
+			if dhcpv6Opts == nil || (dhcpv6Opts.Options["dhcpv6_stateless"] == "true") != tt.wantStateless {
+				t.Fatalf("Unexpected DHCPv6 options %+v", dhcpv6Opts)
+			}
+
+			_, mac, addresses, err := addInstancePort("p", n, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			hwAddr, _ := net.ParseMAC(mac)
+			slaacIP, _ := eui64.ParseMAC(cidrV6.IP, hwAddr)
+			if addresses.ipv6 != slaacIP.String() {
+				t.Errorf("Expected IPv6 address %q, got %q", slaacIP.String(), addresses.ipv6)
+			}
+
+			port, _ := nb.GetLogicalSwitchPort("p-n-ls-inst-c1")
+			wantAddresses := fmt.Sprintf("%s %s", mac, slaacIP.String())
+			if tt.wantDynamic {
+				wantAddresses = fmt.Sprintf("%s dynamic", mac)
+			}
+
+			if len(port.Addresses) != 1 || port.Addresses[0] != wantAddresses {
+				t.Errorf("Expected addresses %q, got %v", wantAddresses, port.Addresses)
+			}
+
+			requireNoWrites(t, db, func() error { return createProjectNetwork("p", n) })
+			requireNoDrift(t, "p", n)
+		})
+	}
+}
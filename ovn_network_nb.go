@@ -0,0 +1,384 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// nbLogicalRouter is a row in the Logical_Router table.
+type nbLogicalRouter struct {
+	UUID         string            `ovsdb:"_uuid"`
+	Name         string            `ovsdb:"name"`
+	Ports        []string          `ovsdb:"ports"`
+	Nat          []string          `ovsdb:"nat"`
+	StaticRoutes []string          `ovsdb:"static_routes"`
+	Options      map[string]string `ovsdb:"options"`
+	ExternalIDs  map[string]string `ovsdb:"external_ids"`
+}
+
+// nbLogicalRouterPort is a row in the Logical_Router_Port table.
+type nbLogicalRouterPort struct {
+	UUID           string            `ovsdb:"_uuid"`
+	Name           string            `ovsdb:"name"`
+	MAC            string            `ovsdb:"mac"`
+	Networks       []string          `ovsdb:"networks"`
+	Peer           *string           `ovsdb:"peer"`
+	HaChassisGroup *string           `ovsdb:"ha_chassis_group"`
+	Ipv6RaConfigs  map[string]string `ovsdb:"ipv6_ra_configs"`
+	Options        map[string]string `ovsdb:"options"`
+	ExternalIDs    map[string]string `ovsdb:"external_ids"`
+}
+
+// nbLogicalRouterStaticRoute is a row in the Logical_Router_Static_Route table.
+type nbLogicalRouterStaticRoute struct {
+	UUID        string            `ovsdb:"_uuid"`
+	IPPrefix    string            `ovsdb:"ip_prefix"`
+	Nexthop     string            `ovsdb:"nexthop"`
+	OutputPort  *string           `ovsdb:"output_port"`
+	Policy      *string           `ovsdb:"policy"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// nbNAT is a row in the NAT table.
+type nbNAT struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Type        string            `ovsdb:"type"`
+	ExternalIP  string            `ovsdb:"external_ip"`
+	LogicalIP   string            `ovsdb:"logical_ip"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// nbLogicalSwitch is a row in the Logical_Switch table.
+type nbLogicalSwitch struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Name        string            `ovsdb:"name"`
+	Ports       []string          `ovsdb:"ports"`
+	OtherConfig map[string]string `ovsdb:"other_config"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// nbLogicalSwitchPort is a row in the Logical_Switch_Port table.
+type nbLogicalSwitchPort struct {
+	UUID             string            `ovsdb:"_uuid"`
+	Name             string            `ovsdb:"name"`
+	Type             string            `ovsdb:"type"`
+	Addresses        []string          `ovsdb:"addresses"`
+	DynamicAddresses *string           `ovsdb:"dynamic_addresses"`
+	PortSecurity     []string          `ovsdb:"port_security"`
+	Options          map[string]string `ovsdb:"options"`
+	Dhcpv4Options    *string           `ovsdb:"dhcpv4_options"`
+	Dhcpv6Options    *string           `ovsdb:"dhcpv6_options"`
+	ExternalIDs      map[string]string `ovsdb:"external_ids"`
+}
+
+// nbDHCPOptions is a row in the DHCP_Options table.
+type nbDHCPOptions struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Cidr        string            `ovsdb:"cidr"`
+	Options     map[string]string `ovsdb:"options"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// nbHAChassisGroup is a row in the HA_Chassis_Group table.
+type nbHAChassisGroup struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Name        string            `ovsdb:"name"`
+	HaChassis   []string          `ovsdb:"ha_chassis"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// nbHAChassis is a row in the HA_Chassis table.
+type nbHAChassis struct {
+	UUID        string            `ovsdb:"_uuid"`
+	ChassisName string            `ovsdb:"chassis_name"`
+	Priority    int               `ovsdb:"priority"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// nbGlobal is the single row in the NB_Global table.
+type nbGlobal struct {
+	UUID        string            `ovsdb:"_uuid"`
+	Name        string            `ovsdb:"name"`
+	Options     map[string]string `ovsdb:"options"`
+	ExternalIDs map[string]string `ovsdb:"external_ids"`
+}
+
+// nbTables maps the NB row types to their table names.
+var nbTables = map[reflect.Type]string{
+	reflect.TypeOf(nbLogicalRouter{}):            "Logical_Router",
+	reflect.TypeOf(nbLogicalRouterPort{}):        "Logical_Router_Port",
+	reflect.TypeOf(nbLogicalRouterStaticRoute{}): "Logical_Router_Static_Route",
+	reflect.TypeOf(nbNAT{}):                      "NAT",
+	reflect.TypeOf(nbLogicalSwitch{}):            "Logical_Switch",
+	reflect.TypeOf(nbLogicalSwitchPort{}):        "Logical_Switch_Port",
+	reflect.TypeOf(nbDHCPOptions{}):              "DHCP_Options",
+	reflect.TypeOf(nbHAChassisGroup{}):           "HA_Chassis_Group",
+	reflect.TypeOf(nbHAChassis{}):                "HA_Chassis",
+	reflect.TypeOf(nbGlobal{}):                   "NB_Global",
+}
+
+// nbClient provides the operations on the OVN northbound database needed to provision project networks.
+// Get functions return nil when the record doesn't exist. Create functions set the UUID of the new row, which is a
+// placeholder in dry-run mode.
+//
+// Changes are applied immediately unless Begin has been called, in which case they are queued until Commit applies
+// them all in a single transaction. Rows created in the transaction are found by the Get functions that look up rows
+// by name, but their UUIDs are only valid within the transaction until it is committed.
+type nbClient interface {
+	Begin()
+	Commit() error
+
+	// Abort discards the queued changes. It does nothing if the transaction has already been committed.
+	Abort()
+
+	GetLogicalRouters() ([]nbLogicalRouter, error)
+	GetLogicalRouter(name string) (*nbLogicalRouter, error)
+	GetLogicalRouterPort(name string) (*nbLogicalRouterPort, error)
+	GetLogicalRouterPorts(router *nbLogicalRouter) ([]nbLogicalRouterPort, error)
+	GetLogicalRouterNATs(router *nbLogicalRouter) ([]nbNAT, error)
+	GetLogicalRouterStaticRoutes(router *nbLogicalRouter) ([]nbLogicalRouterStaticRoute, error)
+	GetLogicalSwitches() ([]nbLogicalSwitch, error)
+	GetLogicalSwitch(name string) (*nbLogicalSwitch, error)
+	GetLogicalSwitchPort(name string) (*nbLogicalSwitchPort, error)
+	GetLogicalSwitchPorts(logicalSwitch *nbLogicalSwitch) ([]nbLogicalSwitchPort, error)
+	GetDHCPOptions(switchName string) ([]nbDHCPOptions, error)
+	GetHAChassisGroup(name string) (*nbHAChassisGroup, error)
+	GetHAChassis(group *nbHAChassisGroup) ([]nbHAChassis, error)
+	GetNBGlobal() (*nbGlobal, error)
+
+	CreateLogicalRouter(router *nbLogicalRouter) error
+	CreateLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error
+	CreateLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error
+	CreateNAT(router *nbLogicalRouter, nat *nbNAT) error
+	CreateLogicalSwitch(logicalSwitch *nbLogicalSwitch) error
+	CreateLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error
+	CreateDHCPOptions(opts *nbDHCPOptions) error
+	CreateHAChassisGroup(group *nbHAChassisGroup) error
+	CreateHAChassis(group *nbHAChassisGroup, chassis *nbHAChassis) error
+
+	// Update sets the named columns of an existing row (a pointer to one of the NB row types) to its values.
+	Update(row interface{}, columns ...string) error
+
+	DeleteLogicalRouter(router *nbLogicalRouter) error
+	DeleteLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error
+	DeleteLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error
+	DeleteNAT(router *nbLogicalRouter, nat *nbNAT) error
+	DeleteLogicalSwitch(logicalSwitch *nbLogicalSwitch) error
+	DeleteLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error
+	DeleteDHCPOptions(opts *nbDHCPOptions) error
+}
+
+// nb is the northbound database client used for provisioning.
+var nb nbClient
+
+// nbTxnRow is a row created in a transaction that has not been committed yet.
+type nbTxnRow struct {
+	row         interface{}
+	placeholder string
+}
+
+// nbTxn tracks the state of the transaction that queued changes will be committed in.
+type nbTxn struct {
+	active  bool
+	created []nbTxnRow
+}
+
+// create records a row created in the transaction. The placeholder is used as its UUID once committed in dry-run
+// mode.
+func (t *nbTxn) create(row interface{}, placeholder string) {
+	t.created = append(t.created, nbTxnRow{row: row, placeholder: placeholder})
+}
+
+// createdRows returns the rows in table created in the transaction whose column has the given value.
+func (t *nbTxn) createdRows(table string, column string, value string) []interface{} {
+	rows := []interface{}{}
+	for _, created := range t.created {
+		if nbTableName(created.row) != table || !nbColumnMatches(created.row, column, value) {
+			continue
+		}
+
+		rows = append(rows, created.row)
+	}
+
+	return rows
+}
+
+// getCreated populates row (a pointer to an NB row) with the first row created in the transaction whose column has
+// the given value. Returns false if there is no such row.
+func (t *nbTxn) getCreated(row interface{}, column string, value string) bool {
+	rows := t.createdRows(nbTableName(row), column, value)
+	if len(rows) == 0 {
+		return false
+	}
+
+	reflect.ValueOf(row).Elem().Set(reflect.ValueOf(rows[0]).Elem())
+	return true
+}
+
+// commit sets the UUIDs of the rows created in the transaction, using their placeholders in dry-run mode, and ends
+// the transaction.
+func (t *nbTxn) commit(uuids []string) {
+	for i, created := range t.created {
+		uuid, _ := nbField(created.row, "_uuid")
+		if dryRun {
+			uuid.SetString(created.placeholder)
+		} else {
+			uuid.SetString(uuids[i])
+		}
+	}
+
+	t.reset()
+}
+
+// reset ends the transaction.
+func (t *nbTxn) reset() {
+	t.active = false
+	t.created = nil
+}
+
+// nbTableName returns the table name of an NB row (or pointer to one).
+func nbTableName(row interface{}) string {
+	return nbTables[reflect.Indirect(reflect.ValueOf(row)).Type()]
+}
+
+// nbColumns returns the column names of an NB row type in field order.
+func nbColumns(rowType reflect.Type) []string {
+	columns := make([]string, 0, rowType.NumField())
+	for i := 0; i < rowType.NumField(); i++ {
+		columns = append(columns, rowType.Field(i).Tag.Get("ovsdb"))
+	}
+
+	return columns
+}
+
+// nbField returns the field of row (a pointer to an NB row) for the named column.
+func nbField(row interface{}, column string) (reflect.Value, error) {
+	rowVal := reflect.ValueOf(row).Elem()
+	for i := 0; i < rowVal.NumField(); i++ {
+		if rowVal.Type().Field(i).Tag.Get("ovsdb") == column {
+			return rowVal.Field(i), nil
+		}
+	}
+
+	return reflect.Value{}, fmt.Errorf("Unknown column %q in %s", column, nbTableName(row))
+}
+
+// nbCopy returns a deep copy of row (a pointer to an NB row).
+func nbCopy(row interface{}) interface{} {
+	src := reflect.ValueOf(row).Elem()
+	dst := reflect.New(src.Type())
+	for i := 0; i < src.NumField(); i++ {
+		nbCopyValue(dst.Elem().Field(i), src.Field(i))
+	}
+
+	return dst.Interface()
+}
+
+// nbCopyValue sets dst to a deep copy of the NB column value src.
+func nbCopyValue(dst reflect.Value, src reflect.Value) {
+	switch src.Kind() {
+	case reflect.Slice:
+		if !src.IsNil() {
+			dst.Set(reflect.ValueOf(append([]string{}, src.Interface().([]string)...)))
+		}
+	case reflect.Map:
+		if !src.IsNil() {
+			m := make(map[string]string, src.Len())
+			for key, value := range src.Interface().(map[string]string) {
+				m[key] = value
+			}
+
+			dst.Set(reflect.ValueOf(m))
+		}
+	case reflect.Ptr:
+		if !src.IsNil() {
+			dst.Set(reflect.New(src.Type().Elem()))
+			dst.Elem().Set(src.Elem())
+		}
+	default:
+		dst.Set(src)
+	}
+}
+
+// nbColumnMatches returns whether the named column of row (a pointer to an NB row) has the given value. Map columns
+// can be matched on a key using "column:key".
+func nbColumnMatches(row interface{}, column string, value string) bool {
+	key := ""
+	isMapKey := strings.Contains(column, ":")
+	if isMapKey {
+		parts := strings.SplitN(column, ":", 2)
+		column, key = parts[0], parts[1]
+	}
+
+	field, err := nbField(row, column)
+	if err != nil {
+		return false
+	}
+
+	if isMapKey {
+		return field.Interface().(map[string]string)[key] == value
+	}
+
+	return field.String() == value
+}
+
+// nbDiffColumns returns those of the named columns whose values differ between have and want (pointers to NB
+// rows of the same type). Sets are compared ignoring order, and empty and missing values are considered equal.
+func nbDiffColumns(have interface{}, want interface{}, columns ...string) ([]string, error) {
+	changed := []string{}
+	for _, column := range columns {
+		haveVal, err := nbField(have, column)
+		if err != nil {
+			return nil, err
+		}
+
+		wantVal, err := nbField(want, column)
+		if err != nil {
+			return nil, err
+		}
+
+		if !nbValuesEqual(haveVal, wantVal) {
+			changed = append(changed, column)
+		}
+	}
+
+	return changed, nil
+}
+
+// nbValuesEqual compares two NB column values.
+func nbValuesEqual(a reflect.Value, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Slice:
+		return stringSetsEqual(a.Interface().([]string), b.Interface().([]string))
+	case reflect.Map:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+
+		return reflect.DeepEqual(a.Interface(), b.Interface())
+	case reflect.Ptr:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+
+		return a.Elem().Interface() == b.Elem().Interface()
+	default:
+		return a.Interface() == b.Interface()
+	}
+}
+
+// stringSetsEqual returns whether a and b contain the same strings, ignoring order.
+func stringSetsEqual(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	sortedA := append([]string{}, a...)
+	sortedB := append([]string{}, b...)
+	sort.Strings(sortedA)
+	sort.Strings(sortedB)
+
+	return reflect.DeepEqual(sortedA, sortedB)
+}
@@ -0,0 +1,642 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// nbctlClient is an nbClient that runs ovn-nbctl for each operation.
+// Changes in a transaction are applied by chaining their commands in a single ovn-nbctl invocation.
+type nbctlClient struct {
+	txn      nbTxn
+	commands [][]string
+}
+
+func ovnNbctl(args ...string) (string, error) {
+	return ovnNbctlOutput("", args...)
+}
+
+// ovnNbctlOutput runs an ovn-nbctl command whose output is used by later commands. In dry-run mode the
+// placeholder is returned instead.
+func ovnNbctlOutput(placeholder string, args ...string) (string, error) {
+	return runCommandOutput(placeholder, "ovn-nbctl", append(ovnNbctlArgs(), args...)...)
+}
+
+// ovnNbctlDB returns the NB database endpoints to connect to. All members of the cluster are listed so that
+// ovn-nbctl can find the leader whichever members are down.
+func ovnNbctlDB() string {
+	return strings.Join(nbEndpoints, ",")
+}
+
+// ovnNbctlArgs returns the ovn-nbctl arguments needed to connect to the NB database. Unlike the ovsdb client, which
+// reads from any member, ovn-nbctl is told to only use the leader so that queries never see stale data from a
+// follower that is catching up.
+func ovnNbctlArgs() []string {
+	return append([]string{"--db", ovnNbctlDB(), "--leader-only"}, ovnSSL.commandArgs()...)
+}
+
+// nbctlQuery runs an ovn-nbctl database query command and decodes its JSON output into rows (a pointer to a slice
+// of NB rows). Queries are run even in dry-run mode so that the plan only contains the changes that are needed.
+func nbctlQuery(rows interface{}, args ...string) error {
+	rowsVal := reflect.ValueOf(rows).Elem()
+	rowType := rowsVal.Type().Elem()
+	columns := nbColumns(rowType)
+
+	cmdArgs := append(ovnNbctlArgs(), "--format=json", fmt.Sprintf("--columns=%s", strings.Join(columns, ",")))
+	cmdArgs = append(cmdArgs, args...)
+	output, err := runQuery("ovn-nbctl", cmdArgs...)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Headings []string            `json:"headings"`
+		Data     [][]json.RawMessage `json:"data"`
+	}{}
+
+	err = json.Unmarshal([]byte(output), &result)
+	if err != nil {
+		return fmt.Errorf("Failed parsing ovn-nbctl output: %w", err)
+	}
+
+	rowsVal.Set(reflect.MakeSlice(rowsVal.Type(), 0, len(result.Data)))
+	for _, data := range result.Data {
+		row := reflect.New(rowType).Elem()
+		for i, heading := range result.Headings {
+			for j := 0; j < rowType.NumField(); j++ {
+				if rowType.Field(j).Tag.Get("ovsdb") != heading {
+					continue
+				}
+
+				err = nbctlDecodeValue(data[i], row.Field(j))
+				if err != nil {
+					return fmt.Errorf("Failed decoding column %q: %w", heading, err)
+				}
+			}
+		}
+
+		rowsVal.Set(reflect.Append(rowsVal, row))
+	}
+
+	return nil
+}
+
+// nbctlDecodeValue decodes an OVSDB JSON value (atom, ["uuid", ...], ["set", [...]] or ["map", [...]]) into field.
+func nbctlDecodeValue(raw json.RawMessage, field reflect.Value) error {
+	var atoms []interface{}
+	var pairs [][2]interface{}
+
+	var value interface{}
+	err := json.Unmarshal(raw, &value)
+	if err != nil {
+		return err
+	}
+
+	list, isList := value.([]interface{})
+	if isList && len(list) == 2 && list[0] == "map" {
+		mapList, _ := list[1].([]interface{})
+		for _, pair := range mapList {
+			kv, ok := pair.([]interface{})
+			if !ok || len(kv) != 2 {
+				return fmt.Errorf("Invalid map pair %v", pair)
+			}
+
+			pairs = append(pairs, [2]interface{}{nbctlAtom(kv[0]), nbctlAtom(kv[1])})
+		}
+	} else if isList && len(list) == 2 && list[0] == "set" {
+		setList, _ := list[1].([]interface{})
+		for _, atom := range setList {
+			atoms = append(atoms, nbctlAtom(atom))
+		}
+	} else {
+		atoms = append(atoms, nbctlAtom(value))
+	}
+
+	switch field.Kind() {
+	case reflect.Map:
+		m := make(map[string]string, len(pairs))
+		for _, pair := range pairs {
+			m[fmt.Sprint(pair[0])] = fmt.Sprint(pair[1])
+		}
+
+		field.Set(reflect.ValueOf(m))
+	case reflect.Slice:
+		s := make([]string, 0, len(atoms))
+		for _, atom := range atoms {
+			s = append(s, fmt.Sprint(atom))
+		}
+
+		field.Set(reflect.ValueOf(s))
+	case reflect.Ptr:
+		if len(atoms) > 0 {
+			s := fmt.Sprint(atoms[0])
+			field.Set(reflect.ValueOf(&s))
+		}
+	case reflect.String:
+		if len(atoms) > 0 {
+			field.SetString(fmt.Sprint(atoms[0]))
+		}
+	case reflect.Int:
+		if len(atoms) > 0 {
+			f, ok := atoms[0].(float64)
+			if !ok {
+				return fmt.Errorf("Invalid integer %v", atoms[0])
+			}
+
+			field.SetInt(int64(f))
+		}
+	default:
+		return fmt.Errorf("Unsupported field type %v", field.Type())
+	}
+
+	return nil
+}
+
+// nbctlAtom returns the value of an OVSDB JSON atom, unwrapping ["uuid", ...] and ["named-uuid", ...] values.
+func nbctlAtom(value interface{}) interface{} {
+	list, isList := value.([]interface{})
+	if isList && len(list) == 2 && (list[0] == "uuid" || list[0] == "named-uuid") {
+		return list[1]
+	}
+
+	return value
+}
+
+// nbctlUUID matches a record UUID, which must not be quoted when used as a reference.
+var nbctlUUID = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// nbctlEncodeAtom encodes a string in the database syntax understood by ovn-nbctl. Strings are always quoted so
+// that values such as the quoted DHCP domain_name option are escaped properly. References to other records (UUIDs,
+// @names and dry-run placeholders) are left as is.
+func nbctlEncodeAtom(s string) string {
+	if nbctlUUID.MatchString(s) || strings.HasPrefix(s, "@") || (strings.HasPrefix(s, "<") && strings.HasSuffix(s, ">")) {
+		return s
+	}
+
+	quoted := &strings.Builder{}
+	encoder := json.NewEncoder(quoted)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(s)
+
+	return strings.TrimSuffix(quoted.String(), "\n")
+}
+
+// nbctlEncodeValue encodes a column value in the database syntax understood by ovn-nbctl's create and set commands.
+func nbctlEncodeValue(value reflect.Value) string {
+	switch value.Kind() {
+	case reflect.Slice:
+		items := []string{}
+		for _, item := range value.Interface().([]string) {
+			items = append(items, nbctlEncodeAtom(item))
+		}
+
+		return fmt.Sprintf("[%s]", strings.Join(items, ","))
+	case reflect.Map:
+		m := value.Interface().(map[string]string)
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		pairs := []string{}
+		for _, key := range keys {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", nbctlEncodeAtom(key), nbctlEncodeAtom(m[key])))
+		}
+
+		return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+	case reflect.Ptr:
+		if value.IsNil() {
+			return "[]"
+		}
+
+		return nbctlEncodeAtom(value.Elem().String())
+	case reflect.Int:
+		return strconv.FormatInt(value.Int(), 10)
+	default:
+		return nbctlEncodeAtom(value.String())
+	}
+}
+
+// nbctlColumnArgs returns the column=value arguments for the named columns of row. If no columns are named then all
+// columns with non-empty values are returned.
+func nbctlColumnArgs(row interface{}, columns ...string) ([]string, error) {
+	if len(columns) == 0 {
+		for _, column := range nbColumns(reflect.TypeOf(row).Elem()) {
+			value, _ := nbField(row, column)
+			if column == "_uuid" || value.IsZero() {
+				continue
+			}
+
+			if (value.Kind() == reflect.Slice || value.Kind() == reflect.Map) && value.Len() == 0 {
+				continue
+			}
+
+			columns = append(columns, column)
+		}
+	}
+
+	args := make([]string, 0, len(columns))
+	for _, column := range columns {
+		value, err := nbField(row, column)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, fmt.Sprintf("%s=%s", column, nbctlEncodeValue(value)))
+	}
+
+	return args, nil
+}
+
+// nbctlGet populates row (a pointer to an NB row) with the record matching conditions.
+// Returns false if there is no such record.
+func nbctlGet(row interface{}, conditions ...string) (bool, error) {
+	rows := reflect.New(reflect.SliceOf(reflect.TypeOf(row).Elem()))
+	err := nbctlQuery(rows.Interface(), append([]string{"find", nbTableName(row)}, conditions...)...)
+	if err != nil {
+		return false, err
+	}
+
+	if rows.Elem().Len() == 0 {
+		return false, nil
+	}
+
+	reflect.ValueOf(row).Elem().Set(rows.Elem().Index(0))
+	return true, nil
+}
+
+// nbctlList populates rows (a pointer to a slice of NB rows) with the records identified by UUIDs.
+func nbctlList(rows interface{}, uuids ...string) error {
+	// Listing without any records would return the whole table.
+	if len(uuids) == 0 {
+		return nil
+	}
+
+	table := nbTables[reflect.TypeOf(rows).Elem().Elem()]
+	return nbctlQuery(rows, append([]string{"list", table}, uuids...)...)
+}
+
+// nbctlRecord returns the identifier of row to use in ovn-nbctl commands. Rows created in the current transaction
+// are referred to by name, as their UUIDs aren't known until it is committed.
+func nbctlRecord(row interface{}) string {
+	uuid, _ := nbField(row, "_uuid")
+	if !strings.HasPrefix(uuid.String(), "@") {
+		return uuid.String()
+	}
+
+	// Rows without a name, such as DHCP options, can only be referred to by UUID.
+	name, err := nbField(row, "name")
+	if err != nil {
+		return uuid.String()
+	}
+
+	return name.String()
+}
+
+// Begin starts queueing changes until Commit is called.
+func (c *nbctlClient) Begin() {
+	c.txn.active = true
+}
+
+// Commit runs the queued commands in a single ovn-nbctl invocation, which applies them in one transaction.
+func (c *nbctlClient) Commit() error {
+	commands := c.commands
+	c.commands = nil
+
+	if len(commands) == 0 {
+		c.txn.reset()
+		return nil
+	}
+
+	args := []string{}
+	for i, command := range commands {
+		if i > 0 {
+			args = append(args, "--")
+		}
+
+		args = append(args, command...)
+	}
+
+	output, err := ovnNbctl(args...)
+	if err != nil {
+		c.txn.reset()
+		return err
+	}
+
+	// Each create command outputs the UUID of its record.
+	uuids := strings.Fields(output)
+	if !dryRun && len(uuids) != len(c.txn.created) {
+		c.txn.reset()
+		return fmt.Errorf("Expected %d UUIDs in ovn-nbctl output, got %q", len(c.txn.created), output)
+	}
+
+	c.txn.commit(uuids)
+	return nil
+}
+
+// Abort discards the queued commands.
+func (c *nbctlClient) Abort() {
+	c.commands = nil
+	c.txn.reset()
+}
+
+// queue adds commands to the transaction, committing them straight away if no transaction has been begun.
+func (c *nbctlClient) queue(commands ...[]string) error {
+	c.commands = append(c.commands, commands...)
+	if c.txn.active {
+		return nil
+	}
+
+	return c.Commit()
+}
+
+// get populates row (a pointer to an NB row) with the record whose column has the given value, including rows
+// created in the current transaction. Returns false if there is no such record.
+func (c *nbctlClient) get(row interface{}, column string, value string) (bool, error) {
+	found, err := nbctlGet(row, fmt.Sprintf("%s=%s", column, nbctlEncodeAtom(value)))
+	if err != nil || found {
+		return found, err
+	}
+
+	return c.txn.getCreated(row, column, value), nil
+}
+
+// create creates row and sets its UUID. When parent is not nil the new row is added to the parent's column, as is
+// required for rows in non-root tables.
+func (c *nbctlClient) create(row interface{}, placeholder string, parent interface{}, parentColumn string) error {
+	columnArgs, err := nbctlColumnArgs(row)
+	if err != nil {
+		return err
+	}
+
+	id := fmt.Sprintf("@row%d", len(c.txn.created))
+	uuid, _ := nbField(row, "_uuid")
+	uuid.SetString(id)
+	c.txn.create(row, placeholder)
+
+	commands := [][]string{append([]string{fmt.Sprintf("--id=%s", id), "create", nbTableName(row)}, columnArgs...)}
+	if parent != nil {
+		commands = append(commands, []string{"add", nbTableName(parent), nbctlRecord(parent), parentColumn, id})
+	}
+
+	return c.queue(commands...)
+}
+
+// GetLogicalRouters returns all logical routers.
+func (c *nbctlClient) GetLogicalRouters() ([]nbLogicalRouter, error) {
+	routers := []nbLogicalRouter{}
+	err := nbctlQuery(&routers, "list", "Logical_Router")
+	if err != nil {
+		return nil, err
+	}
+
+	return routers, nil
+}
+
+// GetLogicalRouter returns the logical router with the given name.
+func (c *nbctlClient) GetLogicalRouter(name string) (*nbLogicalRouter, error) {
+	router := &nbLogicalRouter{}
+	found, err := c.get(router, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return router, nil
+}
+
+// GetLogicalRouterPort returns the logical router port with the given name.
+func (c *nbctlClient) GetLogicalRouterPort(name string) (*nbLogicalRouterPort, error) {
+	port := &nbLogicalRouterPort{}
+	found, err := c.get(port, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return port, nil
+}
+
+// GetLogicalRouterPorts returns the ports of a logical router.
+func (c *nbctlClient) GetLogicalRouterPorts(router *nbLogicalRouter) ([]nbLogicalRouterPort, error) {
+	ports := []nbLogicalRouterPort{}
+	err := nbctlList(&ports, router.Ports...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ports, nil
+}
+
+// GetLogicalRouterNATs returns the NAT rules of a logical router.
+func (c *nbctlClient) GetLogicalRouterNATs(router *nbLogicalRouter) ([]nbNAT, error) {
+	nats := []nbNAT{}
+	err := nbctlList(&nats, router.Nat...)
+	if err != nil {
+		return nil, err
+	}
+
+	return nats, nil
+}
+
+// GetLogicalRouterStaticRoutes returns the static routes of a logical router.
+func (c *nbctlClient) GetLogicalRouterStaticRoutes(router *nbLogicalRouter) ([]nbLogicalRouterStaticRoute, error) {
+	routes := []nbLogicalRouterStaticRoute{}
+	err := nbctlList(&routes, router.StaticRoutes...)
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// GetLogicalSwitches returns all logical switches.
+func (c *nbctlClient) GetLogicalSwitches() ([]nbLogicalSwitch, error) {
+	switches := []nbLogicalSwitch{}
+	err := nbctlQuery(&switches, "list", "Logical_Switch")
+	if err != nil {
+		return nil, err
+	}
+
+	return switches, nil
+}
+
+// GetLogicalSwitch returns the logical switch with the given name.
+func (c *nbctlClient) GetLogicalSwitch(name string) (*nbLogicalSwitch, error) {
+	logicalSwitch := &nbLogicalSwitch{}
+	found, err := c.get(logicalSwitch, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return logicalSwitch, nil
+}
+
+// GetLogicalSwitchPort returns the logical switch port with the given name.
+func (c *nbctlClient) GetLogicalSwitchPort(name string) (*nbLogicalSwitchPort, error) {
+	port := &nbLogicalSwitchPort{}
+	found, err := c.get(port, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return port, nil
+}
+
+// GetLogicalSwitchPorts returns the ports of a logical switch.
+func (c *nbctlClient) GetLogicalSwitchPorts(logicalSwitch *nbLogicalSwitch) ([]nbLogicalSwitchPort, error) {
+	ports := []nbLogicalSwitchPort{}
+	err := nbctlList(&ports, logicalSwitch.Ports...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ports, nil
+}
+
+// GetDHCPOptions returns the DHCP options associated to a logical switch.
+func (c *nbctlClient) GetDHCPOptions(switchName string) ([]nbDHCPOptions, error) {
+	opts := []nbDHCPOptions{}
+	err := nbctlQuery(&opts, "find", "DHCP_Options", fmt.Sprintf("external_ids:lxd_network=%s", nbctlEncodeAtom(switchName)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, created := range c.txn.createdRows("DHCP_Options", "external_ids:lxd_network", switchName) {
+		opts = append(opts, *created.(*nbDHCPOptions))
+	}
+
+	return opts, nil
+}
+
+// GetHAChassisGroup returns the HA chassis group with the given name.
+func (c *nbctlClient) GetHAChassisGroup(name string) (*nbHAChassisGroup, error) {
+	group := &nbHAChassisGroup{}
+	found, err := c.get(group, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// GetHAChassis returns the members of an HA chassis group.
+func (c *nbctlClient) GetHAChassis(group *nbHAChassisGroup) ([]nbHAChassis, error) {
+	chassis := []nbHAChassis{}
+	err := nbctlList(&chassis, group.HaChassis...)
+	if err != nil {
+		return nil, err
+	}
+
+	return chassis, nil
+}
+
+// GetNBGlobal returns the NB_Global row.
+func (c *nbctlClient) GetNBGlobal() (*nbGlobal, error) {
+	globals := []nbGlobal{}
+	err := nbctlQuery(&globals, "list", "NB_Global")
+	if err != nil || len(globals) == 0 {
+		return nil, err
+	}
+
+	return &globals[0], nil
+}
+
+// CreateLogicalRouter creates a logical router.
+func (c *nbctlClient) CreateLogicalRouter(router *nbLogicalRouter) error {
+	return c.create(router, dryRunUUID("logical_router", router.Name), nil, "")
+}
+
+// CreateLogicalRouterPort creates a port on a logical router.
+func (c *nbctlClient) CreateLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	return c.create(port, dryRunUUID("logical_router_port", port.Name), router, "ports")
+}
+
+// CreateLogicalRouterStaticRoute adds a static route to a logical router.
+func (c *nbctlClient) CreateLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	return c.create(route, dryRunUUID("logical_router_static_route", route.IPPrefix), router, "static_routes")
+}
+
+// CreateNAT adds a NAT rule to a logical router.
+func (c *nbctlClient) CreateNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	return c.create(nat, dryRunUUID("nat", nat.LogicalIP), router, "nat")
+}
+
+// CreateLogicalSwitch creates a logical switch.
+func (c *nbctlClient) CreateLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	return c.create(logicalSwitch, dryRunUUID("logical_switch", logicalSwitch.Name), nil, "")
+}
+
+// CreateLogicalSwitchPort creates a port on a logical switch.
+func (c *nbctlClient) CreateLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	return c.create(port, dryRunUUID("logical_switch_port", port.Name), logicalSwitch, "ports")
+}
+
+// CreateDHCPOptions creates DHCP options.
+func (c *nbctlClient) CreateDHCPOptions(opts *nbDHCPOptions) error {
+	return c.create(opts, dryRunUUID("dhcp_options", opts.Cidr), nil, "")
+}
+
+// CreateHAChassisGroup creates an HA chassis group.
+func (c *nbctlClient) CreateHAChassisGroup(group *nbHAChassisGroup) error {
+	return c.create(group, dryRunUUID("ha_chassis_group", group.Name), nil, "")
+}
+
+// CreateHAChassis adds a chassis to an HA chassis group.
+func (c *nbctlClient) CreateHAChassis(group *nbHAChassisGroup, chassis *nbHAChassis) error {
+	return c.create(chassis, dryRunUUID("ha_chassis", chassis.ChassisName), group, "ha_chassis")
+}
+
+// Update sets the named columns of an existing row.
+func (c *nbctlClient) Update(row interface{}, columns ...string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+
+	columnArgs, err := nbctlColumnArgs(row, columns...)
+	if err != nil {
+		return err
+	}
+
+	return c.queue(append([]string{"set", nbTableName(row), nbctlRecord(row)}, columnArgs...))
+}
+
+// DeleteLogicalRouter deletes a logical router along with its ports, routes and NAT rules.
+func (c *nbctlClient) DeleteLogicalRouter(router *nbLogicalRouter) error {
+	return c.queue([]string{"destroy", "Logical_Router", nbctlRecord(router)})
+}
+
+// DeleteLogicalRouterPort removes a port from a logical router.
+func (c *nbctlClient) DeleteLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	return c.queue([]string{"remove", "Logical_Router", nbctlRecord(router), "ports", port.UUID})
+}
+
+// DeleteLogicalRouterStaticRoute removes a static route from a logical router.
+func (c *nbctlClient) DeleteLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	return c.queue([]string{"remove", "Logical_Router", nbctlRecord(router), "static_routes", route.UUID})
+}
+
+// DeleteNAT removes a NAT rule from a logical router.
+func (c *nbctlClient) DeleteNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	return c.queue([]string{"remove", "Logical_Router", nbctlRecord(router), "nat", nat.UUID})
+}
+
+// DeleteLogicalSwitch deletes a logical switch along with its ports.
+func (c *nbctlClient) DeleteLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	return c.queue([]string{"destroy", "Logical_Switch", nbctlRecord(logicalSwitch)})
+}
+
+// DeleteLogicalSwitchPort removes a port from a logical switch.
+func (c *nbctlClient) DeleteLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	return c.queue([]string{"remove", "Logical_Switch", nbctlRecord(logicalSwitch), "ports", port.UUID})
+}
+
+// DeleteDHCPOptions deletes DHCP options.
+func (c *nbctlClient) DeleteDHCPOptions(opts *nbDHCPOptions) error {
+	return c.queue([]string{"destroy", "DHCP_Options", nbctlRecord(opts)})
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/go-logr/stdr"
+	"github.com/lxc/lxd/shared"
+	"github.com/ovn-org/libovsdb/client"
+	"github.com/ovn-org/libovsdb/model"
+	"github.com/ovn-org/libovsdb/ovsdb"
+)
+
+// ovsdbTimeout is how long to wait for a single request to the NB database.
+const ovsdbTimeout = 30 * time.Second
+
+// ovsdbClient is an nbClient that talks to the NB database directly over the OVSDB protocol.
+// Reads are served from a local cache of the whole database, kept up to date by a monitor.
+type ovsdbClient struct {
+	endpoint string // The endpoint of the cluster leader, which all changes are sent to.
+	client   client.Client
+
+	txn     nbTxn
+	ops     []ovsdb.Operation
+	inserts []int       // Index in ops of the insert operation of each row in txn.created.
+	waits   []ovsdbWait // Changes the cache must reflect once the transaction is committed.
+}
+
+// ovsdbWait is a change to a row that the cache must reflect before later reads can see it.
+type ovsdbWait struct {
+	row  interface{} // A row of the changed table, used for its type.
+	uuid string      // The UUID of the changed row, a named UUID if it is created in the same transaction.
+
+	// done reports whether cached, the cached copy of the row or nil if it isn't cached, reflects the change.
+	// Named UUIDs are resolved with resolve.
+	done func(cached interface{}, resolve func(string) string) bool
+}
+
+// newOVSDBClient connects to the leader of the NB database cluster whose members are at endpoints, and starts
+// monitoring it. Members that aren't the leader are skipped. SSL endpoints require tlsConfig.
+func newOVSDBClient(endpoints []string, tlsConfig *tls.Config) (*ovsdbClient, error) {
+	models := make(map[string]model.Model, len(nbTables))
+	for rowType, table := range nbTables {
+		models[table] = reflect.New(rowType).Interface()
+	}
+
+	dbModel, err := model.NewClientDBModel("OVN_Northbound", models)
+	if err != nil {
+		return nil, err
+	}
+
+	// The default logger of the client is very verbose, so only log errors.
+	logger := stdr.New(log.New(os.Stderr, "", log.LstdFlags)).WithName("libovsdb")
+
+	options := []client.Option{client.WithLeaderOnly(true), client.WithLogger(&logger)}
+	for _, endpoint := range endpoints {
+		options = append(options, client.WithEndpoint(endpoint))
+	}
+
+	if tlsConfig != nil {
+		options = append(options, client.WithTLSConfig(tlsConfig))
+	}
+
+	c, err := client.NewOVSDBClient(dbModel, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ovsdbTimeout)
+	defer cancel()
+
+	err = c.Connect(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Failed connecting to NB database %q: %w", strings.Join(endpoints, ","), err)
+	}
+
+	_, err = c.MonitorAll(ctx)
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("Failed monitoring NB database %q: %w", c.CurrentEndpoint(), err)
+	}
+
+	return &ovsdbClient{endpoint: c.CurrentEndpoint(), client: c}, nil
+}
+
+// Close disconnects from the NB database.
+func (c *ovsdbClient) Close() {
+	c.client.Close()
+}
+
+// Begin starts queueing changes until Commit is called.
+func (c *ovsdbClient) Begin() {
+	c.txn.active = true
+}
+
+// Commit applies the queued operations in a single transaction. In dry-run mode the transaction is recorded in the
+// plan instead, in the form accepted by ovsdb-client.
+func (c *ovsdbClient) Commit() error {
+	ops := c.ops
+	inserts := c.inserts
+	waits := c.waits
+	c.ops = nil
+	c.inserts = nil
+	c.waits = nil
+
+	if len(ops) == 0 {
+		c.txn.reset()
+		return nil
+	}
+
+	if dryRun {
+		request, err := json.Marshal(append([]interface{}{"OVN_Northbound"}, opsToInterfaces(ops)...))
+		if err != nil {
+			c.txn.reset()
+			return err
+		}
+
+		plan = append(plan, quoteCommand("ovsdb-client", append(ovnSSL.commandArgs(), "transact", c.endpoint, string(request))...))
+		c.txn.commit(nil)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ovsdbTimeout)
+	defer cancel()
+
+	results, err := c.client.Transact(ctx, ops...)
+	if err == nil {
+		_, err = ovsdb.CheckOperationResults(results, ops)
+	}
+
+	if err != nil {
+		c.txn.reset()
+		return fmt.Errorf("Failed committing NB transaction: %w", err)
+	}
+
+	uuids := make([]string, 0, len(inserts))
+	namedUUIDs := make(map[string]string, len(inserts))
+	for n, i := range inserts {
+		uuids = append(uuids, results[i].UUID.GoUUID)
+		namedUUIDs[fmt.Sprintf("row%d", n)] = results[i].UUID.GoUUID
+	}
+
+	c.txn.commit(uuids)
+
+	resolve := func(uuid string) string {
+		realUUID, found := namedUUIDs[uuid]
+		if found {
+			return realUUID
+		}
+
+		return uuid
+	}
+
+	for _, wait := range waits {
+		err = c.waitCache(wait, resolve)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Abort discards the queued operations.
+func (c *ovsdbClient) Abort() {
+	c.ops = nil
+	c.inserts = nil
+	c.waits = nil
+	c.txn.reset()
+}
+
+// queue adds ops to the transaction, committing them straight away if no transaction has been begun.
+func (c *ovsdbClient) queue(ops ...ovsdb.Operation) error {
+	c.ops = append(c.ops, ops...)
+	if c.txn.active {
+		return nil
+	}
+
+	return c.Commit()
+}
+
+// opsToInterfaces converts ops for encoding as the parameters of a transact request.
+func opsToInterfaces(ops []ovsdb.Operation) []interface{} {
+	values := make([]interface{}, 0, len(ops))
+	for _, op := range ops {
+		values = append(values, op)
+	}
+
+	return values
+}
+
+// list populates rows (a pointer to a slice of NB rows) with the cached rows matching a condition.
+func (c *ovsdbClient) list(rows interface{}, condition client.ConditionalAPI) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ovsdbTimeout)
+	defer cancel()
+
+	return condition.List(ctx, rows)
+}
+
+// get populates row (a pointer to an NB row) with the cached row whose column has the given value, including rows
+// created in the current transaction. Returns false if there is no such row.
+func (c *ovsdbClient) get(row model.Model, column string, value string) (bool, error) {
+	field, err := nbField(row, column)
+	if err != nil {
+		return false, err
+	}
+
+	rows := reflect.New(reflect.SliceOf(reflect.TypeOf(row).Elem()))
+	err = c.list(rows.Interface(), c.client.WhereAll(row, model.Condition{
+		Field:    field.Addr().Interface(),
+		Function: ovsdb.ConditionEqual,
+		Value:    value,
+	}))
+	if err != nil {
+		return false, err
+	}
+
+	if rows.Elem().Len() == 0 {
+		return c.txn.getCreated(row, column, value), nil
+	}
+
+	reflect.ValueOf(row).Elem().Set(rows.Elem().Index(0))
+	return true, nil
+}
+
+// create creates row and sets its UUID. When parent is not nil the new row is also inserted into the parent's
+// column, as is required for rows in non-root tables.
+func (c *ovsdbClient) create(row model.Model, placeholder string, parent model.Model, parentColumn string) error {
+	// Refer to the new row by a named UUID until the transaction is committed.
+	namedUUID := fmt.Sprintf("row%d", len(c.txn.created))
+	uuid, _ := nbField(row, "_uuid")
+	uuid.SetString(namedUUID)
+
+	ops, err := c.client.Create(row)
+	if err != nil {
+		return err
+	}
+
+	c.waits = append(c.waits, ovsdbWait{row: row, uuid: namedUUID, done: func(cached interface{}, resolve func(string) string) bool {
+		return cached != nil
+	}})
+
+	if parent != nil {
+		ops = append(ops, ovsdbMutateSet(parent, parentColumn, ovsdb.MutateOperationInsert, namedUUID))
+		c.waitSetMember(parent, parentColumn, namedUUID, true)
+	}
+
+	c.txn.create(row, placeholder)
+	c.inserts = append(c.inserts, len(c.ops))
+	return c.queue(ops...)
+}
+
+// waitCache waits for the cache, which is updated asynchronously, to reflect a committed change, so that later reads
+// see it.
+func (c *ovsdbClient) waitCache(wait ovsdbWait, resolve func(string) string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ovsdbTimeout)
+	defer cancel()
+
+	uuid := resolve(wait.uuid)
+	cached := reflect.New(reflect.TypeOf(wait.row).Elem()).Interface()
+	cachedUUID, _ := nbField(cached, "_uuid")
+
+	for {
+		// Get overwrites the row it is given, so the UUID is set again each time round.
+		cachedUUID.SetString(uuid)
+		err := c.client.Get(ctx, cached)
+		if err == nil && wait.done(cached, resolve) {
+			return nil
+		}
+
+		if err == client.ErrNotFound && wait.done(nil, resolve) {
+			return nil
+		}
+
+		if err != nil && err != client.ErrNotFound {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Timed out waiting for %s %q to be updated: %w", nbTableName(wait.row), uuid, ctx.Err())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// waitSetMember waits, once the transaction is committed, for the cache to show the row with the given UUID in (or
+// not in) a set column of parent. If the parent is deleted in the same transaction there is nothing to wait for.
+func (c *ovsdbClient) waitSetMember(parent model.Model, column string, uuid string, member bool) {
+	parentUUID, _ := nbField(parent, "_uuid")
+	c.waits = append(c.waits, ovsdbWait{row: parent, uuid: parentUUID.String(), done: func(cached interface{}, resolve func(string) string) bool {
+		if cached == nil {
+			return true
+		}
+
+		members, _ := nbField(cached, column)
+		return shared.StringInSlice(resolve(uuid), members.Interface().([]string)) == member
+	}})
+}
+
+// removeChild removes a row in a non-root table from its parent's column. The row itself is garbage collected by the
+// database once it is no longer referenced.
+func (c *ovsdbClient) removeChild(parent model.Model, parentColumn string, childUUID string) error {
+	c.waitSetMember(parent, parentColumn, childUUID, false)
+	return c.queue(ovsdbMutateSet(parent, parentColumn, ovsdb.MutateOperationDelete, childUUID))
+}
+
+// ovsdbMutateSet returns an operation that inserts or deletes a UUID in a set column of row. The operation is built
+// by hand rather than with the client's Mutate, as the row may only exist in the current transaction, in which case
+// its UUID is a named UUID that the client can't look up.
+func ovsdbMutateSet(row model.Model, column string, mutator ovsdb.Mutator, uuid string) ovsdb.Operation {
+	rowUUID, _ := nbField(row, "_uuid")
+
+	return ovsdb.Operation{
+		Op:    ovsdb.OperationMutate,
+		Table: nbTableName(row),
+		Mutations: []ovsdb.Mutation{{
+			Column:  column,
+			Mutator: mutator,
+			Value:   ovsdb.OvsSet{GoSet: []interface{}{ovsdb.UUID{GoUUID: uuid}}},
+		}},
+		Where: []ovsdb.Condition{{
+			Column:   "_uuid",
+			Function: ovsdb.ConditionEqual,
+			Value:    ovsdb.UUID{GoUUID: rowUUID.String()},
+		}},
+	}
+}
+
+// destroy deletes a row in a root table.
+func (c *ovsdbClient) destroy(row model.Model) error {
+	ops, err := c.client.Where(row).Delete()
+	if err != nil {
+		return err
+	}
+
+	uuid, _ := nbField(row, "_uuid")
+	c.waits = append(c.waits, ovsdbWait{row: row, uuid: uuid.String(), done: func(cached interface{}, resolve func(string) string) bool {
+		return cached == nil
+	}})
+
+	return c.queue(ops...)
+}
+
+// GetLogicalRouters returns all logical routers.
+func (c *ovsdbClient) GetLogicalRouters() ([]nbLogicalRouter, error) {
+	routers := []nbLogicalRouter{}
+	err := c.list(&routers, c.client.WhereCache(func(router *nbLogicalRouter) bool { return true }))
+	if err != nil {
+		return nil, err
+	}
+
+	return routers, nil
+}
+
+// GetLogicalRouter returns the logical router with the given name.
+func (c *ovsdbClient) GetLogicalRouter(name string) (*nbLogicalRouter, error) {
+	router := &nbLogicalRouter{}
+	found, err := c.get(router, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return router, nil
+}
+
+// GetLogicalRouterPort returns the logical router port with the given name.
+func (c *ovsdbClient) GetLogicalRouterPort(name string) (*nbLogicalRouterPort, error) {
+	port := &nbLogicalRouterPort{}
+	found, err := c.get(port, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return port, nil
+}
+
+// GetLogicalRouterPorts returns the ports of a logical router.
+func (c *ovsdbClient) GetLogicalRouterPorts(router *nbLogicalRouter) ([]nbLogicalRouterPort, error) {
+	ports := []nbLogicalRouterPort{}
+	err := c.list(&ports, c.client.WhereCache(func(port *nbLogicalRouterPort) bool {
+		return shared.StringInSlice(port.UUID, router.Ports)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return ports, nil
+}
+
+// GetLogicalRouterNATs returns the NAT rules of a logical router.
+func (c *ovsdbClient) GetLogicalRouterNATs(router *nbLogicalRouter) ([]nbNAT, error) {
+	nats := []nbNAT{}
+	err := c.list(&nats, c.client.WhereCache(func(nat *nbNAT) bool { return shared.StringInSlice(nat.UUID, router.Nat) }))
+	if err != nil {
+		return nil, err
+	}
+
+	return nats, nil
+}
+
+// GetLogicalRouterStaticRoutes returns the static routes of a logical router.
+func (c *ovsdbClient) GetLogicalRouterStaticRoutes(router *nbLogicalRouter) ([]nbLogicalRouterStaticRoute, error) {
+	routes := []nbLogicalRouterStaticRoute{}
+	err := c.list(&routes, c.client.WhereCache(func(route *nbLogicalRouterStaticRoute) bool {
+		return shared.StringInSlice(route.UUID, router.StaticRoutes)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+// GetLogicalSwitches returns all logical switches.
+func (c *ovsdbClient) GetLogicalSwitches() ([]nbLogicalSwitch, error) {
+	switches := []nbLogicalSwitch{}
+	err := c.list(&switches, c.client.WhereCache(func(logicalSwitch *nbLogicalSwitch) bool { return true }))
+	if err != nil {
+		return nil, err
+	}
+
+	return switches, nil
+}
+
+// GetLogicalSwitch returns the logical switch with the given name.
+func (c *ovsdbClient) GetLogicalSwitch(name string) (*nbLogicalSwitch, error) {
+	logicalSwitch := &nbLogicalSwitch{}
+	found, err := c.get(logicalSwitch, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return logicalSwitch, nil
+}
+
+// GetLogicalSwitchPort returns the logical switch port with the given name.
+func (c *ovsdbClient) GetLogicalSwitchPort(name string) (*nbLogicalSwitchPort, error) {
+	port := &nbLogicalSwitchPort{}
+	found, err := c.get(port, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return port, nil
+}
+
+// GetLogicalSwitchPorts returns the ports of a logical switch.
+func (c *ovsdbClient) GetLogicalSwitchPorts(logicalSwitch *nbLogicalSwitch) ([]nbLogicalSwitchPort, error) {
+	ports := []nbLogicalSwitchPort{}
+	err := c.list(&ports, c.client.WhereCache(func(port *nbLogicalSwitchPort) bool {
+		return shared.StringInSlice(port.UUID, logicalSwitch.Ports)
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return ports, nil
+}
+
+// GetDHCPOptions returns the DHCP options associated to a logical switch.
+func (c *ovsdbClient) GetDHCPOptions(switchName string) ([]nbDHCPOptions, error) {
+	opts := []nbDHCPOptions{}
+	err := c.list(&opts, c.client.WhereCache(func(opt *nbDHCPOptions) bool { return opt.ExternalIDs["lxd_network"] == switchName }))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, created := range c.txn.createdRows("DHCP_Options", "external_ids:lxd_network", switchName) {
+		opts = append(opts, *created.(*nbDHCPOptions))
+	}
+
+	return opts, nil
+}
+
+// GetHAChassisGroup returns the HA chassis group with the given name.
+func (c *ovsdbClient) GetHAChassisGroup(name string) (*nbHAChassisGroup, error) {
+	group := &nbHAChassisGroup{}
+	found, err := c.get(group, "name", name)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// GetHAChassis returns the members of an HA chassis group.
+func (c *ovsdbClient) GetHAChassis(group *nbHAChassisGroup) ([]nbHAChassis, error) {
+	chassis := []nbHAChassis{}
+	err := c.list(&chassis, c.client.WhereCache(func(member *nbHAChassis) bool { return shared.StringInSlice(member.UUID, group.HaChassis) }))
+	if err != nil {
+		return nil, err
+	}
+
+	return chassis, nil
+}
+
+// GetNBGlobal returns the NB_Global row.
+func (c *ovsdbClient) GetNBGlobal() (*nbGlobal, error) {
+	globals := []nbGlobal{}
+	err := c.list(&globals, c.client.WhereCache(func(global *nbGlobal) bool { return true }))
+	if err != nil || len(globals) == 0 {
+		return nil, err
+	}
+
+	return &globals[0], nil
+}
+
+// CreateLogicalRouter creates a logical router.
+func (c *ovsdbClient) CreateLogicalRouter(router *nbLogicalRouter) error {
+	return c.create(router, dryRunUUID("logical_router", router.Name), nil, "")
+}
+
+// CreateLogicalRouterPort creates a port on a logical router.
+func (c *ovsdbClient) CreateLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	return c.create(port, dryRunUUID("logical_router_port", port.Name), router, "ports")
+}
+
+// CreateLogicalRouterStaticRoute adds a static route to a logical router.
+func (c *ovsdbClient) CreateLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	return c.create(route, dryRunUUID("logical_router_static_route", route.IPPrefix), router, "static_routes")
+}
+
+// CreateNAT adds a NAT rule to a logical router.
+func (c *ovsdbClient) CreateNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	return c.create(nat, dryRunUUID("nat", nat.LogicalIP), router, "nat")
+}
+
+// CreateLogicalSwitch creates a logical switch.
+func (c *ovsdbClient) CreateLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	return c.create(logicalSwitch, dryRunUUID("logical_switch", logicalSwitch.Name), nil, "")
+}
+
+// CreateLogicalSwitchPort creates a port on a logical switch.
+func (c *ovsdbClient) CreateLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	return c.create(port, dryRunUUID("logical_switch_port", port.Name), logicalSwitch, "ports")
+}
+
+// CreateDHCPOptions creates DHCP options.
+func (c *ovsdbClient) CreateDHCPOptions(opts *nbDHCPOptions) error {
+	return c.create(opts, dryRunUUID("dhcp_options", opts.Cidr), nil, "")
+}
+
+// CreateHAChassisGroup creates an HA chassis group.
+func (c *ovsdbClient) CreateHAChassisGroup(group *nbHAChassisGroup) error {
+	return c.create(group, dryRunUUID("ha_chassis_group", group.Name), nil, "")
+}
+
+// CreateHAChassis adds a chassis to an HA chassis group.
+func (c *ovsdbClient) CreateHAChassis(group *nbHAChassisGroup, chassis *nbHAChassis) error {
+	return c.create(chassis, dryRunUUID("ha_chassis", chassis.ChassisName), group, "ha_chassis")
+}
+
+// Update sets the named columns of an existing row.
+func (c *ovsdbClient) Update(row interface{}, columns ...string) error {
+	if len(columns) == 0 {
+		return nil
+	}
+
+	fields := make([]interface{}, 0, len(columns))
+	for _, column := range columns {
+		field, err := nbField(row, column)
+		if err != nil {
+			return err
+		}
+
+		fields = append(fields, field.Addr().Interface())
+	}
+
+	ops, err := c.client.Where(row).Update(row, fields...)
+	if err != nil {
+		return err
+	}
+
+	// The row may be changed by the caller before the transaction is committed, so a copy is compared.
+	want := nbCopy(row)
+	uuid, _ := nbField(row, "_uuid")
+	c.waits = append(c.waits, ovsdbWait{row: row, uuid: uuid.String(), done: func(cached interface{}, resolve func(string) string) bool {
+		// Rows are only missing from the cache once deleted, as created rows are waited for first.
+		if cached == nil {
+			return true
+		}
+
+		for _, column := range columns {
+			field, _ := nbField(want, column)
+			ovsdbResolveUUIDs(field, resolve)
+		}
+
+		changed, err := nbDiffColumns(cached, want, columns...)
+		return err == nil && len(changed) == 0
+	}})
+
+	return c.queue(ops...)
+}
+
+// ovsdbResolveUUIDs replaces the named UUIDs that field (an NB column value) refers to with the real UUIDs.
+func ovsdbResolveUUIDs(field reflect.Value, resolve func(string) string) {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(resolve(field.String()))
+	case reflect.Ptr:
+		if !field.IsNil() && field.Elem().Kind() == reflect.String {
+			field.Elem().SetString(resolve(field.Elem().String()))
+		}
+	case reflect.Slice:
+		for i := 0; i < field.Len(); i++ {
+			field.Index(i).SetString(resolve(field.Index(i).String()))
+		}
+	}
+}
+
+// DeleteLogicalRouter deletes a logical router along with its ports, routes and NAT rules.
+func (c *ovsdbClient) DeleteLogicalRouter(router *nbLogicalRouter) error {
+	return c.destroy(router)
+}
+
+// DeleteLogicalRouterPort removes a port from a logical router.
+func (c *ovsdbClient) DeleteLogicalRouterPort(router *nbLogicalRouter, port *nbLogicalRouterPort) error {
+	return c.removeChild(router, "ports", port.UUID)
+}
+
+// DeleteLogicalRouterStaticRoute removes a static route from a logical router.
+func (c *ovsdbClient) DeleteLogicalRouterStaticRoute(router *nbLogicalRouter, route *nbLogicalRouterStaticRoute) error {
+	return c.removeChild(router, "static_routes", route.UUID)
+}
+
+// DeleteNAT removes a NAT rule from a logical router.
+func (c *ovsdbClient) DeleteNAT(router *nbLogicalRouter, nat *nbNAT) error {
+	return c.removeChild(router, "nat", nat.UUID)
+}
+
+// DeleteLogicalSwitch deletes a logical switch along with its ports.
+func (c *ovsdbClient) DeleteLogicalSwitch(logicalSwitch *nbLogicalSwitch) error {
+	return c.destroy(logicalSwitch)
+}
+
+// DeleteLogicalSwitchPort removes a port from a logical switch.
+func (c *ovsdbClient) DeleteLogicalSwitchPort(logicalSwitch *nbLogicalSwitch, port *nbLogicalSwitchPort) error {
+	return c.removeChild(logicalSwitch, "ports", port.UUID)
+}
+
+// DeleteDHCPOptions deletes DHCP options.
+func (c *ovsdbClient) DeleteDHCPOptions(opts *nbDHCPOptions) error {
+	return c.destroy(opts)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// getLogicalRouterPeerPortName returns the name of the router port on a project network's router that peers with the
+// router of another project network.
+func getLogicalRouterPeerPortName(projectName string, network network, peerProjectName string, peerNetwork network) string {
+	return fmt.Sprintf("%s-%s-lrp-peer-%s-%s", projectName, network.name, peerProjectName, peerNetwork.name)
+}
+
+// findProjectNetwork returns the project name and network definition for a "<project>/<network>" argument.
+func findProjectNetwork(t *topology, arg string) (string, network, error) {
+	parts := strings.SplitN(arg, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", network{}, fmt.Errorf("Invalid project network %q (must be of the form <project>/<network>)", arg)
+	}
+
+	for _, project := range t.Projects {
+		if project.Name != parts[0] {
+			continue
+		}
+
+		networks, err := t.networks(project)
+		if err != nil {
+			return "", network{}, err
+		}
+
+		for _, n := range networks {
+			if n.name == parts[1] {
+				return project.Name, n, nil
+			}
+		}
+	}
+
+	return "", network{}, fmt.Errorf("Project network %q not found in topology", arg)
+}
+
+// peerEnd is one side of a peer link between two project network routers.
+type peerEnd struct {
+	router   *nbLogicalRouter
+	portName string
+	mac      string
+	gateways []*net.IPNet // The internal router port addresses, with the prefix length of the internal subnets.
+}
+
+// getPeerEnd returns one side of the peer link between the routers of two project networks. The router and its
+// internal router port must exist.
+func getPeerEnd(projectName string, network network, peerProjectName string, peerNetwork network) (*peerEnd, error) {
+	router, err := getExistingLogicalRouter(getLogicalRouterName(projectName, network))
+	if err != nil {
+		return nil, err
+	}
+
+	internalRouterPortName, _ := getLogicalIntSwitchRouterPortNames(projectName, network)
+	internalRouterPort, err := nb.GetLogicalRouterPort(internalRouterPortName)
+	if err != nil {
+		return nil, err
+	}
+
+	if internalRouterPort == nil {
+		return nil, fmt.Errorf("Logical router port %q not found", internalRouterPortName)
+	}
+
+	end := &peerEnd{
+		router:   router,
+		portName: getLogicalRouterPeerPortName(projectName, network, peerProjectName, peerNetwork),
+		mac:      internalRouterPort.MAC,
+	}
+
+	for _, cidr := range internalRouterPort.Networks {
+		ip, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		end.gateways = append(end.gateways, &net.IPNet{IP: ip, Mask: subnet.Mask})
+	}
+
+	return end, nil
+}
+
+// peerProjectNetworks connects the routers of two project networks with a pair of peer router ports, and adds routes
+// on each router to the other's internal subnets through them. The peer ports reuse the MAC address and gateway
+// addresses of each router's internal port, as single address /32 and /128 networks, so no addresses need to be
+// allocated for the link. Existing peer ports and routes are only changed where they differ.
+func peerProjectNetworks(projectName string, network network, peerProjectName string, peerNetwork network) error {
+	nb.Begin()
+	defer nb.Abort()
+
+	end, err := getPeerEnd(projectName, network, peerProjectName, peerNetwork)
+	if err != nil {
+		return err
+	}
+
+	otherEnd, err := getPeerEnd(peerProjectName, peerNetwork, projectName, network)
+	if err != nil {
+		return err
+	}
+
+	ends := [2]*peerEnd{end, otherEnd}
+
+	// The link only has the IP families both networks have, and the subnets must not overlap.
+	common := map[string]bool{}
+	for _, gw := range ends[0].gateways {
+		for _, peerGW := range ends[1].gateways {
+			if ipFamily(gw) != ipFamily(peerGW) {
+				continue
+			}
+
+			if gw.Contains(peerGW.IP) || peerGW.Contains(gw.IP) {
+				subnet := net.IPNet{IP: gw.IP.Mask(gw.Mask), Mask: gw.Mask}
+				peerSubnet := net.IPNet{IP: peerGW.IP.Mask(peerGW.Mask), Mask: peerGW.Mask}
+				return fmt.Errorf("Internal subnets %q and %q overlap", subnet.String(), peerSubnet.String())
+			}
+
+			common[ipFamily(gw)] = true
+		}
+	}
+
+	if len(common) == 0 {
+		return fmt.Errorf("Project networks have no IP family in common")
+	}
+
+	for i, end := range ends {
+		peer := ends[1-i]
+
+		networks := []string{}
+		for _, gw := range end.gateways {
+			if !common[ipFamily(gw)] {
+				continue
+			}
+
+			bits := 128
+			if ipFamily(gw) == "ipv4" {
+				bits = 32
+			}
+
+			networks = append(networks, fmt.Sprintf("%s/%d", gw.IP.String(), bits))
+		}
+
+		port, err := nb.GetLogicalRouterPort(end.portName)
+		if err != nil {
+			return err
+		}
+
+		peerPortName := peer.portName
+		err = ensureLogicalRouterPort(end.router, port, &nbLogicalRouterPort{
+			Name:     end.portName,
+			MAC:      end.mac,
+			Networks: networks,
+			Peer:     &peerPortName,
+		}, "mac", "networks", "peer")
+		if err != nil {
+			return err
+		}
+
+		// The nexthop isn't in the subnet of any of the router's ports, so the routes set the output port.
+		want := []nbLogicalRouterStaticRoute{}
+		for _, peerGW := range peer.gateways {
+			for _, gw := range end.gateways {
+				if ipFamily(gw) != ipFamily(peerGW) {
+					continue
+				}
+
+				outputPort := end.portName
+				prefix := net.IPNet{IP: peerGW.IP.Mask(peerGW.Mask), Mask: peerGW.Mask}
+				want = append(want, nbLogicalRouterStaticRoute{
+					IPPrefix:    prefix.String(),
+					Nexthop:     peerGW.IP.String(),
+					OutputPort:  &outputPort,
+					ExternalIDs: map[string]string{"lxd_peer": end.portName},
+				})
+			}
+		}
+
+		err = ensurePeerRoutes(end.router, end.portName, want)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nb.Commit()
+}
+
+// ensurePeerRoutes makes the routes through a peer port on a router match those wanted, removing any others.
+func ensurePeerRoutes(router *nbLogicalRouter, portName string, want []nbLogicalRouterStaticRoute) error {
+	routes, err := nb.GetLogicalRouterStaticRoutes(router)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for i, route := range routes {
+		if route.ExternalIDs["lxd_peer"] != portName {
+			continue
+		}
+
+		key := route.IPPrefix + " " + route.Nexthop
+		wanted := false
+		for _, w := range want {
+			if w.IPPrefix+" "+w.Nexthop == key && route.OutputPort != nil && *route.OutputPort == portName {
+				wanted = true
+			}
+		}
+
+		if wanted && !existing[key] {
+			existing[key] = true
+			continue
+		}
+
+		err = nb.DeleteLogicalRouterStaticRoute(router, &routes[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range want {
+		if existing[want[i].IPPrefix+" "+want[i].Nexthop] {
+			continue
+		}
+
+		err = nb.CreateLogicalRouterStaticRoute(router, &want[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unpeerProjectNetworks removes the peer router ports between the routers of two project networks, and the routes
+// through them. Either side may already be gone.
+func unpeerProjectNetworks(projectName string, network network, peerProjectName string, peerNetwork network) error {
+	nb.Begin()
+	defer nb.Abort()
+
+	// Each side is the name of a router and of its peer port.
+	for _, side := range [][2]string{
+		{getLogicalRouterName(projectName, network), getLogicalRouterPeerPortName(projectName, network, peerProjectName, peerNetwork)},
+		{getLogicalRouterName(peerProjectName, peerNetwork), getLogicalRouterPeerPortName(peerProjectName, peerNetwork, projectName, network)},
+	} {
+		router, err := nb.GetLogicalRouter(side[0])
+		if err != nil {
+			return err
+		}
+
+		if router == nil {
+			continue
+		}
+
+		err = removePeerPort(router, side[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nb.Commit()
+}
+
+// removePeerPort removes a peer port from a router, along with the routes through it, if it exists.
+func removePeerPort(router *nbLogicalRouter, portName string) error {
+	err := ensurePeerRoutes(router, portName, nil)
+	if err != nil {
+		return err
+	}
+
+	port, err := nb.GetLogicalRouterPort(portName)
+	if err != nil || port == nil {
+		return err
+	}
+
+	return nb.DeleteLogicalRouterPort(router, port)
+}
+
+// removePeers removes the other side of every peer link of a router that is about to be deleted, so that the peer
+// routers aren't left with ports and routes pointing at it.
+func removePeers(router *nbLogicalRouter) error {
+	ports, err := nb.GetLogicalRouterPorts(router)
+	if err != nil {
+		return err
+	}
+
+	var routers []nbLogicalRouter
+	for _, port := range ports {
+		if port.Peer == nil {
+			continue
+		}
+
+		if routers == nil {
+			routers, err = nb.GetLogicalRouters()
+			if err != nil {
+				return err
+			}
+		}
+
+		peerPort, err := nb.GetLogicalRouterPort(*port.Peer)
+		if err != nil {
+			return err
+		}
+
+		if peerPort == nil {
+			continue
+		}
+
+		for i := range routers {
+			if routers[i].UUID != router.UUID && shared.StringInSlice(peerPort.UUID, routers[i].Ports) {
+				err = removePeerPort(&routers[i], peerPort.Name)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testPeerNetworks returns networks "a" and "b" of project "p", with internal subnets that don't overlap.
+func testPeerNetworks() (network, network) {
+	a := testNetwork("a")
+	b := testNetwork("b")
+	b.gw4 = "10.1.0.1/24"
+	b.gw6 = "fd01::1/64"
+
+	return a, b
+}
+
+// testPeerRoutes returns the routes through a router's peer port, as "<prefix> via <nexthop>".
+func testPeerRoutes(t *testing.T, routerName string, portName string) []string {
+	t.Helper()
+
+	router, err := nb.GetLogicalRouter(routerName)
+	if err != nil || router == nil {
+		t.Fatalf("Logical router %q not found: %v", routerName, err)
+	}
+
+	routes, err := nb.GetLogicalRouterStaticRoutes(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peerRoutes := []string{}
+	for _, route := range routes {
+		if route.ExternalIDs["lxd_peer"] != portName {
+			continue
+		}
+
+		if route.OutputPort == nil || *route.OutputPort != portName {
+			t.Errorf("Route %q doesn't go out of peer port %q", route.IPPrefix, portName)
+		}
+
+		peerRoutes = append(peerRoutes, route.IPPrefix+" via "+route.Nexthop)
+	}
+
+	sort.Strings(peerRoutes)
+
+	return peerRoutes
+}
+
+func TestPeerProjectNetworks(t *testing.T) {
+	db, _ := setupTestNB(t)
+	a, b := testPeerNetworks()
+	for _, n := range []network{a, b} {
+		err := createProjectNetwork("p", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := peerProjectNetworks("p", a, "p", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		router     string
+		port       string
+		peer       string
+		networks   string
+		wantRoutes []string
+	}{
+		{
+			router:     "p-a",
+			port:       "p-a-lrp-peer-p-b",
+			peer:       "p-b-lrp-peer-p-a",
+			networks:   "10.0.0.1/32 fd00::1/128",
+			wantRoutes: []string{"10.1.0.0/24 via 10.1.0.1", "fd01::/64 via fd01::1"},
+		},
+		{
+			router:     "p-b",
+			port:       "p-b-lrp-peer-p-a",
+			peer:       "p-a-lrp-peer-p-b",
+			networks:   "10.1.0.1/32 fd01::1/128",
+			wantRoutes: []string{"10.0.0.0/24 via 10.0.0.1", "fd00::/64 via fd00::1"},
+		},
+	} {
+		port, err := nb.GetLogicalRouterPort(tt.port)
+		if err != nil || port == nil {
+			t.Fatalf("Peer port %q not found: %v", tt.port, err)
+		}
+
+		internalPort, _ := nb.GetLogicalRouterPort(tt.router + "-lrp-int")
+		if port.MAC != internalPort.MAC {
+			t.Errorf("Peer port %q has MAC address %q rather than that of the internal port", tt.port, port.MAC)
+		}
+
+		if port.Peer == nil || *port.Peer != tt.peer {
+			t.Errorf("Peer port %q has peer %v", tt.port, port.Peer)
+		}
+
+		if strings.Join(port.Networks, " ") != tt.networks {
+			t.Errorf("Peer port %q has networks %v", tt.port, port.Networks)
+		}
+
+		routes := testPeerRoutes(t, tt.router, tt.port)
+		if strings.Join(routes, ", ") != strings.Join(tt.wantRoutes, ", ") {
+			t.Errorf("Expected routes %v on %q, got %v", tt.wantRoutes, tt.router, routes)
+		}
+	}
+
+	// Peering again, in either direction, changes nothing, and the peer link isn't drift of either network.
+	requireNoWrites(t, db, func() error { return peerProjectNetworks("p", a, "p", b) })
+	requireNoWrites(t, db, func() error { return peerProjectNetworks("p", b, "p", a) })
+	requireNoDrift(t, "p", a)
+	requireNoDrift(t, "p", b)
+
+	// Unpeering removes both ports and their routes, and leaves the networks as they were.
+	err = unpeerProjectNetworks("p", a, "p", b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, side := range [][2]string{{"p-a", "p-a-lrp-peer-p-b"}, {"p-b", "p-b-lrp-peer-p-a"}} {
+		port, _ := nb.GetLogicalRouterPort(side[1])
+		if port != nil {
+			t.Errorf("Peer port %q not removed", side[1])
+		}
+
+		routes := testPeerRoutes(t, side[0], side[1])
+		if len(routes) != 0 {
+			t.Errorf("Routes %v through %q not removed", routes, side[1])
+		}
+	}
+
+	requireNoWrites(t, db, func() error { return unpeerProjectNetworks("p", a, "p", b) })
+	requireNoWrites(t, db, func() error { return createProjectNetwork("p", a) })
+	requireNoWrites(t, db, func() error { return createProjectNetwork("p", b) })
+}
+
+func TestPeerProjectNetworksFamilies(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(a *network, b *network)
+		wantPorts string // Networks of the peer port of "a", if peering succeeds.
+		errMsg    string
+	}{
+		{
+			name:      "IPv4 only on one side",
+			setup:     func(a *network, b *network) { b.ipv6 = false },
+			wantPorts: "10.0.0.1/32",
+		},
+		{
+			name: "no IP family in common",
+			setup: func(a *network, b *network) {
+				a.ipv6 = false
+				b.ipv4 = false
+			},
+			errMsg: "no IP family in common",
+		},
+		{
+			name:   "overlapping subnets",
+			setup:  func(a *network, b *network) { b.gw4 = "10.0.0.129/25" },
+			errMsg: "overlap",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			a, b := testPeerNetworks()
+			tt.setup(&a, &b)
+			for _, n := range []network{a, b} {
+				err := createProjectNetwork("p", n)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if tt.errMsg != "" {
+				before := db.snapshot()
+				err := peerProjectNetworks("p", a, "p", b)
+				if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+				}
+
+				requireUnchanged(t, db, before)
+
+				return
+			}
+
+			err := peerProjectNetworks("p", a, "p", b)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			port, _ := nb.GetLogicalRouterPort("p-a-lrp-peer-p-b")
+			if port == nil || strings.Join(port.Networks, " ") != tt.wantPorts {
+				t.Fatalf("Unexpected peer port %+v", port)
+			}
+		})
+	}
+}
+
+func TestRemovePeers(t *testing.T) {
+	_, host := setupTestNB(t)
+	a, b := testPeerNetworks()
+	c := testNetwork("c")
+	c.gw4 = "10.2.0.1/24"
+	c.gw6 = "fd02::1/64"
+	for _, n := range []network{a, b, c} {
+		err := createProjectNetwork("p", n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, peer := range [][2]network{{a, b}, {a, c}, {b, c}} {
+		err := peerProjectNetworks("p", peer[0], "p", peer[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Deleting network "a" removes the other side of its peer links, and leaves the link between "b" and "c" alone.
+	host.outputs = map[string]string{}
+	err := deleteProjectNetwork("p", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, side := range [][2]string{{"p-b", "p-b-lrp-peer-p-a"}, {"p-c", "p-c-lrp-peer-p-a"}} {
+		port, _ := nb.GetLogicalRouterPort(side[1])
+		if port != nil {
+			t.Errorf("Peer port %q not removed", side[1])
+		}
+
+		routes := testPeerRoutes(t, side[0], side[1])
+		if len(routes) != 0 {
+			t.Errorf("Routes %v through %q not removed", routes, side[1])
+		}
+	}
+
+	for _, side := range [][2]string{{"p-b", "p-b-lrp-peer-p-c"}, {"p-c", "p-c-lrp-peer-p-b"}} {
+		port, _ := nb.GetLogicalRouterPort(side[1])
+		if port == nil {
+			t.Errorf("Peer port %q removed", side[1])
+		}
+
+		routes := testPeerRoutes(t, side[0], side[1])
+		if len(routes) != 2 {
+			t.Errorf("Expected 2 routes through %q, got %v", side[1], routes)
+		}
+	}
+
+	// Unpeering a deleted network still removes the other side.
+	err = peerProjectNetworks("p", b, "p", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = deleteProjectNetwork("p", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = unpeerProjectNetworks("p", b, "p", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, _ := nb.GetLogicalRouterPort("p-b-lrp-peer-p-c")
+	if port != nil {
+		t.Errorf("Peer port %q not removed", port.Name)
+	}
+}
+
+func TestFindProjectNetwork(t *testing.T) {
+	tests := []struct {
+		arg    string
+		errMsg string // Empty if the network is found.
+	}{
+		{arg: "p/n"},
+		{arg: "p", errMsg: `Invalid project network "p" (must be of the form <project>/<network>)`},
+		{arg: "p/", errMsg: `Invalid project network "p/" (must be of the form <project>/<network>)`},
+		{arg: "/n", errMsg: `Invalid project network "/n" (must be of the form <project>/<network>)`},
+		{arg: "p/m", errMsg: `Project network "p/m" not found in topology`},
+		{arg: "q/n", errMsg: `Project network "q/n" not found in topology`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			projectName, n, err := findProjectNetwork(testTopology(), tt.arg)
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if projectName != "p" || n.name != "n" || n.gw4 != "10.0.0.1/24" {
+					t.Errorf("Unexpected project %q network %+v", projectName, n)
+				}
+
+				return
+			}
+
+			if err == nil || err.Error() != tt.errMsg {
+				t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// dryRun disables running of commands. Instead they are recorded in the plan.
+var dryRun bool
+
+// plan is the ordered list of commands that would have been run in dry-run mode.
+var plan []string
+
+// execCommand runs a command on the host and returns its output. Tests replace it to stub the host commands.
+var execCommand = shared.RunCommand
+
+// runCommand runs a command that changes the host or the OVN databases, or records it in the plan when in dry-run
+// mode.
+func runCommand(name string, args ...string) (string, error) {
+	return runCommandOutput("", name, args...)
+}
+
+// runCommandOutput runs a command whose output is used by later commands. In dry-run mode the command is recorded
+// in the plan and the placeholder is returned in place of the output.
+func runCommandOutput(placeholder string, name string, args ...string) (string, error) {
+	if dryRun {
+		plan = append(plan, quoteCommand(name, args...))
+		return placeholder, nil
+	}
+
+	return execCommand(name, args...)
+}
+
+// runQuery runs a command that only reads state. Queries are run even in dry-run mode, so that the plan is built from
+// the real state and only contains the commands that change it.
+func runQuery(name string, args ...string) (string, error) {
+	return execCommand(name, args...)
+}
+
+// dryRunUUID returns a placeholder for the UUID of a record that doesn't exist until the plan is run.
+func dryRunUUID(table string, name string) string {
+	return fmt.Sprintf("<%s:%s>", table, name)
+}
+
+// quoteCommand returns the command as a string that can be pasted into a shell.
+func quoteCommand(name string, args ...string) string {
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`<>|&;()*?[]{}!#~") {
+			arg = fmt.Sprintf("'%s'", strings.Replace(arg, "'", `'"'"'`, -1))
+		}
+
+		quoted = append(quoted, arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// printPlan writes the recorded commands to w.
+func printPlan(w io.Writer) {
+	fmt.Fprintf(w, "# Plan (%d commands)\n", len(plan))
+	for _, cmd := range plan {
+		fmt.Fprintln(w, cmd)
+	}
+}
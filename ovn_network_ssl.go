@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// ovnSSLConfig holds the files used to connect to the OVN databases over SSL.
+type ovnSSLConfig struct {
+	privateKey  string
+	certificate string
+	caCert      string
+}
+
+// ovnSSL is the SSL configuration used to connect to the OVN databases. Plain TCP is used when it has no private
+// key.
+var ovnSSL ovnSSLConfig
+
+// enabled returns whether the OVN databases are connected to over SSL.
+func (s ovnSSLConfig) enabled() bool {
+	return s.privateKey != ""
+}
+
+// validate checks that either all or none of the files are set, and that those set can be read.
+func (s ovnSSLConfig) validate() error {
+	files := map[string]string{"private key": s.privateKey, "certificate": s.certificate, "CA certificate": s.caCert}
+	for name, path := range files {
+		if path == "" {
+			if s.privateKey != "" || s.certificate != "" || s.caCert != "" {
+				return fmt.Errorf("SSL %s missing (private key, certificate and CA certificate must all be set)", name)
+			}
+
+			continue
+		}
+
+		_, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Failed reading SSL %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// commandArgs returns the SSL arguments for the OVN and OVSDB command line tools.
+func (s ovnSSLConfig) commandArgs() []string {
+	if !s.enabled() {
+		return nil
+	}
+
+	return []string{
+		fmt.Sprintf("--private-key=%s", s.privateKey),
+		fmt.Sprintf("--certificate=%s", s.certificate),
+		fmt.Sprintf("--ca-cert=%s", s.caCert),
+	}
+}
+
+// tlsConfig returns the TLS configuration for OVSDB clients, or nil if SSL isn't enabled.
+// Like the OVN tools, the server certificate is only checked against the CA certificate and not the address
+// connected to, as certificates issued by ovs-pki don't name the host.
+func (s ovnSSLConfig) tlsConfig() (*tls.Config, error) {
+	if !s.enabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certificate, s.privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed loading SSL certificate %q: %w", s.certificate, err)
+	}
+
+	caCert, err := ioutil.ReadFile(s.caCert)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caCert) {
+		return nil, fmt.Errorf("No certificates found in SSL CA certificate %q", s.caCert)
+	}
+
+	return &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("No server certificate")
+			}
+
+			serverCert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+
+			intermediates := x509.NewCertPool()
+			for _, rawCert := range rawCerts[1:] {
+				intermediate, err := x509.ParseCertificate(rawCert)
+				if err != nil {
+					return err
+				}
+
+				intermediates.AddCert(intermediate)
+			}
+
+			_, err = serverCert.Verify(x509.VerifyOptions{Roots: roots, Intermediates: intermediates})
+			return err
+		},
+	}, nil
+}
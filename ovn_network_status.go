@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// status is the live state of the HA chassis group and the project networks in the NB database.
+type status struct {
+	HAChassisGroup string          `json:"ha_chassis_group"`
+	HAChassis      []chassisStatus `json:"ha_chassis"`
+	Networks       []networkStatus `json:"networks"`
+}
+
+// chassisStatus is a member of the HA chassis group.
+type chassisStatus struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+}
+
+// networkStatus is the live state of a project network. Records that don't exist are nil.
+type networkStatus struct {
+	Project        string              `json:"project"`
+	Network        string              `json:"network"`
+	Router         *routerStatus       `json:"router"`
+	ExternalSwitch *switchStatus       `json:"external_switch"`
+	InternalSwitch *switchStatus       `json:"internal_switch"`
+	DHCPOptions    []dhcpOptionsStatus `json:"dhcp_options"`
+}
+
+// routerStatus is the live state of a logical router.
+type routerStatus struct {
+	Name   string             `json:"name"`
+	Ports  []routerPortStatus `json:"ports"`
+	NATs   []natStatus        `json:"nats"`
+	Routes []routeStatus      `json:"routes"`
+}
+
+// routerPortStatus is a logical router port.
+type routerPortStatus struct {
+	Name     string   `json:"name"`
+	MAC      string   `json:"mac"`
+	Networks []string `json:"networks"`
+}
+
+// natStatus is a NAT rule on a logical router.
+type natStatus struct {
+	Type       string `json:"type"`
+	ExternalIP string `json:"external_ip"`
+	LogicalIP  string `json:"logical_ip"`
+}
+
+// routeStatus is a static route on a logical router.
+type routeStatus struct {
+	IPPrefix   string `json:"ip_prefix"`
+	Nexthop    string `json:"nexthop"`
+	OutputPort string `json:"output_port,omitempty"`
+	Policy     string `json:"policy,omitempty"`
+}
+
+// switchStatus is the live state of a logical switch.
+type switchStatus struct {
+	Name  string             `json:"name"`
+	Ports []switchPortStatus `json:"ports"`
+}
+
+// switchPortStatus is a logical switch port. Instance ports have dynamic addresses once OVN has assigned them.
+type switchPortStatus struct {
+	Name             string   `json:"name"`
+	Type             string   `json:"type"`
+	Addresses        []string `json:"addresses"`
+	DynamicAddresses string   `json:"dynamic_addresses,omitempty"`
+}
+
+// dhcpOptionsStatus is a set of DHCP options for a subnet of the internal switch.
+type dhcpOptionsStatus struct {
+	CIDR    string            `json:"cidr"`
+	Options map[string]string `json:"options"`
+}
+
+// getHAChassisStatus returns the members of the HA chassis group, highest priority first.
+func getHAChassisStatus() ([]chassisStatus, error) {
+	members := []chassisStatus{}
+
+	group, err := nb.GetHAChassisGroup(haChassisGroup)
+	if err != nil || group == nil {
+		return members, err
+	}
+
+	chassis, err := nb.GetHAChassis(group)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range chassis {
+		members = append(members, chassisStatus{Name: c.ChassisName, Priority: c.Priority})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		if members[i].Priority != members[j].Priority {
+			return members[i].Priority > members[j].Priority
+		}
+
+		return members[i].Name < members[j].Name
+	})
+
+	return members, nil
+}
+
+// getNetworkStatus returns the live state of a project network.
+func getNetworkStatus(projectName string, network network) (*networkStatus, error) {
+	s := &networkStatus{Project: projectName, Network: network.name, DHCPOptions: []dhcpOptionsStatus{}}
+
+	var err error
+	s.Router, err = getRouterStatus(getLogicalRouterName(projectName, network))
+	if err != nil {
+		return nil, err
+	}
+
+	s.ExternalSwitch, err = getSwitchStatus(getLogicalExtSwitchName(projectName, network))
+	if err != nil {
+		return nil, err
+	}
+
+	intSwitchName := getLogicalIntSwitchName(projectName, network)
+	s.InternalSwitch, err = getSwitchStatus(intSwitchName)
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := nb.GetDHCPOptions(intSwitchName)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, o := range opts {
+		s.DHCPOptions = append(s.DHCPOptions, dhcpOptionsStatus{CIDR: o.Cidr, Options: o.Options})
+	}
+
+	sort.Slice(s.DHCPOptions, func(i, j int) bool { return s.DHCPOptions[i].CIDR < s.DHCPOptions[j].CIDR })
+
+	return s, nil
+}
+
+// getRouterStatus returns the live state of a logical router, or nil if it doesn't exist.
+func getRouterStatus(name string) (*routerStatus, error) {
+	router, err := nb.GetLogicalRouter(name)
+	if err != nil || router == nil {
+		return nil, err
+	}
+
+	s := &routerStatus{Name: router.Name, Ports: []routerPortStatus{}, NATs: []natStatus{}, Routes: []routeStatus{}}
+
+	ports, err := nb.GetLogicalRouterPorts(router)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, port := range ports {
+		s.Ports = append(s.Ports, routerPortStatus{Name: port.Name, MAC: port.MAC, Networks: port.Networks})
+	}
+
+	nats, err := nb.GetLogicalRouterNATs(router)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nat := range nats {
+		s.NATs = append(s.NATs, natStatus{Type: nat.Type, ExternalIP: nat.ExternalIP, LogicalIP: nat.LogicalIP})
+	}
+
+	routes, err := nb.GetLogicalRouterStaticRoutes(router)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, route := range routes {
+		r := routeStatus{IPPrefix: route.IPPrefix, Nexthop: route.Nexthop}
+		if route.OutputPort != nil {
+			r.OutputPort = *route.OutputPort
+		}
+
+		if route.Policy != nil {
+			r.Policy = *route.Policy
+		}
+
+		s.Routes = append(s.Routes, r)
+	}
+
+	sort.Slice(s.Ports, func(i, j int) bool { return s.Ports[i].Name < s.Ports[j].Name })
+	sort.Slice(s.NATs, func(i, j int) bool { return s.NATs[i].LogicalIP < s.NATs[j].LogicalIP })
+	sort.Slice(s.Routes, func(i, j int) bool { return s.Routes[i].IPPrefix < s.Routes[j].IPPrefix })
+
+	return s, nil
+}
+
+// getSwitchStatus returns the live state of a logical switch, or nil if it doesn't exist.
+func getSwitchStatus(name string) (*switchStatus, error) {
+	logicalSwitch, err := nb.GetLogicalSwitch(name)
+	if err != nil || logicalSwitch == nil {
+		return nil, err
+	}
+
+	ports, err := nb.GetLogicalSwitchPorts(logicalSwitch)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &switchStatus{Name: logicalSwitch.Name, Ports: []switchPortStatus{}}
+	for _, port := range ports {
+		p := switchPortStatus{Name: port.Name, Type: port.Type, Addresses: port.Addresses}
+		if port.DynamicAddresses != nil {
+			p.DynamicAddresses = *port.DynamicAddresses
+		}
+
+		s.Ports = append(s.Ports, p)
+	}
+
+	sort.Slice(s.Ports, func(i, j int) bool { return s.Ports[i].Name < s.Ports[j].Name })
+
+	return s, nil
+}
+
+// printStatusJSON writes the status to w as JSON.
+func printStatusJSON(w io.Writer, s *status) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(s)
+}
+
+// printStatusTable writes the status to w as a table with a row per record.
+func printStatusTable(w io.Writer, s *status) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PROJECT\tNETWORK\tRECORD\tNAME\tDETAILS")
+
+	for _, c := range s.HAChassis {
+		fmt.Fprintf(tw, "-\t-\tha-chassis\t%s\tgroup=%s priority=%d\n", c.Name, s.HAChassisGroup, c.Priority)
+	}
+
+	for _, n := range s.Networks {
+		row := func(record string, name string, details string) {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", n.Project, n.Network, record, name, details)
+		}
+
+		if n.Router == nil {
+			row("router", "-", "missing")
+		} else {
+			row("router", n.Router.Name, "")
+			for _, p := range n.Router.Ports {
+				row("router-port", p.Name, fmt.Sprintf("mac=%s networks=%s", p.MAC, strings.Join(p.Networks, ",")))
+			}
+
+			for _, nat := range n.Router.NATs {
+				row("nat", nat.Type, fmt.Sprintf("%s -> %s", nat.LogicalIP, nat.ExternalIP))
+			}
+
+			for _, r := range n.Router.Routes {
+				details := fmt.Sprintf("via %s", r.Nexthop)
+				if r.OutputPort != "" {
+					details += fmt.Sprintf(" port=%s", r.OutputPort)
+				}
+
+				if r.Policy != "" {
+					details += fmt.Sprintf(" policy=%s", r.Policy)
+				}
+
+				row("route", r.IPPrefix, details)
+			}
+		}
+
+		for _, ls := range []struct {
+			kind string
+			s    *switchStatus
+		}{{"external", n.ExternalSwitch}, {"internal", n.InternalSwitch}} {
+			if ls.s == nil {
+				row("switch", "-", fmt.Sprintf("%s missing", ls.kind))
+				continue
+			}
+
+			row("switch", ls.s.Name, ls.kind)
+			for _, p := range ls.s.Ports {
+				details := fmt.Sprintf("addresses=%s", strings.Join(p.Addresses, ","))
+				if p.Type != "" {
+					details = fmt.Sprintf("type=%s %s", p.Type, details)
+				}
+
+				if p.DynamicAddresses != "" {
+					details += fmt.Sprintf(" dynamic=%q", p.DynamicAddresses)
+				}
+
+				row("switch-port", p.Name, details)
+			}
+		}
+
+		for _, o := range n.DHCPOptions {
+			keys := make([]string, 0, len(o.Options))
+			for key := range o.Options {
+				keys = append(keys, key)
+			}
+
+			sort.Strings(keys)
+
+			options := make([]string, 0, len(keys))
+			for _, key := range keys {
+				options = append(options, fmt.Sprintf("%s=%s", key, o.Options[key]))
+			}
+
+			row("dhcp-options", o.CIDR, strings.Join(options, " "))
+		}
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testStatus returns the status of network n of project p along with the HA chassis group.
+func testStatus(t *testing.T, n network) *status {
+	t.Helper()
+
+	s := &status{HAChassisGroup: haChassisGroup}
+
+	var err error
+	s.HAChassis, err = getHAChassisStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	networkStatus, err := getNetworkStatus("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Networks = append(s.Networks, *networkStatus)
+
+	return s
+}
+
+func TestGetNetworkStatus(t *testing.T) {
+	_, _ = setupTestNB(t)
+	n := testNetwork("n")
+
+	// Nothing exists before the network is created.
+	s := testStatus(t, n)
+	missing := s.Networks[0]
+	if missing.Router != nil || missing.ExternalSwitch != nil || missing.InternalSwitch != nil || len(missing.DHCPOptions) != 0 {
+		t.Fatalf("Unexpected status of a missing network %+v", missing)
+	}
+
+	err := createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = testStatus(t, n)
+	if !reflect.DeepEqual(s.HAChassis, []chassisStatus{{Name: "chassis1", Priority: 1}}) {
+		t.Errorf("Unexpected HA chassis %+v", s.HAChassis)
+	}
+
+	got := s.Networks[0]
+	if got.Project != "p" || got.Network != "n" {
+		t.Errorf("Unexpected network %q/%q", got.Project, got.Network)
+	}
+
+	if got.Router == nil || got.Router.Name != "p-n" {
+		t.Fatalf("Unexpected router %+v", got.Router)
+	}
+
+	portNames := []string{}
+	for _, port := range got.Router.Ports {
+		portNames = append(portNames, port.Name)
+	}
+
+	if !reflect.DeepEqual(portNames, []string{"p-n-lrp-ext", "p-n-lrp-int"}) {
+		t.Errorf("Unexpected router ports %v", portNames)
+	}
+
+	if len(got.Router.NATs) != 2 || got.Router.NATs[0] != (natStatus{Type: "snat", ExternalIP: "192.0.2.10", LogicalIP: "10.0.0.0/24"}) {
+		t.Errorf("Unexpected NATs %+v", got.Router.NATs)
+	}
+
+	if len(got.Router.Routes) != 2 || got.Router.Routes[0].IPPrefix != "0.0.0.0/0" || got.Router.Routes[0].Nexthop != "192.0.2.1" {
+		t.Errorf("Unexpected routes %+v", got.Router.Routes)
+	}
+
+	if got.ExternalSwitch == nil || got.ExternalSwitch.Name != "p-n-ls-ext" {
+		t.Errorf("Unexpected external switch %+v", got.ExternalSwitch)
+	}
+
+	if got.InternalSwitch == nil || got.InternalSwitch.Name != "p-n-ls-int" || len(got.InternalSwitch.Ports) != 1 {
+		t.Errorf("Unexpected internal switch %+v", got.InternalSwitch)
+	}
+
+	if len(got.DHCPOptions) != 2 || got.DHCPOptions[0].CIDR != "10.0.0.0/24" || got.DHCPOptions[1].CIDR != "fd00::/64" {
+		t.Errorf("Unexpected DHCP options %+v", got.DHCPOptions)
+	}
+}
+
+func TestPrintStatusTable(t *testing.T) {
+	_, _ = setupTestNB(t)
+	n := testNetwork("n")
+
+	err := createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testStatus(t, n)
+
+	missing, err := getNetworkStatus("p", testNetwork("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Networks = append(s.Networks, *missing)
+
+	var out bytes.Buffer
+	err = printStatusTable(&out, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Columns are aligned with spaces, so compare rows with their whitespace collapsed.
+	rows := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		rows[strings.Join(strings.Fields(line), " ")] = true
+	}
+
+	for _, row := range []string{
+		"PROJECT NETWORK RECORD NAME DETAILS",
+		"- - ha-chassis chassis1 group=" + haChassisGroup + " priority=1",
+		"p n router p-n",
+		"p n nat snat 10.0.0.0/24 -> 192.0.2.10",
+		"p n route 0.0.0.0/0 via 192.0.2.1",
+		"p n route ::/0 via 2001:db8::1",
+		"p n switch p-n-ls-ext external",
+		"p n switch-port p-n-lsp-parent-ext type=localnet addresses=unknown",
+		"p n switch p-n-ls-int internal",
+		"p n switch-port p-n-lsrp-int type=router addresses=router",
+		"p n dhcp-options fd00::/64 dhcpv6_stateless=true dns_server=fd00::53 domain_search=\"lxd\" server_id=" + s.Networks[0].Router.Ports[1].MAC,
+		"p m router - missing",
+		"p m switch - external missing",
+		"p m switch - internal missing",
+	} {
+		if !rows[row] {
+			t.Errorf("Missing status row %q in:\n%s", row, out.String())
+		}
+	}
+}
+
+func TestPrintStatusJSON(t *testing.T) {
+	_, _ = setupTestNB(t)
+	n := testNetwork("n")
+
+	err := createProjectNetwork("p", n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := testStatus(t, n)
+
+	missing, err := getNetworkStatus("p", testNetwork("m"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.Networks = append(s.Networks, *missing)
+
+	var out bytes.Buffer
+	err = printStatusJSON(&out, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The output decodes back to the same status.
+	var decoded status
+	err = json.Unmarshal(out.Bytes(), &decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(&decoded, s) {
+		t.Errorf("Status changed by JSON round trip:\n%+v\n%+v", decoded, *s)
+	}
+
+	// Missing records are null rather than left out, and routes only have the optional fields that are set.
+	var raw struct {
+		Networks []map[string]json.RawMessage `json:"networks"`
+	}
+
+	err = json.Unmarshal(out.Bytes(), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(raw.Networks) != 2 || string(raw.Networks[1]["router"]) != "null" || string(raw.Networks[1]["internal_switch"]) != "null" {
+		t.Errorf("Missing records not null in %s", out.String())
+	}
+
+	if strings.Contains(out.String(), `"output_port"`) || strings.Contains(out.String(), `"policy"`) {
+		t.Errorf("Unset route fields in %s", out.String())
+	}
+}
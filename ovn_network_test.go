@@ -0,0 +1,741 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// testHost stands in for the host in tests, recording the commands the provisioning functions run instead of running
+// them.
+type testHost struct {
+	commands []string
+
+	// outputs holds the output of commands by their command line, as quoted by quoteCommand.
+	outputs map[string]string
+}
+
+// run records a command and returns its stubbed output. NB database queries without stubbed output find no records.
+func (h *testHost) run(name string, args ...string) (string, error) {
+	command := quoteCommand(name, args...)
+	h.commands = append(h.commands, command)
+
+	output, found := h.outputs[command]
+	if !found && name == "ovn-nbctl" && shared.StringInSlice("--format=json", args) {
+		return `{"headings": [], "data": []}`, nil
+	}
+
+	return output, nil
+}
+
+// addRows stubs an ovn-nbctl find or list command, given by its arguments following the columns, to return rows (a
+// slice of NB rows).
+func (h *testHost) addRows(rows interface{}, args ...string) {
+	rowsVal := reflect.ValueOf(rows)
+	rowType := rowsVal.Type().Elem()
+
+	result := struct {
+		Headings []string        `json:"headings"`
+		Data     [][]interface{} `json:"data"`
+	}{Data: [][]interface{}{}}
+
+	for i := 0; i < rowType.NumField(); i++ {
+		result.Headings = append(result.Headings, rowType.Field(i).Tag.Get("ovsdb"))
+	}
+
+	for i := 0; i < rowsVal.Len(); i++ {
+		data := []interface{}{}
+		for j := 0; j < rowType.NumField(); j++ {
+			data = append(data, testNbValue(rowsVal.Index(i).Field(j)))
+		}
+
+		result.Data = append(result.Data, data)
+	}
+
+	output, _ := json.Marshal(result)
+	queryArgs := []string{"--format=json", fmt.Sprintf("--columns=%s", strings.Join(result.Headings, ","))}
+	h.outputs[testNbctl(append(queryArgs, args...)...)] = string(output)
+}
+
+// testNbValue returns a field of a row struct as an OVSDB JSON value.
+func testNbValue(field reflect.Value) interface{} {
+	switch field.Kind() {
+	case reflect.Map:
+		pairs := [][2]string{}
+		iter := field.MapRange()
+		for iter.Next() {
+			pairs = append(pairs, [2]string{iter.Key().String(), iter.Value().String()})
+		}
+
+		return []interface{}{"map", pairs}
+	case reflect.Slice:
+		return []interface{}{"set", field.Interface()}
+	case reflect.Ptr:
+		if field.IsNil() {
+			return []interface{}{"set", []string{}}
+		}
+
+		return field.Elem().Interface()
+	default:
+		return field.Interface()
+	}
+}
+
+// ran returns whether a command starting with prefix was run.
+func (h *testHost) ran(prefix string) bool {
+	for _, command := range h.commands {
+		if strings.HasPrefix(command, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setupTestHost replaces the host with a testHost, and accesses the NB database with ovn-nbctl, for the rest of the
+// test.
+func setupTestHost(t *testing.T, outputs map[string]string) *testHost {
+	t.Helper()
+
+	host := &testHost{outputs: outputs}
+
+	oldNB := nb
+	oldExecCommand := execCommand
+	oldNBEndpoints := nbEndpoints
+	oldSBEndpoints := sbEndpoints
+	nb = &nbctlClient{}
+	execCommand = host.run
+	nbEndpoints = []string{ovnDBAddress(6643)}
+	sbEndpoints = []string{ovnDBAddress(6642)}
+	t.Cleanup(func() {
+		nb = oldNB
+		execCommand = oldExecCommand
+		nbEndpoints = oldNBEndpoints
+		sbEndpoints = oldSBEndpoints
+		dryRun = false
+	})
+
+	dryRun = false
+	plan = nil
+	macSeed = ""
+	macsInUse = nil
+
+	return host
+}
+
+// testNorthd is a memoryClient that allocates a dynamic IPv4 address to instance ports when they are read, as northd
+// does shortly after they are added.
+type testNorthd struct {
+	*memoryClient
+
+	next int
+}
+
+// GetLogicalSwitchPort returns the logical switch port with the given name, after allocating its dynamic addresses.
+func (c *testNorthd) GetLogicalSwitchPort(name string) (*nbLogicalSwitchPort, error) {
+	port, err := c.memoryClient.GetLogicalSwitchPort(name)
+	if err != nil || port == nil || port.DynamicAddresses != nil {
+		return port, err
+	}
+
+	if len(port.Addresses) != 1 || !strings.HasSuffix(port.Addresses[0], " dynamic") {
+		return port, nil
+	}
+
+	dynamicAddresses := strings.Fields(port.Addresses[0])[0]
+	for _, row := range c.table("Logical_Switch") {
+		logicalSwitch := row.(*nbLogicalSwitch)
+		_, subnet, err := net.ParseCIDR(logicalSwitch.OtherConfig["subnet"])
+		if err != nil || !shared.StringInSlice(port.UUID, logicalSwitch.Ports) {
+			continue
+		}
+
+		c.next++
+		ip := make(net.IP, len(subnet.IP))
+		copy(ip, subnet.IP)
+		ip[len(ip)-1] += byte(100 + c.next)
+		dynamicAddresses = fmt.Sprintf("%s %s", dynamicAddresses, ip.String())
+	}
+
+	port.DynamicAddresses = &dynamicAddresses
+	err = c.memoryClient.Update(port, "dynamic_addresses")
+	if err != nil {
+		return nil, err
+	}
+
+	return port, nil
+}
+
+// snapshot returns a deep copy of the rows in the database.
+func (c *testNorthd) snapshot() map[string]map[string]interface{} {
+	snapshot := make(map[string]map[string]interface{}, len(c.rows))
+	for table, rows := range c.rows {
+		snapshot[table] = make(map[string]interface{}, len(rows))
+		for uuid, row := range rows {
+			snapshot[table][uuid] = nbCopy(row)
+		}
+	}
+
+	return snapshot
+}
+
+// setupTestNB points the provisioning functions at an empty in-memory NB database with the HA chassis group that
+// connectOVStoOVN would have created, stubs the host commands and resets the state kept between networks.
+func setupTestNB(t *testing.T) (*testNorthd, *testHost) {
+	t.Helper()
+
+	db := &testNorthd{memoryClient: newMemoryClient()}
+	host := &testHost{outputs: map[string]string{}}
+
+	oldNB := nb
+	oldExecCommand := execCommand
+	nb = db
+	execCommand = host.run
+	t.Cleanup(func() {
+		nb = oldNB
+		execCommand = oldExecCommand
+		dryRun = false
+	})
+
+	dryRun = false
+	plan = nil
+	macSeed = ""
+	macsInUse = nil
+	transitIPsInUse = map[string]string{}
+	externalIPsInUse = map[string]string{}
+	externalIPsLoaded = false
+
+	group := &nbHAChassisGroup{Name: haChassisGroup}
+	err := nb.CreateHAChassisGroup(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = nb.CreateHAChassis(group, &nbHAChassis{ChassisName: "chassis1", Priority: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db, host
+}
+
+// testNetwork returns a dual-stack network on an uplink, as built from the topology.
+func testNetwork(name string) network {
+	return network{
+		name:         name,
+		ipv4:         true,
+		ipv6:         true,
+		gw4:          "10.0.0.1/24",
+		gw6:          "fd00::1/64",
+		dns4:         "1.1.1.1",
+		dns6:         "fd00::53",
+		ipv6Mode:     "slaac",
+		extBridge:    "br0",
+		extIP4:       "192.0.2.10/24",
+		extIP6Prefix: "2001:db8::/64",
+		extGW4:       "192.0.2.1",
+		extGW6:       "2001:db8::1",
+	}
+}
+
+// requireNoWrites fails the test if f fails or changes the database.
+func requireNoWrites(t *testing.T, db *testNorthd, f func() error) {
+	t.Helper()
+
+	before := db.snapshot()
+	err := f()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requireUnchanged(t, db, before)
+}
+
+// requireUnchanged fails the test if the rows in the database differ from those in snapshot.
+func requireUnchanged(t *testing.T, db *testNorthd, snapshot map[string]map[string]interface{}) {
+	t.Helper()
+
+	for table, rows := range db.rows {
+		for uuid, row := range rows {
+			before, found := snapshot[table][uuid]
+			if !found {
+				t.Fatalf("%s row %+v was created", table, row)
+			}
+
+			if !reflect.DeepEqual(before, row) {
+				t.Fatalf("%s row %q changed from %+v to %+v", table, uuid, before, row)
+			}
+		}
+	}
+
+	for table, rows := range snapshot {
+		for uuid := range rows {
+			_, found := db.rows[table][uuid]
+			if !found {
+				t.Fatalf("%s row %q was deleted", table, uuid)
+			}
+		}
+	}
+}
+
+// requireNoDrift fails the test if the NB database doesn't match a project network's definition.
+func requireNoDrift(t *testing.T, projectName string, network network) {
+	t.Helper()
+
+	dryRun = true
+	defer func() { dryRun = false }()
+
+	drift, err := diffProjectNetwork(projectName, network)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(drift) != 0 {
+		t.Fatalf("Unexpected drift: %+v", drift)
+	}
+}
+
+// createTestRouter adds a logical router with the given static routes and NAT rules.
+func createTestRouter(t *testing.T, routes []nbLogicalRouterStaticRoute, nats []nbNAT) *nbLogicalRouter {
+	t.Helper()
+
+	router := &nbLogicalRouter{Name: "r"}
+	err := nb.CreateLogicalRouter(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range routes {
+		err = nb.CreateLogicalRouterStaticRoute(router, &routes[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range nats {
+		err = nb.CreateNAT(router, &nats[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	router, err = nb.GetLogicalRouter("r")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return router
+}
+
+// testRowNames returns the sorted static routes or NAT rules in rows, as "<prefix> via <nexthop>" and
+// "<type> <logical IP> -> <external IP>".
+func testRowNames(rows interface{}) []string {
+	names := []string{}
+	switch r := rows.(type) {
+	case []nbLogicalRouterStaticRoute:
+		for _, route := range r {
+			names = append(names, fmt.Sprintf("%s via %s", route.IPPrefix, route.Nexthop))
+		}
+	case []nbNAT:
+		for _, nat := range r {
+			names = append(names, fmt.Sprintf("%s %s -> %s", nat.Type, nat.LogicalIP, nat.ExternalIP))
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// testNbctl returns the command line of an ovn-nbctl command against the NB database.
+func testNbctl(args ...string) string {
+	return quoteCommand("ovn-nbctl", append([]string{"--db", fmt.Sprintf("tcp:%s:6643", ndbIP), "--leader-only"}, args...)...)
+}
+
+// testNbctlFind returns the command line of an ovn-nbctl query for the UUIDs of the records of table matching
+// condition.
+func testNbctlFind(table string, condition string) string {
+	return testNbctl("--format=csv", "--no-headings", "--data=bare", "--colum=_uuid", "find", table, condition)
+}
+
+// requireInOrder fails the test unless the commands in want were all run, in that order.
+func requireInOrder(t *testing.T, ran []string, want []string) {
+	t.Helper()
+
+	next := 0
+	for _, command := range want {
+		for next < len(ran) && ran[next] != command {
+			next++
+		}
+
+		if next == len(ran) {
+			t.Fatalf("Command %q not run in order: %v", command, ran)
+		}
+	}
+}
+
+func TestDeleteProjectNetwork(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(h *testHost)
+		instances []string
+		want      []string // Commands that must be run, in order.
+		notWant   []string // Parts of commands that must not be run.
+	}{
+		{
+			name: "network with leftover instance and NAT entries",
+			setup: func(h *testHost) {
+				h.addRows([]nbLogicalSwitch{{UUID: "switch-uuid", Name: "p-n-ls-int", Ports: []string{"uuid1", "uuid2", "uuid3"}}}, "find", "Logical_Switch", `name="p-n-ls-int"`)
+				h.addRows([]nbLogicalSwitchPort{{UUID: "uuid1", Name: "p-n-lsrp-int"}, {UUID: "uuid2", Name: "p-n-ls-inst-c1"}, {UUID: "uuid3", Name: "p-n-ls-inst-old"}}, "list", "Logical_Switch_Port", "uuid1", "uuid2", "uuid3")
+				h.addRows([]nbLogicalRouter{{UUID: "router-uuid", Name: "p-n", Nat: []string{"nat-uuid"}}}, "find", "Logical_Router", `name="p-n"`)
+				h.addRows([]nbDHCPOptions{{UUID: "dhcp4-uuid", Cidr: "10.0.0.0/24"}, {UUID: "dhcp6-uuid", Cidr: "fd00::/64"}}, "find", "DHCP_Options", `external_ids:lxd_network="p-n-ls-int"`)
+				h.outputs["ovs-vsctl --format=csv --no-headings --data=bare --colum=name find interface external-ids:iface-id=p-n-ls-inst-old"] = "insthold\n"
+			},
+			instances: []string{"c1"},
+			want: []string{
+				"lxc delete -f p-n-c1",
+				"lxc delete -f p-n-old",
+				"ovs-vsctl del-port insthold",
+				"ip link del insthold",
+				testNbctl("destroy", "Logical_Switch", "switch-uuid", "--", "destroy", "Logical_Router", "router-uuid", "--", "destroy", "DHCP_Options", "dhcp4-uuid", "--", "destroy", "DHCP_Options", "dhcp6-uuid"),
+			},
+		},
+		{
+			name:  "network already deleted",
+			setup: func(h *testHost) {},
+			notWant: []string{
+				" list ",
+				" destroy ",
+				"lxc delete",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := setupTestHost(t, map[string]string{})
+			tt.setup(host)
+			n := network{name: "n", instances: tt.instances}
+
+			err := deleteProjectNetwork("p", n)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			requireInOrder(t, host.commands, tt.want)
+
+			for _, part := range tt.notWant {
+				for _, command := range host.commands {
+					if strings.Contains(command, part) {
+						t.Errorf("Unexpected command %q", command)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	host := setupTestHost(t, map[string]string{
+		"ip route get 8.8.8.8":                                "8.8.8.8 via 10.0.0.1 dev eth0 src 10.0.0.42 uid 0\n    cache\n",
+		"ovs-vsctl get open_vswitch . external_ids:system-id": "\"chassis-uuid\"\n",
+	})
+	host.addRows([]nbHAChassisGroup{{UUID: "group-uuid", Name: "group1"}}, "find", "HA_Chassis_Group", `name="group1"`)
+	host.addRows([]nbLogicalRouter{{UUID: "router-uuid", Name: "p-n"}}, "find", "Logical_Router", `name="p-n"`)
+	dryRun = true
+
+	err := connectOVStoOVN(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = deleteProjectNetwork("p", network{name: "n"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queries ran on the host, and the plan is built from their output.
+	requireInOrder(t, host.commands, []string{
+		"ip route get 8.8.8.8",
+		"ovs-vsctl get open_vswitch . external_ids:system-id",
+	})
+
+	requireInOrder(t, plan, []string{
+		"ovs-vsctl set open_vswitch . external_ids:ovn-remote=tcp:10.109.89.178:6642 external_ids:ovn-remote-probe-interval=10000 external_ids:ovn-encap-ip=10.0.0.42 external_ids:ovn-encap-type=geneve",
+		testNbctl("--id=@row0", "create", "HA_Chassis", `chassis_name="chassis-uuid"`, "priority=42", "--", "add", "HA_Chassis_Group", "group-uuid", "ha_chassis", "@row0"),
+		testNbctl("destroy", "Logical_Router", "router-uuid"),
+	})
+
+	// Nothing that changes the host or the NB database ran, and no query was planned.
+	for _, command := range host.commands {
+		if !strings.Contains(command, " find ") && !strings.Contains(command, " get ") && !strings.Contains(command, " list ") {
+			t.Errorf("Command %q run in dry-run mode", command)
+		}
+	}
+
+	for _, command := range plan {
+		if strings.Contains(command, " find ") || strings.Contains(command, " get ") || strings.Contains(command, " list ") {
+			t.Errorf("Query %q recorded in the plan", command)
+		}
+	}
+}
+
+func TestNbctlTransaction(t *testing.T) {
+	host := setupTestHost(t, map[string]string{})
+
+	// Changes are only run on commit, in a single ovn-nbctl invocation. Rows created in the transaction are referred
+	// to by name until then.
+	nb.Begin()
+	router := &nbLogicalRouter{Name: "r"}
+	logicalSwitch := &nbLogicalSwitch{Name: "s"}
+	for _, create := range []func() error{
+		func() error { return nb.CreateLogicalRouter(router) },
+		func() error {
+			return nb.CreateNAT(router, &nbNAT{Type: "snat", ExternalIP: "192.0.2.10", LogicalIP: "10.0.0.0/24"})
+		},
+		func() error { return nb.CreateLogicalSwitch(logicalSwitch) },
+		func() error { return nb.DeleteLogicalSwitch(logicalSwitch) },
+	} {
+		err := create()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(host.commands) != 0 {
+		t.Fatalf("Commands run before commit: %v", host.commands)
+	}
+
+	commit := testNbctl(
+		"--id=@row0", "create", "Logical_Router", `name="r"`,
+		"--", "--id=@row1", "create", "NAT", `type="snat"`, `external_ip="192.0.2.10"`, `logical_ip="10.0.0.0/24"`,
+		"--", "add", "Logical_Router", "r", "nat", "@row1",
+		"--", "--id=@row2", "create", "Logical_Switch", `name="s"`,
+		"--", "destroy", "Logical_Switch", "s",
+	)
+	host.outputs[commit] = "router-uuid\nnat-uuid\nswitch-uuid\n"
+
+	err := nb.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(host.commands, "\n") != commit {
+		t.Fatalf("Expected command %q, got %v", commit, host.commands)
+	}
+
+	if router.UUID != "router-uuid" {
+		t.Errorf("Created router has UUID %q", router.UUID)
+	}
+
+	// Aborting discards the queued changes, and changes outside of a transaction are run straight away.
+	host.commands = nil
+	nb.Begin()
+	err = nb.CreateLogicalSwitch(&nbLogicalSwitch{Name: "t"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nb.Abort()
+	err = nb.DeleteLogicalRouter(router)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := testNbctl("destroy", "Logical_Router", "router-uuid")
+	if strings.Join(host.commands, "\n") != want {
+		t.Fatalf("Expected command %q, got %v", want, host.commands)
+	}
+}
+
+func TestEnsureStaticRoute(t *testing.T) {
+	outputPort := "r-lrp-ext"
+	srcIP := "src-ip"
+
+	tests := []struct {
+		name     string
+		existing []nbLogicalRouterStaticRoute
+		prefix   string
+		nexthop  string
+		want     []string
+	}{
+		{
+			name:    "missing route",
+			prefix:  "0.0.0.0/0",
+			nexthop: "192.0.2.1",
+			want:    []string{"0.0.0.0/0 via 192.0.2.1"},
+		},
+		{
+			name:     "same route",
+			existing: []nbLogicalRouterStaticRoute{{IPPrefix: "::/0", Nexthop: "2001:db8:0::1"}},
+			prefix:   "::/0",
+			nexthop:  "2001:db8::1",
+			want:     []string{"::/0 via 2001:db8:0::1"},
+		},
+		{
+			name:     "nexthop changed",
+			existing: []nbLogicalRouterStaticRoute{{IPPrefix: "0.0.0.0/0", Nexthop: "192.0.2.254"}},
+			prefix:   "0.0.0.0/0",
+			nexthop:  "192.0.2.1",
+			want:     []string{"0.0.0.0/0 via 192.0.2.1"},
+		},
+		{
+			name: "other routes for the prefix left alone",
+			existing: []nbLogicalRouterStaticRoute{
+				{IPPrefix: "0.0.0.0/0", Nexthop: "192.0.2.2", OutputPort: &outputPort},
+				{IPPrefix: "0.0.0.0/0", Nexthop: "192.0.2.3", Policy: &srcIP},
+				{IPPrefix: "0.0.0.0/0", Nexthop: "169.254.100.1", ExternalIDs: map[string]string{"ic-learned-route": "x"}},
+			},
+			prefix:  "0.0.0.0/0",
+			nexthop: "192.0.2.1",
+			want:    []string{"0.0.0.0/0 via 169.254.100.1", "0.0.0.0/0 via 192.0.2.1", "0.0.0.0/0 via 192.0.2.2", "0.0.0.0/0 via 192.0.2.3"},
+		},
+		{
+			name: "marked route output port and policy corrected",
+			existing: []nbLogicalRouterStaticRoute{
+				{IPPrefix: "0.0.0.0/0", Nexthop: "192.0.2.2", OutputPort: &outputPort},
+				{IPPrefix: "0.0.0.0/0", Nexthop: "192.0.2.1", OutputPort: &outputPort, Policy: &srcIP, ExternalIDs: map[string]string{"lxd_default_route": "r"}},
+			},
+			prefix:  "0.0.0.0/0",
+			nexthop: "192.0.2.1",
+			want:    []string{"0.0.0.0/0 via 192.0.2.1", "0.0.0.0/0 via 192.0.2.2"},
+		},
+		{
+			name:     "route marked for another router",
+			existing: []nbLogicalRouterStaticRoute{{IPPrefix: "0.0.0.0/0", Nexthop: "192.0.2.1", Policy: &srcIP, ExternalIDs: map[string]string{"lxd_default_route": "other"}}},
+			prefix:   "0.0.0.0/0",
+			nexthop:  "192.0.2.1",
+			want:     []string{"0.0.0.0/0 via 192.0.2.1", "0.0.0.0/0 via 192.0.2.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			router := createTestRouter(t, tt.existing, nil)
+
+			// The router is read again each time, as it lists its static routes.
+			ensure := func() error {
+				router, err := nb.GetLogicalRouter("r")
+				if err != nil {
+					return err
+				}
+
+				routes, err := nb.GetLogicalRouterStaticRoutes(router)
+				if err != nil {
+					return err
+				}
+
+				return ensureStaticRoute(router, routes, tt.prefix, tt.nexthop)
+			}
+
+			err := ensure()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router, _ = nb.GetLogicalRouter("r")
+			routes, _ := nb.GetLogicalRouterStaticRoutes(router)
+			got := testRowNames(routes)
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Errorf("Expected routes %v, got %v", tt.want, got)
+			}
+
+			// Exactly one route is marked as the router's, with no output port and the default policy.
+			marked := 0
+			for _, route := range routes {
+				if route.ExternalIDs["lxd_default_route"] != "r" {
+					continue
+				}
+
+				marked++
+				if !net.ParseIP(route.Nexthop).Equal(net.ParseIP(tt.nexthop)) || route.OutputPort != nil || route.Policy != nil {
+					t.Errorf("Unexpected marked route %+v", route)
+				}
+			}
+
+			if marked != 1 {
+				t.Errorf("Expected one marked route, got %d", marked)
+			}
+
+			requireNoWrites(t, db, ensure)
+		})
+	}
+}
+
+func TestEnsureSNATs(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []nbNAT
+		want     map[string]string
+		wantNATs []string
+	}{
+		{
+			name:     "missing rules",
+			want:     map[string]string{"10.0.0.0/24": "192.0.2.10", "fd00::/64": "2001:db8::10"},
+			wantNATs: []string{"snat 10.0.0.0/24 -> 192.0.2.10", "snat fd00::/64 -> 2001:db8::10"},
+		},
+		{
+			name:     "same rule",
+			existing: []nbNAT{{Type: "snat", LogicalIP: "10.0.0.0/24", ExternalIP: "192.0.2.10"}},
+			want:     map[string]string{"10.0.0.0/24": "192.0.2.10"},
+			wantNATs: []string{"snat 10.0.0.0/24 -> 192.0.2.10"},
+		},
+		{
+			name:     "external address changed",
+			existing: []nbNAT{{Type: "snat", LogicalIP: "10.0.0.0/24", ExternalIP: "192.0.2.11"}},
+			want:     map[string]string{"10.0.0.0/24": "192.0.2.10"},
+			wantNATs: []string{"snat 10.0.0.0/24 -> 192.0.2.10"},
+		},
+		{
+			name: "other rules",
+			existing: []nbNAT{
+				{Type: "snat", LogicalIP: "10.1.0.0/24", ExternalIP: "192.0.2.10"},
+				{Type: "dnat_and_snat", LogicalIP: "10.0.0.5", ExternalIP: "192.0.2.20"},
+			},
+			want:     map[string]string{},
+			wantNATs: []string{"dnat_and_snat 10.0.0.5 -> 192.0.2.20"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, _ := setupTestNB(t)
+			router := createTestRouter(t, nil, tt.existing)
+
+			// The router is read again each time, as it lists its NAT rules.
+			ensure := func() error {
+				router, err := nb.GetLogicalRouter("r")
+				if err != nil {
+					return err
+				}
+
+				nats, err := nb.GetLogicalRouterNATs(router)
+				if err != nil {
+					return err
+				}
+
+				return ensureSNATs(router, nats, tt.want)
+			}
+
+			err := ensure()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			router, _ = nb.GetLogicalRouter("r")
+			nats, _ := nb.GetLogicalRouterNATs(router)
+			got := testRowNames(nats)
+			if strings.Join(got, ", ") != strings.Join(tt.wantNATs, ", ") {
+				t.Errorf("Expected NAT rules %v, got %v", tt.wantNATs, got)
+			}
+
+			requireNoWrites(t, db, ensure)
+		})
+	}
+}
@@ -0,0 +1,815 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+
+	"github.com/lxc/lxd/shared"
+	"gopkg.in/yaml.v2"
+)
+
+// topology describes the uplinks, projects and networks that should exist.
+// It is loaded from a YAML file (JSON is also accepted as it is a subset of YAML).
+type topology struct {
+	Uplinks    []topologyUplink    `yaml:"uplinks"`
+	SubnetPool *topologySubnetPool `yaml:"subnet_pool,omitempty"`
+
+	Interconnection *topologyInterconnection `yaml:"interconnection,omitempty"`
+
+	Projects []topologyProject `yaml:"projects"`
+}
+
+// topologyUplink describes an external network that project network routers connect to.
+// Networks that don't set external_ip4 are given the next free address in ipv4_range, with the prefix length of
+// ipv4_subnet. External IPv6 addresses are always derived from ipv6_prefix and the router port MAC address.
+// The IPv4 or IPv6 settings can be left out if no network using the uplink has that IP family.
+type topologyUplink struct {
+	Name       string `yaml:"name"`
+	Bridge     string `yaml:"bridge"`
+	IPv4Subnet string `yaml:"ipv4_subnet,omitempty"`
+	IPv4Range  string `yaml:"ipv4_range,omitempty"`
+	IPv6Prefix string `yaml:"ipv6_prefix,omitempty"`
+	Gateway4   string `yaml:"gateway4,omitempty"`
+	Gateway6   string `yaml:"gateway6,omitempty"`
+	DNS4       string `yaml:"dns4,omitempty"`
+	DNS6       string `yaml:"dns6,omitempty"`
+}
+
+// topologySubnetPool describes the ranges that internal subnets are allocated from for networks that don't set
+// their gateways. Either range can be left out if every network sets the gateway of that IP family.
+type topologySubnetPool struct {
+	IPv4           string `yaml:"ipv4,omitempty"`
+	IPv4SubnetSize int    `yaml:"ipv4_subnet_size,omitempty"`
+	IPv6           string `yaml:"ipv6,omitempty"`
+	IPv6SubnetSize int    `yaml:"ipv6_subnet_size,omitempty"`
+}
+
+// topologyInterconnection describes how this OVN deployment, as one availability zone, connects to others through
+// transit switches. The transit switches are created in the interconnection NB database, and ovn-ic adds them to the
+// NB database of each availability zone. The route options set whether ovn-ic advertises the routes of this
+// availability zone's routers, and learns those of other availability zones, with or without default routes.
+type topologyInterconnection struct {
+	AvailabilityZone      string                  `yaml:"availability_zone"` // Must be unique across the availability zones.
+	RouteAdvertise        bool                    `yaml:"route_advertise,omitempty"`
+	RouteAdvertiseDefault bool                    `yaml:"route_advertise_default,omitempty"`
+	RouteLearn            bool                    `yaml:"route_learn,omitempty"`
+	RouteLearnDefault     bool                    `yaml:"route_learn_default,omitempty"`
+	TransitSwitches       []topologyTransitSwitch `yaml:"transit_switches"`
+}
+
+// topologyTransitSwitch describes a transit switch and the subnets its router ports are addressed from. The subnets
+// are shared by every availability zone attached to the switch. IPv4 addresses are allocated from the subnet, and
+// IPv6 addresses are derived from the router port MAC address.
+type topologyTransitSwitch struct {
+	Name string `yaml:"name"`
+	IPv4 string `yaml:"ipv4,omitempty"`
+	IPv6 string `yaml:"ipv6,omitempty"`
+}
+
+// topologyProject describes a project and the networks it should have.
+type topologyProject struct {
+	Name     string            `yaml:"name"`
+	Networks []topologyNetwork `yaml:"networks"`
+}
+
+// topologyNetwork describes a single project network and the instances connected to it.
+type topologyNetwork struct {
+	Name      string             `yaml:"name"`
+	Uplink    string             `yaml:"uplink"`
+	Families  []string           `yaml:"families,omitempty"` // ipv4 and/or ipv6, both by default.
+	Routed    []string           `yaml:"routed,omitempty"`   // IP families routed to the uplink without SNAT.
+	Gateway4  string             `yaml:"gateway4,omitempty"`
+	Gateway6  string             `yaml:"gateway6,omitempty"`
+	ExtIP4    string             `yaml:"external_ip4,omitempty"`
+	DNS4      string             `yaml:"dns4,omitempty"`
+	DNS6      string             `yaml:"dns6,omitempty"`
+	IPv6Mode  string             `yaml:"ipv6_mode,omitempty"` // slaac (default), dhcpv6_stateless or dhcpv6_stateful.
+	Instances []topologyInstance `yaml:"instances,omitempty"`
+
+	// TransitSwitch is the transit switch the network's router is attached to, if any.
+	TransitSwitch string `yaml:"transit_switch,omitempty"`
+
+	// ReservedIPs are IPv4 addresses and FIRST-LAST ranges in the internal subnet that OVN doesn't hand out, for
+	// VIPs, load balancers and hosts configured outside OVN.
+	ReservedIPs []string `yaml:"reserved_ips,omitempty"`
+
+	// Routes are static routes on the network's router, in addition to the default routes to the uplink.
+	Routes []topologyRoute `yaml:"routes,omitempty"`
+}
+
+// topologyRoute describes a static route. The nexthop must be in the subnet of one of the router's ports, or of the
+// output port if one is set.
+type topologyRoute struct {
+	Prefix     string `yaml:"prefix"`
+	Nexthop    string `yaml:"nexthop"`
+	OutputPort string `yaml:"output_port,omitempty"`
+	Policy     string `yaml:"policy,omitempty"` // dst-ip (default) or src-ip.
+}
+
+// topologyInstance describes an instance connected to a project network. Instances without static addresses can be
+// written as just their name, and get their addresses from OVN.
+type topologyInstance struct {
+	Name string `yaml:"name"`
+	IPv4 string `yaml:"ipv4,omitempty"`
+	IPv6 string `yaml:"ipv6,omitempty"`
+}
+
+// UnmarshalYAML accepts either an instance name or a mapping with the name and static addresses.
+func (i *topologyInstance) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	name := ""
+	err := unmarshal(&name)
+	if err == nil {
+		*i = topologyInstance{Name: name}
+		return nil
+	}
+
+	type plain topologyInstance
+	return unmarshal((*plain)(i))
+}
+
+// MarshalYAML writes instances without static addresses as just their name.
+func (i topologyInstance) MarshalYAML() (interface{}, error) {
+	if i.IPv4 == "" && i.IPv6 == "" {
+		return i.Name, nil
+	}
+
+	type plain topologyInstance
+	return plain(i), nil
+}
+
+// loadTopology reads and validates the topology file at path.
+func loadTopology(path string) (*topology, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := topology{}
+	err = yaml.UnmarshalStrict(content, &t)
+	if err != nil {
+		return nil, fmt.Errorf("Failed parsing topology file %q: %w", path, err)
+	}
+
+	err = t.validate()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid topology file %q: %w", path, err)
+	}
+
+	return &t, nil
+}
+
+// write writes the topology to w as YAML, in the format loadTopology reads.
+func (t *topology) write(w io.Writer) error {
+	content, err := yaml.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(content)
+	return err
+}
+
+// validate checks that the topology is complete and self consistent.
+func (t *topology) validate() error {
+	uplinks := make(map[string]topologyUplink, len(t.Uplinks))
+	for _, uplink := range t.Uplinks {
+		if uplink.Name == "" {
+			return fmt.Errorf("Uplink name missing")
+		}
+
+		_, found := uplinks[uplink.Name]
+		if found {
+			return fmt.Errorf("Duplicate uplink %q", uplink.Name)
+		}
+
+		uplinks[uplink.Name] = uplink
+
+		if uplink.Bridge == "" {
+			return fmt.Errorf("Uplink %q bridge missing", uplink.Name)
+		}
+
+		// An uplink needs the settings of at least one IP family, and IPv6 needs both the prefix and the gateway.
+		if uplink.Gateway4 == "" && uplink.IPv6Prefix == "" && uplink.Gateway6 == "" {
+			return fmt.Errorf("Uplink %q has no gateway4 or ipv6_prefix and gateway6", uplink.Name)
+		}
+
+		if (uplink.IPv6Prefix == "") != (uplink.Gateway6 == "") {
+			return fmt.Errorf("Uplink %q ipv6_prefix and gateway6 must be set together", uplink.Name)
+		}
+
+		if uplink.IPv6Prefix != "" {
+			_, _, err := net.ParseCIDR(uplink.IPv6Prefix)
+			if err != nil {
+				return fmt.Errorf("Uplink %q invalid ipv6_prefix: %w", uplink.Name, err)
+			}
+		}
+
+		for key, value := range map[string]string{"gateway4": uplink.Gateway4, "gateway6": uplink.Gateway6, "dns4": uplink.DNS4, "dns6": uplink.DNS6} {
+			if value != "" && net.ParseIP(value) == nil {
+				return fmt.Errorf("Uplink %q invalid %s %q", uplink.Name, key, value)
+			}
+		}
+
+		if (uplink.IPv4Subnet == "") != (uplink.IPv4Range == "") {
+			return fmt.Errorf("Uplink %q ipv4_subnet and ipv4_range must be set together", uplink.Name)
+		}
+
+		if uplink.IPv4Range != "" && uplink.Gateway4 == "" {
+			return fmt.Errorf("Uplink %q ipv4_range requires gateway4", uplink.Name)
+		}
+
+		if uplink.IPv4Range != "" {
+			ip, subnet, err := net.ParseCIDR(uplink.IPv4Subnet)
+			if err != nil || ip.To4() == nil {
+				return fmt.Errorf("Uplink %q invalid ipv4_subnet %q", uplink.Name, uplink.IPv4Subnet)
+			}
+
+			first, last, err := parseIPRange(uplink.IPv4Range)
+			if err != nil {
+				return fmt.Errorf("Uplink %q invalid ipv4_range: %w", uplink.Name, err)
+			}
+
+			if !subnet.Contains(first) || !subnet.Contains(last) {
+				return fmt.Errorf("Uplink %q ipv4_range %q not within ipv4_subnet %q", uplink.Name, uplink.IPv4Range, uplink.IPv4Subnet)
+			}
+		}
+	}
+
+	if t.SubnetPool != nil {
+		err := t.SubnetPool.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if t.Interconnection != nil {
+		err := t.Interconnection.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(t.Projects) == 0 {
+		return fmt.Errorf("No projects defined")
+	}
+
+	projects := make(map[string]struct{}, len(t.Projects))
+	extIPs := make(map[string]string)
+	for _, project := range t.Projects {
+		if project.Name == "" {
+			return fmt.Errorf("Project name missing")
+		}
+
+		_, found := projects[project.Name]
+		if found {
+			return fmt.Errorf("Duplicate project %q", project.Name)
+		}
+
+		projects[project.Name] = struct{}{}
+
+		networks := make(map[string]struct{}, len(project.Networks))
+		for _, n := range project.Networks {
+			if n.Name == "" {
+				return fmt.Errorf("Project %q network name missing", project.Name)
+			}
+
+			_, found := networks[n.Name]
+			if found {
+				return fmt.Errorf("Project %q duplicate network %q", project.Name, n.Name)
+			}
+
+			networks[n.Name] = struct{}{}
+
+			uplink, found := uplinks[n.Uplink]
+			if !found {
+				return fmt.Errorf("Project %q network %q unknown uplink %q", project.Name, n.Name, n.Uplink)
+			}
+
+			ipv4, ipv6, err := n.families()
+			if err != nil {
+				return fmt.Errorf("Project %q network %q %w", project.Name, n.Name, err)
+			}
+
+			routed4, routed6, err := n.routed()
+			if err != nil {
+				return fmt.Errorf("Project %q network %q %w", project.Name, n.Name, err)
+			}
+
+			// Settings of an IP family the network doesn't have would be silently ignored.
+			for _, unused := range []struct {
+				key    string
+				value  bool
+				family bool
+			}{
+				{"gateway4", n.Gateway4 != "", ipv4},
+				{"external_ip4", n.ExtIP4 != "", ipv4},
+				{"dns4", n.DNS4 != "", ipv4},
+				{"reserved_ips", len(n.ReservedIPs) > 0, ipv4},
+				{"routed ipv4", routed4, ipv4},
+				{"gateway6", n.Gateway6 != "", ipv6},
+				{"dns6", n.DNS6 != "", ipv6},
+				{"ipv6_mode", n.IPv6Mode != "", ipv6},
+				{"routed ipv6", routed6, ipv6},
+			} {
+				if unused.value && !unused.family {
+					return fmt.Errorf("Project %q network %q %s set but the network has no IP family using it", project.Name, n.Name, unused.key)
+				}
+			}
+
+			if ipv4 && uplink.Gateway4 == "" {
+				return fmt.Errorf("Project %q network %q has IPv4 but uplink %q has no gateway4", project.Name, n.Name, uplink.Name)
+			}
+
+			if ipv6 && uplink.IPv6Prefix == "" {
+				return fmt.Errorf("Project %q network %q has IPv6 but uplink %q has no ipv6_prefix", project.Name, n.Name, uplink.Name)
+			}
+
+			// The external address is allocated from the uplink's range if left out.
+			if ipv4 && n.ExtIP4 == "" && uplink.IPv4Range == "" {
+				return fmt.Errorf("Project %q network %q external_ip4 missing and uplink %q has no ipv4_range", project.Name, n.Name, uplink.Name)
+			}
+
+			if n.ExtIP4 != "" {
+				extIP, _, err := net.ParseCIDR(n.ExtIP4)
+				if err != nil {
+					return fmt.Errorf("Project %q network %q invalid external_ip4: %w", project.Name, n.Name, err)
+				}
+
+				otherNetwork, found := extIPs[extIP.String()]
+				if found {
+					return fmt.Errorf("Project %q network %q external_ip4 %q already used by %s", project.Name, n.Name, extIP.String(), otherNetwork)
+				}
+
+				extIPs[extIP.String()] = fmt.Sprintf("%s/%s", project.Name, n.Name)
+			}
+
+			// Gateways left out are allocated from the subnet pool.
+			for _, gw := range []struct {
+				key    string
+				value  string
+				pool   string
+				family bool
+			}{{"gateway4", n.Gateway4, "ipv4", ipv4}, {"gateway6", n.Gateway6, "ipv6", ipv6}} {
+				if !gw.family {
+					continue
+				}
+
+				if gw.value == "" {
+					if t.SubnetPool == nil || (gw.pool == "ipv4" && t.SubnetPool.IPv4 == "") || (gw.pool == "ipv6" && t.SubnetPool.IPv6 == "") {
+						return fmt.Errorf("Project %q network %q %s missing and no %s subnet pool defined", project.Name, n.Name, gw.key, gw.pool)
+					}
+
+					continue
+				}
+
+				_, _, err := net.ParseCIDR(gw.value)
+				if err != nil {
+					return fmt.Errorf("Project %q network %q invalid %s: %w", project.Name, n.Name, gw.key, err)
+				}
+			}
+
+			// DNS servers can be inherited from the uplink, but must be set somewhere for each IP family.
+			dns := map[string]string{}
+			if ipv4 {
+				dns["dns4"] = n.DNS4
+				if dns["dns4"] == "" {
+					dns["dns4"] = uplink.DNS4
+				}
+			}
+
+			if ipv6 {
+				dns["dns6"] = n.DNS6
+				if dns["dns6"] == "" {
+					dns["dns6"] = uplink.DNS6
+				}
+			}
+
+			for key, value := range dns {
+				if net.ParseIP(value) == nil {
+					return fmt.Errorf("Project %q network %q invalid %s %q", project.Name, n.Name, key, value)
+				}
+			}
+
+			if n.IPv6Mode != "" && !shared.StringInSlice(n.IPv6Mode, []string{"slaac", "dhcpv6_stateless", "dhcpv6_stateful"}) {
+				return fmt.Errorf("Project %q network %q invalid ipv6_mode %q (must be slaac, dhcpv6_stateless or dhcpv6_stateful)", project.Name, n.Name, n.IPv6Mode)
+			}
+
+			reserved := make([][2]net.IP, 0, len(n.ReservedIPs))
+			for _, value := range n.ReservedIPs {
+				var err error
+				first, last := net.ParseIP(value), net.ParseIP(value)
+				if strings.Contains(value, "-") {
+					first, last, err = parseIPRange(value)
+				}
+
+				if err != nil || first == nil || first.To4() == nil {
+					return fmt.Errorf("Project %q network %q invalid reserved_ips entry %q (must be an IPv4 address or FIRST-LAST range)", project.Name, n.Name, value)
+				}
+
+				if n.Gateway4 != "" {
+					_, subnet, _ := net.ParseCIDR(n.Gateway4)
+					if !subnet.Contains(first) || !subnet.Contains(last) {
+						return fmt.Errorf("Project %q network %q reserved_ips entry %q not within %q", project.Name, n.Name, value, subnet.String())
+					}
+				}
+
+				reserved = append(reserved, [2]net.IP{first.To4(), last.To4()})
+			}
+
+			if n.TransitSwitch != "" {
+				ts, err := t.transitSwitch(n.TransitSwitch)
+				if err != nil {
+					return fmt.Errorf("Project %q network %q unknown transit switch %q", project.Name, n.Name, n.TransitSwitch)
+				}
+
+				if !(ipv4 && ts.IPv4 != "") && !(ipv6 && ts.IPv6 != "") {
+					return fmt.Errorf("Project %q network %q has no IP family in common with transit switch %q", project.Name, n.Name, ts.Name)
+				}
+			}
+
+			routes := make(map[topologyRoute]struct{}, len(n.Routes))
+			for _, route := range n.Routes {
+				_, prefix, err := net.ParseCIDR(route.Prefix)
+				if err != nil {
+					return fmt.Errorf("Project %q network %q invalid route prefix %q", project.Name, n.Name, route.Prefix)
+				}
+
+				nexthop := net.ParseIP(route.Nexthop)
+				if nexthop == nil || (nexthop.To4() != nil) != (prefix.IP.To4() != nil) {
+					return fmt.Errorf("Project %q network %q route %q invalid nexthop %q", project.Name, n.Name, route.Prefix, route.Nexthop)
+				}
+
+				if (prefix.IP.To4() != nil && !ipv4) || (prefix.IP.To4() == nil && !ipv6) {
+					return fmt.Errorf("Project %q network %q route %q is of an IP family the network doesn't have", project.Name, n.Name, route.Prefix)
+				}
+
+				if route.Policy != "" && route.Policy != "dst-ip" && route.Policy != "src-ip" {
+					return fmt.Errorf("Project %q network %q route %q invalid policy %q (must be dst-ip or src-ip)", project.Name, n.Name, route.Prefix, route.Policy)
+				}
+
+				// The default routes to the uplink gateway are managed separately.
+				ones, _ := prefix.Mask.Size()
+				if ones == 0 && route.Policy != "src-ip" {
+					return fmt.Errorf("Project %q network %q route %q conflicts with the default route to the uplink", project.Name, n.Name, route.Prefix)
+				}
+
+				key := topologyRoute{Prefix: prefix.String(), Nexthop: nexthop.String(), OutputPort: route.OutputPort, Policy: route.Policy}
+				if key.Policy == "" {
+					key.Policy = "dst-ip"
+				}
+
+				_, found := routes[key]
+				if found {
+					return fmt.Errorf("Project %q network %q duplicate route %q via %q", project.Name, n.Name, route.Prefix, route.Nexthop)
+				}
+
+				routes[key] = struct{}{}
+			}
+
+			instances := make(map[string]struct{}, len(n.Instances))
+			staticIPs := make(map[string]string)
+			for _, instance := range n.Instances {
+				if instance.Name == "" {
+					return fmt.Errorf("Project %q network %q instance name missing", project.Name, n.Name)
+				}
+
+				_, found := instances[instance.Name]
+				if found {
+					return fmt.Errorf("Project %q network %q duplicate instance %q", project.Name, n.Name, instance.Name)
+				}
+
+				instances[instance.Name] = struct{}{}
+
+				if (instance.IPv4 != "" && !ipv4) || (instance.IPv6 != "" && !ipv6) {
+					return fmt.Errorf("Project %q network %q instance %q static address of an IP family the network doesn't have", project.Name, n.Name, instance.Name)
+				}
+
+				// OVN can't combine a static IPv6 address with a dynamic IPv4 one, whereas a missing static IPv6
+				// address is derived from the MAC address.
+				if instance.IPv6 != "" && instance.IPv4 == "" && ipv4 {
+					return fmt.Errorf("Project %q network %q instance %q static ipv6 requires a static ipv4", project.Name, n.Name, instance.Name)
+				}
+
+				// Without stateful DHCPv6 instances configure their IPv6 address from the MAC address, so port
+				// security would block any other address.
+				if instance.IPv6 != "" && n.IPv6Mode != "dhcpv6_stateful" {
+					return fmt.Errorf("Project %q network %q instance %q static ipv6 requires ipv6_mode dhcpv6_stateful", project.Name, n.Name, instance.Name)
+				}
+
+				for _, static := range []struct {
+					key   string
+					value string
+					gw    string
+					ipv4  bool
+				}{{"ipv4", instance.IPv4, n.Gateway4, true}, {"ipv6", instance.IPv6, n.Gateway6, false}} {
+					if static.value == "" {
+						continue
+					}
+
+					ip := net.ParseIP(static.value)
+					if ip == nil || (ip.To4() != nil) != static.ipv4 {
+						return fmt.Errorf("Project %q network %q instance %q invalid %s %q", project.Name, n.Name, instance.Name, static.key, static.value)
+					}
+
+					// Gateways allocated from the subnet pool are only known at run time, so are checked then.
+					if static.gw != "" {
+						_, subnet, _ := net.ParseCIDR(static.gw)
+						if !subnet.Contains(ip) {
+							return fmt.Errorf("Project %q network %q instance %q %s %q not within %q", project.Name, n.Name, instance.Name, static.key, static.value, subnet.String())
+						}
+					}
+
+					for _, r := range reserved {
+						if static.ipv4 && bytes.Compare(ip.To4(), r[0]) >= 0 && bytes.Compare(ip.To4(), r[1]) <= 0 {
+							return fmt.Errorf("Project %q network %q instance %q %s %q is reserved", project.Name, n.Name, instance.Name, static.key, static.value)
+						}
+					}
+
+					otherInstance, found := staticIPs[ip.String()]
+					if found {
+						return fmt.Errorf("Project %q network %q instance %q %s %q already used by instance %q", project.Name, n.Name, instance.Name, static.key, static.value, otherInstance)
+					}
+
+					staticIPs[ip.String()] = instance.Name
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// families returns whether the network has IPv4 and IPv6 addresses. Networks have both unless they list their
+// families.
+func (n *topologyNetwork) families() (bool, bool, error) {
+	if len(n.Families) == 0 {
+		return true, true, nil
+	}
+
+	return parseFamilies("families", n.Families)
+}
+
+// routed returns whether the network's IPv4 and IPv6 subnets are routed to the uplink rather than SNATed.
+func (n *topologyNetwork) routed() (bool, bool, error) {
+	return parseFamilies("routed", n.Routed)
+}
+
+// parseFamilies returns whether a list of IP families includes ipv4 and ipv6.
+func parseFamilies(key string, families []string) (bool, bool, error) {
+	ipv4, ipv6 := false, false
+	for _, family := range families {
+		switch family {
+		case "ipv4":
+			ipv4 = true
+		case "ipv6":
+			ipv6 = true
+		default:
+			return false, false, fmt.Errorf("invalid %s entry %q (must be ipv4 or ipv6)", key, family)
+		}
+	}
+
+	return ipv4, ipv6, nil
+}
+
+// validate checks the subnet pool ranges and fills in the default subnet sizes of /24 for IPv4 and /64 for IPv6.
+func (p *topologySubnetPool) validate() error {
+	if p.IPv4 == "" && p.IPv6 == "" {
+		return fmt.Errorf("Subnet pool has no ipv4 or ipv6 range")
+	}
+
+	if p.IPv4SubnetSize == 0 {
+		p.IPv4SubnetSize = 24
+	}
+
+	if p.IPv6SubnetSize == 0 {
+		p.IPv6SubnetSize = 64
+	}
+
+	for _, pool := range []struct {
+		key     string
+		cidr    string
+		size    int
+		maxSize int
+		ipv4    bool
+	}{
+		{"ipv4", p.IPv4, p.IPv4SubnetSize, 30, true},
+		{"ipv6", p.IPv6, p.IPv6SubnetSize, 64, false},
+	} {
+		if pool.cidr == "" {
+			continue
+		}
+
+		ip, poolNet, err := net.ParseCIDR(pool.cidr)
+		if err != nil {
+			return fmt.Errorf("Subnet pool invalid %s: %w", pool.key, err)
+		}
+
+		if (ip.To4() != nil) != pool.ipv4 {
+			return fmt.Errorf("Subnet pool %s %q is of the wrong IP family", pool.key, pool.cidr)
+		}
+
+		poolSize, _ := poolNet.Mask.Size()
+		if pool.size < poolSize || pool.size > pool.maxSize {
+			return fmt.Errorf("Subnet pool %s_subnet_size %d must be between %d and %d", pool.key, pool.size, poolSize, pool.maxSize)
+		}
+	}
+
+	return nil
+}
+
+// validate checks the availability zone name and the transit switches.
+func (ic *topologyInterconnection) validate() error {
+	if ic.AvailabilityZone == "" {
+		return fmt.Errorf("Interconnection availability_zone missing")
+	}
+
+	switches := make(map[string]struct{}, len(ic.TransitSwitches))
+	for _, ts := range ic.TransitSwitches {
+		if ts.Name == "" {
+			return fmt.Errorf("Transit switch name missing")
+		}
+
+		_, found := switches[ts.Name]
+		if found {
+			return fmt.Errorf("Duplicate transit switch %q", ts.Name)
+		}
+
+		switches[ts.Name] = struct{}{}
+
+		if ts.IPv4 == "" && ts.IPv6 == "" {
+			return fmt.Errorf("Transit switch %q has no ipv4 or ipv6 subnet", ts.Name)
+		}
+
+		// IPv6 addresses are derived from the MAC address, which takes the last 64 bits.
+		for _, subnet := range []struct {
+			key     string
+			cidr    string
+			maxSize int
+			ipv4    bool
+		}{{"ipv4", ts.IPv4, 30, true}, {"ipv6", ts.IPv6, 64, false}} {
+			if subnet.cidr == "" {
+				continue
+			}
+
+			ip, subnetNet, err := net.ParseCIDR(subnet.cidr)
+			if err != nil || (ip.To4() != nil) != subnet.ipv4 {
+				return fmt.Errorf("Transit switch %q invalid %s subnet %q", ts.Name, subnet.key, subnet.cidr)
+			}
+
+			size, _ := subnetNet.Mask.Size()
+			if size > subnet.maxSize {
+				return fmt.Errorf("Transit switch %q %s subnet %q must be /%d or larger", ts.Name, subnet.key, subnet.cidr, subnet.maxSize)
+			}
+		}
+	}
+
+	return nil
+}
+
+// transitSwitch returns the transit switch with the given name.
+func (t *topology) transitSwitch(name string) (*topologyTransitSwitch, error) {
+	if t.Interconnection != nil {
+		for i := range t.Interconnection.TransitSwitches {
+			if t.Interconnection.TransitSwitches[i].Name == name {
+				return &t.Interconnection.TransitSwitches[i], nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("Transit switch %q not found", name)
+}
+
+// uplink returns the uplink with the given name.
+func (t *topology) uplink(name string) (*topologyUplink, error) {
+	for i := range t.Uplinks {
+		if t.Uplinks[i].Name == name {
+			return &t.Uplinks[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("Uplink %q not found", name)
+}
+
+// networks returns the network definitions for a project, with uplink settings and DNS defaults applied. The settings
+// of an IP family the network doesn't have are left empty.
+func (t *topology) networks(project topologyProject) ([]network, error) {
+	networks := make([]network, 0, len(project.Networks))
+	for _, n := range project.Networks {
+		uplink, err := t.uplink(n.Uplink)
+		if err != nil {
+			return nil, err
+		}
+
+		ipv4, ipv6, err := n.families()
+		if err != nil {
+			return nil, err
+		}
+
+		routed4, routed6, err := n.routed()
+		if err != nil {
+			return nil, err
+		}
+
+		instances := make([]string, 0, len(n.Instances))
+		instanceIPs := map[string]instanceAddresses{}
+		for _, instance := range n.Instances {
+			instances = append(instances, instance.Name)
+			if instance.IPv4 != "" || instance.IPv6 != "" {
+				instanceIPs[instance.Name] = instanceAddresses{ipv4: instance.IPv4, ipv6: instance.IPv6}
+			}
+		}
+
+		routes := make([]staticRoute, 0, len(n.Routes))
+		for _, route := range n.Routes {
+			_, prefix, err := net.ParseCIDR(route.Prefix)
+			if err != nil {
+				return nil, err
+			}
+
+			policy := route.Policy
+			if policy == "" {
+				policy = "dst-ip"
+			}
+
+			routes = append(routes, staticRoute{prefix: prefix.String(), nexthop: net.ParseIP(route.Nexthop).String(), outputPort: route.OutputPort, policy: policy})
+		}
+
+		network := network{
+			name:        n.Name,
+			ipv4:        ipv4,
+			ipv6:        ipv6,
+			extBridge:   uplink.Bridge,
+			instances:   instances,
+			instanceIPs: instanceIPs,
+			routes:      routes,
+		}
+
+		// Default to the uplink's DNS servers if the network doesn't specify its own.
+		if ipv4 {
+			network.gw4 = n.Gateway4
+			network.dns4 = n.DNS4
+			if network.dns4 == "" {
+				network.dns4 = uplink.DNS4
+			}
+
+			network.extIP4 = n.ExtIP4
+			network.extIP4Subnet = uplink.IPv4Subnet
+			network.extIP4Range = uplink.IPv4Range
+			network.extGW4 = uplink.Gateway4
+			network.reservedIPs = n.ReservedIPs
+			network.routed4 = routed4
+		}
+
+		if ipv6 {
+			network.gw6 = n.Gateway6
+			network.dns6 = n.DNS6
+			if network.dns6 == "" {
+				network.dns6 = uplink.DNS6
+			}
+
+			network.ipv6Mode = n.IPv6Mode
+			if network.ipv6Mode == "" {
+				network.ipv6Mode = "slaac"
+			}
+
+			network.extIP6Prefix = uplink.IPv6Prefix
+			network.extGW6 = uplink.Gateway6
+			network.routed6 = routed6
+		}
+
+		// The transit router port only has the IP families both the network and the transit switch have.
+		if n.TransitSwitch != "" {
+			ts, err := t.transitSwitch(n.TransitSwitch)
+			if err != nil {
+				return nil, err
+			}
+
+			network.transitSwitch = ts.Name
+			network.availabilityZone = t.Interconnection.AvailabilityZone
+			for _, subnet := range []struct {
+				cidr   string
+				value  *string
+				family bool
+			}{{ts.IPv4, &network.transitNet4, ipv4}, {ts.IPv6, &network.transitNet6, ipv6}} {
+				if subnet.cidr == "" || !subnet.family {
+					continue
+				}
+
+				_, subnetNet, err := net.ParseCIDR(subnet.cidr)
+				if err != nil {
+					return nil, err
+				}
+
+				*subnet.value = subnetNet.String()
+			}
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
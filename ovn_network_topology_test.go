@@ -0,0 +1,805 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+// testTopology returns a valid topology with one uplink and one project with one network.
+func testTopology() *topology {
+	return &topology{
+		Uplinks: []topologyUplink{{
+			Name:       "uplink1",
+			Bridge:     "br0",
+			IPv6Prefix: "2001:db8::/64",
+			Gateway4:   "192.0.2.1",
+			Gateway6:   "2001:db8::1",
+			DNS4:       "192.0.2.53",
+			DNS6:       "2001:db8::53",
+		}},
+		Projects: []topologyProject{{
+			Name: "p",
+			Networks: []topologyNetwork{{
+				Name:      "n",
+				Uplink:    "uplink1",
+				Gateway4:  "10.0.0.1/24",
+				Gateway6:  "fd00::1/64",
+				ExtIP4:    "192.0.2.10/24",
+				Instances: []topologyInstance{{Name: "c1"}},
+			}},
+		}},
+	}
+}
+
+// testInterconnection returns interconnection settings with transit switch "ts1", which has both IP families.
+func testInterconnection() *topologyInterconnection {
+	return &topologyInterconnection{
+		AvailabilityZone: "az1",
+		TransitSwitches:  []topologyTransitSwitch{{Name: "ts1", IPv4: "169.254.100.0/24", IPv6: "fd10::/64"}},
+	}
+}
+
+func TestTopologyValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(t *topology)
+		check  func(t *testing.T, top *topology) // Checks the defaults filled in by a valid topology.
+		errMsg string                            // Empty if the topology is valid.
+	}{
+		{
+			name:  "valid",
+			setup: func(t *topology) {},
+		},
+		{
+			name:   "uplink name missing",
+			setup:  func(t *topology) { t.Uplinks[0].Name = "" },
+			errMsg: "Uplink name missing",
+		},
+		{
+			name:   "duplicate uplink",
+			setup:  func(t *topology) { t.Uplinks = append(t.Uplinks, t.Uplinks[0]) },
+			errMsg: `Duplicate uplink "uplink1"`,
+		},
+		{
+			name:   "uplink bridge missing",
+			setup:  func(t *topology) { t.Uplinks[0].Bridge = "" },
+			errMsg: `Uplink "uplink1" bridge missing`,
+		},
+		{
+			name:   "invalid uplink IPv6 prefix",
+			setup:  func(t *topology) { t.Uplinks[0].IPv6Prefix = "2001:db8::" },
+			errMsg: `Uplink "uplink1" invalid ipv6_prefix`,
+		},
+		{
+			name:   "invalid uplink IPv4 gateway",
+			setup:  func(t *topology) { t.Uplinks[0].Gateway4 = "192.0.2.1/24" },
+			errMsg: `Uplink "uplink1" invalid gateway4`,
+		},
+		{
+			name:   "invalid uplink IPv6 gateway",
+			setup:  func(t *topology) { t.Uplinks[0].Gateway6 = "2001:db8::1/64" },
+			errMsg: `Uplink "uplink1" invalid gateway6`,
+		},
+		{
+			name:   "invalid uplink DNS server",
+			setup:  func(t *topology) { t.Uplinks[0].DNS4 = "192.0.2.53/24" },
+			errMsg: `Uplink "uplink1" invalid dns4 "192.0.2.53/24"`,
+		},
+		{
+			name: "uplink without gateways",
+			setup: func(t *topology) {
+				t.Uplinks[0].Gateway4 = ""
+				t.Uplinks[0].IPv6Prefix = ""
+				t.Uplinks[0].Gateway6 = ""
+			},
+			errMsg: `Uplink "uplink1" has no gateway4 or ipv6_prefix and gateway6`,
+		},
+		{
+			name:   "uplink IPv6 prefix without a gateway",
+			setup:  func(t *topology) { t.Uplinks[0].Gateway6 = "" },
+			errMsg: `Uplink "uplink1" ipv6_prefix and gateway6 must be set together`,
+		},
+		{
+			name: "uplink IPv4 range without a gateway",
+			setup: func(t *topology) {
+				t.Uplinks[0].IPv4Subnet = "192.0.2.0/24"
+				t.Uplinks[0].IPv4Range = "192.0.2.100-192.0.2.199"
+				t.Uplinks[0].Gateway4 = ""
+			},
+			errMsg: `Uplink "uplink1" ipv4_range requires gateway4`,
+		},
+		{
+			name:   "uplink IPv4 range without a subnet",
+			setup:  func(t *topology) { t.Uplinks[0].IPv4Range = "192.0.2.100-192.0.2.199" },
+			errMsg: `Uplink "uplink1" ipv4_subnet and ipv4_range must be set together`,
+		},
+		{
+			name: "invalid uplink IPv4 subnet",
+			setup: func(t *topology) {
+				t.Uplinks[0].IPv4Subnet = "2001:db8::/64"
+				t.Uplinks[0].IPv4Range = "192.0.2.100-192.0.2.199"
+			},
+			errMsg: `Uplink "uplink1" invalid ipv4_subnet "2001:db8::/64"`,
+		},
+		{
+			name: "invalid uplink IPv4 range",
+			setup: func(t *topology) {
+				t.Uplinks[0].IPv4Subnet = "192.0.2.0/24"
+				t.Uplinks[0].IPv4Range = "192.0.2.199-192.0.2.100"
+			},
+			errMsg: `Uplink "uplink1" invalid ipv4_range`,
+		},
+		{
+			name: "uplink IPv4 range outside the subnet",
+			setup: func(t *topology) {
+				t.Uplinks[0].IPv4Subnet = "192.0.2.0/25"
+				t.Uplinks[0].IPv4Range = "192.0.2.100-192.0.2.199"
+			},
+			errMsg: `Uplink "uplink1" ipv4_range "192.0.2.100-192.0.2.199" not within ipv4_subnet "192.0.2.0/25"`,
+		},
+		{
+			name: "subnet pool defaults",
+			setup: func(t *topology) {
+				t.SubnetPool = &topologySubnetPool{IPv4: "10.10.0.0/16", IPv6: "fd10::/48"}
+				t.Projects[0].Networks[0].Gateway4 = ""
+				t.Projects[0].Networks[0].Gateway6 = ""
+			},
+			check: func(t *testing.T, top *topology) {
+				if top.SubnetPool.IPv4SubnetSize != 24 || top.SubnetPool.IPv6SubnetSize != 64 {
+					t.Errorf("Unexpected default subnet sizes %+v", top.SubnetPool)
+				}
+			},
+		},
+		{
+			name:   "empty subnet pool",
+			setup:  func(t *topology) { t.SubnetPool = &topologySubnetPool{} },
+			errMsg: "Subnet pool has no ipv4 or ipv6 range",
+		},
+		{
+			name:   "invalid subnet pool",
+			setup:  func(t *topology) { t.SubnetPool = &topologySubnetPool{IPv4: "10.10.0.0"} },
+			errMsg: "Subnet pool invalid ipv4",
+		},
+		{
+			name:   "subnet pool of the wrong family",
+			setup:  func(t *topology) { t.SubnetPool = &topologySubnetPool{IPv6: "10.10.0.0/16"} },
+			errMsg: `Subnet pool ipv6 "10.10.0.0/16" is of the wrong IP family`,
+		},
+		{
+			name:   "subnet size larger than the pool",
+			setup:  func(t *topology) { t.SubnetPool = &topologySubnetPool{IPv4: "10.10.0.0/16", IPv4SubnetSize: 8} },
+			errMsg: "Subnet pool ipv4_subnet_size 8 must be between 16 and 30",
+		},
+		{
+			name:   "IPv6 subnet size smaller than /64",
+			setup:  func(t *topology) { t.SubnetPool = &topologySubnetPool{IPv6: "fd10::/48", IPv6SubnetSize: 80} },
+			errMsg: "Subnet pool ipv6_subnet_size 80 must be between 48 and 64",
+		},
+		{
+			name: "gateway missing without a pool",
+			setup: func(t *topology) {
+				t.SubnetPool = &topologySubnetPool{IPv4: "10.10.0.0/16"}
+				t.Projects[0].Networks[0].Gateway6 = ""
+			},
+			errMsg: `Project "p" network "n" gateway6 missing and no ipv6 subnet pool defined`,
+		},
+		{
+			name:   "no projects",
+			setup:  func(t *topology) { t.Projects = nil },
+			errMsg: "No projects defined",
+		},
+		{
+			name:   "project name missing",
+			setup:  func(t *topology) { t.Projects[0].Name = "" },
+			errMsg: "Project name missing",
+		},
+		{
+			name:   "duplicate project",
+			setup:  func(t *topology) { t.Projects = append(t.Projects, topologyProject{Name: "p"}) },
+			errMsg: `Duplicate project "p"`,
+		},
+		{
+			name:   "network name missing",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Name = "" },
+			errMsg: `Project "p" network name missing`,
+		},
+		{
+			name: "duplicate network",
+			setup: func(t *topology) {
+				n := t.Projects[0].Networks[0]
+				n.ExtIP4 = "192.0.2.11/24"
+				t.Projects[0].Networks = append(t.Projects[0].Networks, n)
+			},
+			errMsg: `Project "p" duplicate network "n"`,
+		},
+		{
+			name:   "unknown uplink",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Uplink = "uplink2" },
+			errMsg: `Project "p" network "n" unknown uplink "uplink2"`,
+		},
+		{
+			name:   "invalid IPv4 gateway",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Gateway4 = "10.0.0.1" },
+			errMsg: `Project "p" network "n" invalid gateway4`,
+		},
+		{
+			name:   "invalid IPv6 gateway",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Gateway6 = "fd00::1" },
+			errMsg: `Project "p" network "n" invalid gateway6`,
+		},
+		{
+			name:   "invalid external IPv4 address",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].ExtIP4 = "192.0.2.10" },
+			errMsg: `Project "p" network "n" invalid external_ip4`,
+		},
+		{
+			name:   "external IPv4 address missing without a range",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].ExtIP4 = "" },
+			errMsg: `Project "p" network "n" external_ip4 missing and uplink "uplink1" has no ipv4_range`,
+		},
+		{
+			name: "external IPv4 address from the uplink range",
+			setup: func(t *topology) {
+				t.Uplinks[0].IPv4Subnet = "192.0.2.0/24"
+				t.Uplinks[0].IPv4Range = "192.0.2.100-192.0.2.199"
+				t.Projects[0].Networks[0].ExtIP4 = ""
+			},
+		},
+		{
+			name: "DNS servers inherited from the uplink",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].DNS4 = ""
+				t.Projects[0].Networks[0].DNS6 = ""
+			},
+		},
+		{
+			name: "no IPv4 DNS server",
+			setup: func(t *topology) {
+				t.Uplinks[0].DNS4 = ""
+				t.Projects[0].Networks[0].DNS4 = ""
+			},
+			errMsg: `Project "p" network "n" invalid dns4 ""`,
+		},
+		{
+			name:   "invalid IPv6 DNS server",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].DNS6 = "fd00::53/64" },
+			errMsg: `Project "p" network "n" invalid dns6 "fd00::53/64"`,
+		},
+		{
+			name:  "IPv6 mode",
+			setup: func(t *topology) { t.Projects[0].Networks[0].IPv6Mode = "dhcpv6_stateful" },
+		},
+		{
+			name:   "invalid IPv6 mode",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].IPv6Mode = "stateful" },
+			errMsg: `Project "p" network "n" invalid ipv6_mode "stateful" (must be slaac, dhcpv6_stateless or dhcpv6_stateful)`,
+		},
+		{
+			name: "IPv4-only network",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Families = []string{"ipv4"}
+				t.Projects[0].Networks[0].Gateway6 = ""
+			},
+		},
+		{
+			name: "IPv6-only network on an IPv6-only uplink",
+			setup: func(t *topology) {
+				t.Uplinks[0].Gateway4 = ""
+				t.Uplinks[0].DNS4 = ""
+				t.Projects[0].Networks[0].Families = []string{"ipv6"}
+				t.Projects[0].Networks[0].Gateway4 = ""
+				t.Projects[0].Networks[0].ExtIP4 = ""
+			},
+		},
+		{
+			name:   "invalid families entry",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Families = []string{"ipv5"} },
+			errMsg: `Project "p" network "n" invalid families entry "ipv5" (must be ipv4 or ipv6)`,
+		},
+		{
+			name:   "setting of an IP family the network doesn't have",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Families = []string{"ipv4"} },
+			errMsg: `Project "p" network "n" gateway6 set but the network has no IP family using it`,
+		},
+		{
+			name:  "routed network",
+			setup: func(t *topology) { t.Projects[0].Networks[0].Routed = []string{"ipv4", "ipv6"} },
+		},
+		{
+			name:   "invalid routed entry",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Routed = []string{"ipv5"} },
+			errMsg: `Project "p" network "n" invalid routed entry "ipv5" (must be ipv4 or ipv6)`,
+		},
+		{
+			name: "routed IP family the network doesn't have",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Families = []string{"ipv4"}
+				t.Projects[0].Networks[0].Gateway6 = ""
+				t.Projects[0].Networks[0].Routed = []string{"ipv6"}
+			},
+			errMsg: `Project "p" network "n" routed ipv6 set but the network has no IP family using it`,
+		},
+		{
+			name: "routes",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Routes = []topologyRoute{
+					{Prefix: "10.50.0.0/16", Nexthop: "10.0.0.254"},
+					{Prefix: "fd50::/48", Nexthop: "fd00::254"},
+					{Prefix: "0.0.0.0/0", Nexthop: "192.0.2.5", OutputPort: "p-n-lrp-ext", Policy: "src-ip"},
+				}
+			},
+		},
+		{
+			name: "invalid route prefix",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "10.50.0.0", Nexthop: "10.0.0.254"}}
+			},
+			errMsg: `Project "p" network "n" invalid route prefix "10.50.0.0"`,
+		},
+		{
+			name: "invalid route nexthop",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "10.50.0.0/16", Nexthop: "10.0.0.254/24"}}
+			},
+			errMsg: `Project "p" network "n" route "10.50.0.0/16" invalid nexthop "10.0.0.254/24"`,
+		},
+		{
+			name: "route nexthop of the wrong family",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "10.50.0.0/16", Nexthop: "fd00::254"}}
+			},
+			errMsg: `Project "p" network "n" route "10.50.0.0/16" invalid nexthop "fd00::254"`,
+		},
+		{
+			name: "route of an IP family the network doesn't have",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Families = []string{"ipv4"}
+				t.Projects[0].Networks[0].Gateway6 = ""
+				t.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "fd50::/48", Nexthop: "fd00::254"}}
+			},
+			errMsg: `Project "p" network "n" route "fd50::/48" is of an IP family the network doesn't have`,
+		},
+		{
+			name: "invalid route policy",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "10.50.0.0/16", Nexthop: "10.0.0.254", Policy: "dst"}}
+			},
+			errMsg: `Project "p" network "n" route "10.50.0.0/16" invalid policy "dst" (must be dst-ip or src-ip)`,
+		},
+		{
+			name: "default route",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "0.0.0.0/0", Nexthop: "192.0.2.5"}}
+			},
+			errMsg: `Project "p" network "n" route "0.0.0.0/0" conflicts with the default route to the uplink`,
+		},
+		{
+			name: "duplicate route",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "10.50.0.0/16", Nexthop: "10.0.0.254"}, {Prefix: "10.50.0.1/16", Nexthop: "10.0.0.254", Policy: "dst-ip"}}
+			},
+			errMsg: `Project "p" network "n" duplicate route "10.50.0.1/16" via "10.0.0.254"`,
+		},
+		{
+			name: "transit switch",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Projects[0].Networks[0].TransitSwitch = "ts1"
+			},
+		},
+		{
+			name: "availability zone missing",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.AvailabilityZone = ""
+			},
+			errMsg: "Interconnection availability_zone missing",
+		},
+		{
+			name: "transit switch name missing",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.TransitSwitches[0].Name = ""
+			},
+			errMsg: "Transit switch name missing",
+		},
+		{
+			name: "duplicate transit switch",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.TransitSwitches = append(t.Interconnection.TransitSwitches, t.Interconnection.TransitSwitches[0])
+			},
+			errMsg: `Duplicate transit switch "ts1"`,
+		},
+		{
+			name: "transit switch without subnets",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.TransitSwitches[0] = topologyTransitSwitch{Name: "ts1"}
+			},
+			errMsg: `Transit switch "ts1" has no ipv4 or ipv6 subnet`,
+		},
+		{
+			name: "transit switch IPv4 subnet of the wrong family",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.TransitSwitches[0].IPv4 = "fd10::/64"
+			},
+			errMsg: `Transit switch "ts1" invalid ipv4 subnet "fd10::/64"`,
+		},
+		{
+			name: "transit switch IPv4 subnet too small",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.TransitSwitches[0].IPv4 = "169.254.100.0/31"
+			},
+			errMsg: `Transit switch "ts1" ipv4 subnet "169.254.100.0/31" must be /30 or larger`,
+		},
+		{
+			name: "transit switch IPv6 subnet too small",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.TransitSwitches[0].IPv6 = "fd10::/80"
+			},
+			errMsg: `Transit switch "ts1" ipv6 subnet "fd10::/80" must be /64 or larger`,
+		},
+		{
+			name: "unknown transit switch",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Projects[0].Networks[0].TransitSwitch = "ts2"
+			},
+			errMsg: `Project "p" network "n" unknown transit switch "ts2"`,
+		},
+		{
+			name:   "transit switch without interconnection",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].TransitSwitch = "ts1" },
+			errMsg: `Project "p" network "n" unknown transit switch "ts1"`,
+		},
+		{
+			name: "transit switch without a common IP family",
+			setup: func(t *topology) {
+				t.Interconnection = testInterconnection()
+				t.Interconnection.TransitSwitches[0].IPv4 = ""
+				t.Projects[0].Networks[0].Families = []string{"ipv4"}
+				t.Projects[0].Networks[0].Gateway6 = ""
+				t.Projects[0].Networks[0].TransitSwitch = "ts1"
+			},
+			errMsg: `Project "p" network "n" has no IP family in common with transit switch "ts1"`,
+		},
+		{
+			name: "IPv4 network on an uplink without IPv4",
+			setup: func(t *topology) {
+				t.Uplinks[0].Gateway4 = ""
+				t.Uplinks[0].DNS4 = ""
+			},
+			errMsg: `Project "p" network "n" has IPv4 but uplink "uplink1" has no gateway4`,
+		},
+		{
+			name: "IPv6 network on an uplink without IPv6",
+			setup: func(t *topology) {
+				t.Uplinks[0].IPv6Prefix = ""
+				t.Uplinks[0].Gateway6 = ""
+			},
+			errMsg: `Project "p" network "n" has IPv6 but uplink "uplink1" has no ipv6_prefix`,
+		},
+		{
+			name: "external IPv4 address used twice",
+			setup: func(t *topology) {
+				n := t.Projects[0].Networks[0]
+				n.Name = "m"
+				n.ExtIP4 = "192.0.2.10/25"
+				t.Projects[0].Networks = append(t.Projects[0].Networks, n)
+			},
+			errMsg: `Project "p" network "m" external_ip4 "192.0.2.10" already used by p/n`,
+		},
+		{
+			name:   "instance name missing",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].Instances = []topologyInstance{{}} },
+			errMsg: `Project "p" network "n" instance name missing`,
+		},
+		{
+			name: "duplicate instance",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1"}, {Name: "c1"}}
+			},
+			errMsg: `Project "p" network "n" duplicate instance "c1"`,
+		},
+		{
+			name: "static addresses",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].IPv6Mode = "dhcpv6_stateful"
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.0.0.10", IPv6: "fd00::10"}, {Name: "c2", IPv4: "10.0.0.11"}}
+			},
+		},
+		{
+			name: "static IPv6 address without an IPv4 one",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv6: "fd00::10"}}
+			},
+			errMsg: `Project "p" network "n" instance "c1" static ipv6 requires a static ipv4`,
+		},
+		{
+			name: "static IPv6 address without stateful DHCPv6",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].IPv6Mode = "dhcpv6_stateless"
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.0.0.10", IPv6: "fd00::10"}}
+			},
+			errMsg: `Project "p" network "n" instance "c1" static ipv6 requires ipv6_mode dhcpv6_stateful`,
+		},
+		{
+			name: "static IPv6 address on an IPv6-only network",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Families = []string{"ipv6"}
+				t.Projects[0].Networks[0].Gateway4 = ""
+				t.Projects[0].Networks[0].ExtIP4 = ""
+				t.Projects[0].Networks[0].IPv6Mode = "dhcpv6_stateful"
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv6: "fd00::10"}}
+			},
+		},
+		{
+			name: "static address of an IP family the network doesn't have",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Families = []string{"ipv4"}
+				t.Projects[0].Networks[0].Gateway6 = ""
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.0.0.10", IPv6: "fd00::10"}}
+			},
+			errMsg: `Project "p" network "n" instance "c1" static address of an IP family the network doesn't have`,
+		},
+		{
+			name: "static IPv4 address of the wrong family",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "fd00::10"}}
+			},
+			errMsg: `Project "p" network "n" instance "c1" invalid ipv4 "fd00::10"`,
+		},
+		{
+			name: "static IPv4 address outside the subnet",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.0.1.10"}}
+			},
+			errMsg: `Project "p" network "n" instance "c1" ipv4 "10.0.1.10" not within "10.0.0.0/24"`,
+		},
+		{
+			name: "static IPv6 address outside the subnet",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].IPv6Mode = "dhcpv6_stateful"
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.0.0.10", IPv6: "fd01::10"}}
+			},
+			errMsg: `Project "p" network "n" instance "c1" ipv6 "fd01::10" not within "fd00::/64"`,
+		},
+		{
+			name: "static address used twice",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.0.0.10"}, {Name: "c2", IPv4: "10.0.0.10"}}
+			},
+			errMsg: `Project "p" network "n" instance "c2" ipv4 "10.0.0.10" already used by instance "c1"`,
+		},
+		{
+			name:  "reserved addresses",
+			setup: func(t *topology) { t.Projects[0].Networks[0].ReservedIPs = []string{"10.0.0.5", "10.0.0.1-10.0.0.10"} },
+		},
+		{
+			name:   "invalid reserved range",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].ReservedIPs = []string{"10.0.0.10-10.0.0.5"} },
+			errMsg: `Project "p" network "n" invalid reserved_ips entry "10.0.0.10-10.0.0.5"`,
+		},
+		{
+			name:   "reserved IPv6 address",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].ReservedIPs = []string{"fd00::5"} },
+			errMsg: `Project "p" network "n" invalid reserved_ips entry "fd00::5"`,
+		},
+		{
+			name:   "reserved range outside the subnet",
+			setup:  func(t *topology) { t.Projects[0].Networks[0].ReservedIPs = []string{"10.0.0.250-10.0.1.5"} },
+			errMsg: `Project "p" network "n" reserved_ips entry "10.0.0.250-10.0.1.5" not within "10.0.0.0/24"`,
+		},
+		{
+			name: "static address reserved",
+			setup: func(t *topology) {
+				t.Projects[0].Networks[0].ReservedIPs = []string{"10.0.0.2-10.0.0.10"}
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.0.0.5"}}
+			},
+			errMsg: `Project "p" network "n" instance "c1" ipv4 "10.0.0.5" is reserved`,
+		},
+		{
+			name: "static address with a gateway from the subnet pool",
+			setup: func(t *topology) {
+				t.SubnetPool = &topologySubnetPool{IPv4: "10.10.0.0/16"}
+				t.Projects[0].Networks[0].Gateway4 = ""
+				t.Projects[0].Networks[0].Instances = []topologyInstance{{Name: "c1", IPv4: "10.10.0.10"}}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			top := testTopology()
+			tt.setup(top)
+
+			err := top.validate()
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				if tt.check != nil {
+					tt.check(t, top)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestTopologyNetworks(t *testing.T) {
+	top := testTopology()
+	top.Projects[0].Networks = append(top.Projects[0].Networks, topologyNetwork{
+		Name:     "m",
+		Uplink:   "uplink1",
+		Routed:   []string{"ipv6"},
+		Gateway4: "10.0.1.1/24",
+		Gateway6: "fd00:0:0:1::1/64",
+		ExtIP4:   "192.0.2.11/24",
+		DNS4:     "1.1.1.1",
+		DNS6:     "2606:4700:4700::1111",
+	}, topologyNetwork{
+		Name:          "v6",
+		Uplink:        "uplink1",
+		Families:      []string{"ipv6"},
+		Gateway6:      "fd00:0:0:2::1/64",
+		TransitSwitch: "ts1",
+	})
+	top.Interconnection = testInterconnection()
+	top.Projects[0].Networks[0].Instances = append(top.Projects[0].Networks[0].Instances, topologyInstance{Name: "c2", IPv4: "10.0.0.20"})
+	top.Projects[0].Networks[0].Routes = []topologyRoute{{Prefix: "172.16.0.1/16", Nexthop: "10.0.0.5"}}
+
+	networks, err := top.networks(top.Projects[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []network{
+		{
+			name:         "n",
+			ipv4:         true,
+			ipv6:         true,
+			gw4:          "10.0.0.1/24",
+			gw6:          "fd00::1/64",
+			dns4:         "192.0.2.53",
+			dns6:         "2001:db8::53",
+			ipv6Mode:     "slaac",
+			extBridge:    "br0",
+			extIP4:       "192.0.2.10/24",
+			extIP6Prefix: "2001:db8::/64",
+			extGW4:       "192.0.2.1",
+			extGW6:       "2001:db8::1",
+			instances:    []string{"c1", "c2"},
+			instanceIPs:  map[string]instanceAddresses{"c2": {ipv4: "10.0.0.20"}},
+			routes:       []staticRoute{{prefix: "172.16.0.0/16", nexthop: "10.0.0.5", policy: "dst-ip"}},
+		},
+		{
+			name:         "m",
+			ipv4:         true,
+			ipv6:         true,
+			gw4:          "10.0.1.1/24",
+			gw6:          "fd00:0:0:1::1/64",
+			dns4:         "1.1.1.1",
+			dns6:         "2606:4700:4700::1111",
+			ipv6Mode:     "slaac",
+			extBridge:    "br0",
+			extIP4:       "192.0.2.11/24",
+			extIP6Prefix: "2001:db8::/64",
+			extGW4:       "192.0.2.1",
+			extGW6:       "2001:db8::1",
+			routed6:      true,
+			instances:    []string{},
+			instanceIPs:  map[string]instanceAddresses{},
+			routes:       []staticRoute{},
+		},
+		{
+			name:             "v6",
+			ipv6:             true,
+			gw6:              "fd00:0:0:2::1/64",
+			dns6:             "2001:db8::53",
+			ipv6Mode:         "slaac",
+			extBridge:        "br0",
+			extIP6Prefix:     "2001:db8::/64",
+			extGW6:           "2001:db8::1",
+			instances:        []string{},
+			instanceIPs:      map[string]instanceAddresses{},
+			routes:           []staticRoute{},
+			transitSwitch:    "ts1",
+			transitNet6:      "fd10::/64",
+			availabilityZone: "az1",
+		},
+	}
+
+	if !reflect.DeepEqual(networks, want) {
+		t.Errorf("Expected networks %+v, got %+v", want, networks)
+	}
+}
+
+func TestLoadTopology(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		errMsg  string
+	}{
+		{
+			name:    "example",
+			content: "",
+		},
+		{
+			name:    "unknown field",
+			content: "uplinks: []\nprojects: []\nnetworks: []\n",
+			errMsg:  "Failed parsing topology file",
+		},
+		{
+			name:    "invalid",
+			content: "uplinks: []\nprojects: []\n",
+			errMsg:  "Invalid topology file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "topology.yaml"
+			if tt.content != "" {
+				path = filepath.Join(t.TempDir(), "topology.yaml")
+				err := ioutil.WriteFile(path, []byte(tt.content), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := loadTopology(path)
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Fatalf("Expected error %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
+
+func TestTopologyInstanceYAML(t *testing.T) {
+	content := "- c1\n- name: c2\n  ipv4: 10.0.0.10\n  ipv6: fd00::10\n"
+
+	var instances []topologyInstance
+	err := yaml.UnmarshalStrict([]byte(content), &instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []topologyInstance{{Name: "c1"}, {Name: "c2", IPv4: "10.0.0.10", IPv6: "fd00::10"}}
+	if !reflect.DeepEqual(instances, want) {
+		t.Fatalf("Expected instances %+v, got %+v", want, instances)
+	}
+
+	// Instances without static addresses are written back as just their name.
+	out, err := yaml.Marshal(instances)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(out) != content {
+		t.Errorf("Expected %q, got %q", content, string(out))
+	}
+}